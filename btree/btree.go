@@ -4,8 +4,12 @@ import (
 	"github.com/jmgilman/kv"
 )
 
-// Tree implementsa a MemoryStore using an in-memory BTree for holding data
+// Tree implements a MemoryStore using an in-memory balanced binary search tree
+// for holding data. Put, Get and Lookup take O(log n) time regardless of the
+// order keys are written in. Keys are ordered by the Comparator of the tree,
+// or bytewise if it has none.
 type Tree struct {
+	cmp  kv.Comparator
 	root *node
 	size int
 }
@@ -16,9 +20,25 @@ func (t *Tree) Delete(key string) error {
 }
 
 // Get searches for the given key in the tree structure and returns its
-// associated KVPair or kv.ErrorNoSuchKey if the key was not found.
+// associated KVPair or kv.ErrorNoSuchKey if the key was not found or has been
+// deleted.
 func (t *Tree) Get(key string) (*kv.KVPair, error) {
-	return t.root.get(key)
+	return t.root.get(key, t.comparator())
+}
+
+// Iterator returns a kv.Iterator over every KVPair in the tree structure,
+// including tombstones. The iterator keeps seeing the tree as it was when it
+// was created, so the tree may be written to while it's in use as long as
+// creating it and writing are synchronized.
+func (t *Tree) Iterator() kv.Iterator {
+	return &iterator{cmp: t.comparator(), root: t.root}
+}
+
+// Lookup searches for the given key in the tree structure and returns its
+// associated KVPair, including tombstones, or kv.ErrorNoSuchKey if the key was
+// not found.
+func (t *Tree) Lookup(key string) (*kv.KVPair, error) {
+	return t.root.lookup(key, t.comparator())
 }
 
 // Max returns the KVPair with the highest key in the tree structure.
@@ -60,60 +80,75 @@ func (t *Tree) Range(key string) (*kv.KVPair, *kv.KVPair, error) {
 		return nil, nil, kv.ErrorOutOfRange
 	}
 
+	cmp := t.comparator()
 	min := t.Min().Key
 	max := t.Max().Key
 
-	if key < min || key > max {
+	if cmp.Compare(key, min) < 0 || cmp.Compare(key, max) > 0 {
 		return nil, nil, kv.ErrorOutOfRange
-	} else if key == min {
-		rnode := t.root.getClosestRight(key)
-		return nil, &rnode.pair, nil
-	} else if key == max {
-		lnode := t.root.getClosestLeft(key)
-		return &lnode.pair, nil, nil
 	}
 
-	lnode := t.root.getClosestLeft(key)
-	rnode := t.root.getClosestRight(key)
+	var left, right *kv.KVPair
+	if lnode := t.root.getClosestLeft(key, cmp); lnode != nil {
+		left = &lnode.pair
+	}
+	if rnode := t.root.getClosestRight(key, cmp); rnode != nil {
+		right = &rnode.pair
+	}
 
-	return &lnode.pair, &rnode.pair, nil
+	return left, right, nil
 }
 
 // Pairs returns the contents of the tree structure as an ordered slice of
-// KVPair's.
+// KVPair's. Versions of the same key are ordered from newest to oldest.
 func (t *Tree) Pairs() []*kv.KVPair {
 	return t.root.pairs()
 }
 
-// Put adds a new KVPair into the tree structure or updates the value of the
-// associated KVPair if the key already exists.
+// Put adds a new KVPair into the tree structure. If the key already exists the
+// KVPair is kept as another version of it, ordered by sequence number, unless
+// it has the same sequence number as an existing version, which it replaces.
+// Get and Lookup always return the newest version.
 func (t *Tree) Put(pair kv.KVPair) error {
-	if t.root == nil {
-		t.root = &node{pair, nil, nil}
+	root, grown := t.root.put(pair, t.comparator())
+	root.red = false
+
+	t.root = root
+	if grown {
 		t.size++
-	} else {
-		if grown := t.root.put(pair); grown {
-			t.size++
-		}
 	}
 
 	return nil
 }
 
+// Size returns the number of KVPair's in the tree structure, counting each
+// version of a key.
 func (t *Tree) Size() int {
 	return t.size
 }
 
-// NewTreeFromSlice returns a tree structure created from a slice of ordered
-// KVPair's.
-func NewTreeFromSlice(pairs []kv.KVPair) Tree {
+// comparator returns the Comparator of the tree, defaulting to bytewise.
+func (t *Tree) comparator() kv.Comparator {
+	return kv.DefaultComparator(t.cmp)
+}
+
+// NewTree returns an empty tree structure which orders keys by the given
+// Comparator, or bytewise if it's nil.
+func NewTree(cmp kv.Comparator) *Tree {
+	return &Tree{cmp: cmp}
+}
+
+// NewTreeFromSlice returns a tree structure created from a slice of KVPair's
+// with unique keys, ordered by the given Comparator, or bytewise if it's nil.
+func NewTreeFromSlice(pairs []kv.KVPair, cmp kv.Comparator) Tree {
 	size := len(pairs)
 	if size == 0 {
-		return Tree{}
+		return Tree{cmp: cmp}
 	}
 
 	return Tree{
-		root: newNode(pairs),
+		cmp:  cmp,
+		root: newNode(pairs, kv.DefaultComparator(cmp)),
 		size: size,
 	}
 }
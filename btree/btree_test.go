@@ -2,9 +2,13 @@ package btree
 
 import (
 	"errors"
+	"fmt"
+	"math"
+	"sync"
 	"testing"
 
 	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
 	"github.com/jmgilman/kv/mock/helper"
 	"github.com/matryer/is"
 )
@@ -24,7 +28,7 @@ func NewFixedTree() Tree {
 
 func NewRandomTree(size int) (Tree, []kv.KVPair) {
 	pairs := helper.NewRandomSortedPairs(size)
-	return NewTreeFromSlice(pairs), pairs
+	return NewTreeFromSlice(pairs, nil), pairs
 }
 
 func TestTreeDelete(t *testing.T) {
@@ -57,6 +61,23 @@ func TestTreeGet(t *testing.T) {
 	is.True(errors.Is(err, kv.ErrorNoSuchKey))
 }
 
+func TestTreeLookup(t *testing.T) {
+	is := is.New(t)
+	tree, pairs := NewRandomTree(10)
+
+	// Deleted keys are returned as tombstones
+	pair := pairs[0]
+	is.NoErr(tree.Delete(pair.Key))
+
+	result, err := tree.Lookup(pair.Key)
+	is.NoErr(err)
+	is.True(result.Tombstone)
+
+	// Nonexistent key
+	_, err = tree.Lookup("1")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
 func TestTreeMax(t *testing.T) {
 	is := is.New(t)
 	tree, pairs := NewRandomTree(10)
@@ -104,6 +125,27 @@ func TestTreeRange(t *testing.T) {
 	// Key is above max
 	l, r, err = tree.Range("z")
 	is.True(errors.Is(err, kv.ErrorOutOfRange))
+
+	// Neighbours are found however the tree was balanced
+	var sequential Tree
+	for i := 0; i < 100; i += 2 {
+		key := fmt.Sprintf("key%04d", i)
+		sequential.Put(kv.NewKVPair(key, []byte(key)))
+	}
+	for i := 1; i < 98; i += 2 {
+		l, r, err = sequential.Range(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(l.Key, fmt.Sprintf("key%04d", i-1))
+		is.Equal(r.Key, fmt.Sprintf("key%04d", i+1))
+	}
+
+	// Only key
+	var single Tree
+	single.Put(kv.NewKVPair("a", []byte("a")))
+	l, r, err = single.Range("a")
+	is.NoErr(err)
+	is.Equal(l, nil)
+	is.Equal(r, nil)
 }
 
 func TestTreePairs(t *testing.T) {
@@ -152,9 +194,262 @@ func TestNewTreeFromSlice(t *testing.T) {
 	is := is.New(t)
 	pairs := helper.NewRandomSortedPairs(10)
 
-	tree := NewTreeFromSlice(pairs)
+	tree := NewTreeFromSlice(pairs, nil)
 	result := tree.Pairs()
 	for i, pair := range pairs {
 		is.Equal(*result[i], pair)
 	}
 }
+
+func TestTreeComparator(t *testing.T) {
+	is := is.New(t)
+	tree := NewTree(mock.ReverseComparator{})
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		tree.Put(kv.NewKVPair(key, []byte(key)))
+	}
+
+	// Pairs are ordered by the comparator
+	var keys []string
+	for _, pair := range tree.Pairs() {
+		keys = append(keys, pair.Key)
+	}
+	is.Equal(keys, []string{"e", "d", "c", "b", "a"})
+	is.Equal(tree.Min().Key, "e")
+	is.Equal(tree.Max().Key, "a")
+
+	pair, err := tree.Get("b")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("b"))
+
+	l, r, err := tree.Range("c")
+	is.NoErr(err)
+	is.Equal(l.Key, "d")
+	is.Equal(r.Key, "b")
+
+	// Iterators seek and move in the same order
+	iterator := tree.Iterator()
+	is.NoErr(iterator.Seek("cc"))
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "b")
+	is.NoErr(iterator.Prev())
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Key(), "d")
+
+	// Keys are compared as they are
+	binary := NewTree(nil)
+	binary.Put(kv.NewKVPair("\xff\x00", []byte("a")))
+	binary.Put(kv.NewKVPair("\x00\xff", []byte("b")))
+	binary.Put(kv.NewKVPair("A", []byte("c")))
+	binary.Put(kv.NewKVPair("a", []byte("d")))
+	is.Equal(binary.Size(), 4)
+	is.Equal(binary.Min().Key, "\x00\xff")
+	is.Equal(binary.Max().Key, "\xff\x00")
+
+	pair, err = binary.Get("A")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("c"))
+}
+
+func TestTreeIterator(t *testing.T) {
+	is := is.New(t)
+	tree := NewFixedTree()
+	tree.Delete("q")
+
+	// Every pair in order, including tombstones
+	iterator := tree.Iterator()
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(len(result), tree.Size())
+	for i, pair := range tree.Pairs() {
+		is.Equal(result[i], *pair)
+	}
+	is.True(result[3].Tombstone)
+
+	// Seek to an existing key
+	is.NoErr(iterator.Seek("m"))
+	is.Equal(iterator.Key(), "m")
+	is.Equal(iterator.Value(), []byte("m"))
+
+	// Seek between keys
+	is.NoErr(iterator.Seek("c"))
+	is.Equal(iterator.Key(), "i")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "m")
+
+	// Seek past the end
+	is.NoErr(iterator.Seek("z"))
+	is.True(!iterator.Valid())
+
+	// Empty tree
+	var empty Tree
+	result, err = helper.ReadIterator(empty.Iterator(), "")
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestTreeIteratorReverse(t *testing.T) {
+	is := is.New(t)
+	var tree Tree
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%04d", (i*7)%50)
+		tree.Put(kv.NewKVPair(key, []byte(key)))
+	}
+
+	// Every pair in reverse order
+	iterator := tree.Iterator()
+	pairs, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+
+	result, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(result, helper.ReversePairs(pairs))
+
+	// Step back from the middle
+	is.NoErr(iterator.SeekToLast())
+	for i := 0; i < 10; i++ {
+		is.NoErr(iterator.Prev())
+	}
+	is.Equal(iterator.Pair(), pairs[len(pairs)-11])
+
+	// Step back from the first key
+	is.NoErr(iterator.Seek(""))
+	is.NoErr(iterator.Prev())
+	is.True(!iterator.Valid())
+
+	// Empty tree
+	var empty Tree
+	result, err = helper.ReadIteratorReverse(empty.Iterator())
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestTreeIteratorVersions(t *testing.T) {
+	is := is.New(t)
+	var tree Tree
+	for seq := uint64(1); seq <= 6; seq++ {
+		key := fmt.Sprintf("key%d", seq%2)
+		pair := kv.NewKVPair(key, []byte(fmt.Sprint(seq)))
+		pair.Seq = seq
+		tree.Put(pair)
+	}
+	is.Equal(tree.Size(), 6)
+
+	// Versions are ordered from newest to oldest within a key
+	iterator := tree.Iterator()
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	var seqs []uint64
+	for _, pair := range result {
+		seqs = append(seqs, pair.Seq)
+	}
+	is.Equal(seqs, []uint64{6, 4, 2, 5, 3, 1})
+
+	// Reverse iteration visits the same versions backwards
+	reverse, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(reverse, helper.ReversePairs(result))
+
+	// Get returns the newest version
+	pair, err := tree.Get("key1")
+	is.NoErr(err)
+	is.Equal(pair.Seq, uint64(5))
+}
+
+func TestTreeBalanced(t *testing.T) {
+	size := 10000
+	is := is.New(t)
+
+	// Sequential keys are the worst case for an unbalanced tree
+	var tree Tree
+	for i := 0; i < size; i++ {
+		key := fmt.Sprintf("key%08d", i)
+		is.NoErr(tree.Put(kv.NewKVPair(key, []byte(key))))
+	}
+	is.Equal(tree.Size(), size)
+	is.True(!tree.root.isRed())
+
+	// Every path has the same number of black nodes and no red node has a red
+	// child, which bounds the height to twice the optimum
+	var check func(n *node) (int, int)
+	check = func(n *node) (int, int) {
+		if n == nil {
+			return 0, 0
+		}
+
+		lblack, lheight := check(n.left)
+		rblack, rheight := check(n.right)
+		is.Equal(lblack, rblack)
+		is.True(!n.right.isRed())
+		is.True(!(n.isRed() && n.left.isRed()))
+
+		if !n.isRed() {
+			lblack++
+		}
+		if rheight > lheight {
+			lheight = rheight
+		}
+
+		return lblack, lheight + 1
+	}
+
+	_, height := check(tree.root)
+	is.True(float64(height) <= 2*math.Log2(float64(size+1)))
+
+	// Keys are still in order
+	pairs := tree.Pairs()
+	for i := 1; i < len(pairs); i++ {
+		is.True(pairs[i-1].Key < pairs[i].Key)
+	}
+}
+
+func TestTreeIteratorWrites(t *testing.T) {
+	size := 1000
+	is := is.New(t)
+	var tree Tree
+	var pairs []kv.KVPair
+	for i := 0; i < size; i++ {
+		pair := kv.NewKVPair(fmt.Sprintf("key%04d", i), []byte("old"))
+		is.NoErr(tree.Put(pair))
+		pairs = append(pairs, pair)
+	}
+
+	before, err := helper.ReadIterator(tree.Iterator(), "")
+	is.NoErr(err)
+
+	// Writes made after the iterator was created aren't seen by it
+	iterator := tree.Iterator()
+	for i, pair := range pairs {
+		pair.Seq = 1
+		pair.Value = []byte("new")
+		is.NoErr(tree.Put(pair))
+		is.NoErr(tree.Put(kv.NewKVPair(fmt.Sprintf("new%04d", i), nil)))
+	}
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(result, before)
+
+	// Writers may carry on while iterators are read concurrently
+	var mu sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < size; i++ {
+			mu.Lock()
+			tree.Put(kv.NewKVPair(fmt.Sprintf("concurrent%04d", i), nil))
+			mu.Unlock()
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		mu.Lock()
+		iterator := tree.Iterator()
+		count := tree.Size()
+		mu.Unlock()
+
+		result, err := helper.ReadIterator(iterator, "")
+		is.NoErr(err)
+		is.Equal(len(result), count)
+	}
+	<-done
+}
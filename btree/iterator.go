@@ -0,0 +1,133 @@
+package btree
+
+import "github.com/jmgilman/kv"
+
+// iterator implements kv.Iterator over a Tree as it was when the iterator was
+// created. It keeps a stack of the nodes which still have to be visited moving
+// forward, with the current node on top, and the index of the current version
+// of that node's key. Nodes don't link to their parents, so moving backwards
+// walks down from the root again.
+type iterator struct {
+	cmp     kv.Comparator
+	root    *node
+	stack   []*node
+	version int
+}
+
+func (i *iterator) Close() error {
+	i.stack = nil
+	return nil
+}
+
+func (i *iterator) Key() string {
+	return i.top().pair.Key
+}
+
+// Next moves to the next version of the current key or, if there is none, to
+// the lowest key in the right subtree of the current node, or back up to its
+// closest ancestor on the left if it has none.
+func (i *iterator) Next() error {
+	if !i.Valid() {
+		return nil
+	}
+
+	n := i.top()
+	if i.version+1 < n.versions() {
+		i.version++
+		return nil
+	}
+
+	i.stack = i.stack[:len(i.stack)-1]
+	for n = n.right; n != nil; n = n.left {
+		i.stack = append(i.stack, n)
+	}
+	i.version = 0
+
+	return nil
+}
+
+func (i *iterator) Pair() kv.KVPair {
+	return i.top().version(i.version)
+}
+
+// Prev moves to the previous version of the current key or, if there is none,
+// walks down the tree to find the closest node whose key is lower than the
+// current one and seeks to its oldest version.
+func (i *iterator) Prev() error {
+	if !i.Valid() {
+		return nil
+	}
+
+	if i.version > 0 {
+		i.version--
+		return nil
+	}
+
+	key := i.top().pair.Key
+	var prev *node
+	for n := i.root; n != nil; {
+		if i.cmp.Compare(n.pair.Key, key) < 0 {
+			prev = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+
+	if prev == nil {
+		i.stack = i.stack[:0]
+		return nil
+	}
+
+	i.Seek(prev.pair.Key)
+	i.version = prev.versions() - 1
+	return nil
+}
+
+// Seek walks down the tree towards the given key, stacking every node whose
+// key isn't lower than it, which leaves the closest one on top. An empty key
+// stacks every node on the way to the lowest key.
+func (i *iterator) Seek(key string) error {
+	i.stack = i.stack[:0]
+	for n := i.root; n != nil; {
+		if key == "" || i.cmp.Compare(key, n.pair.Key) <= 0 {
+			i.stack = append(i.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	i.version = 0
+
+	return nil
+}
+
+// SeekToLast seeks to the oldest version of the highest key in the tree.
+func (i *iterator) SeekToLast() error {
+	if i.root == nil {
+		i.stack = i.stack[:0]
+		return nil
+	}
+
+	max := i.root
+	for max.right != nil {
+		max = max.right
+	}
+
+	i.Seek(max.pair.Key)
+	i.version = i.top().versions() - 1
+	return nil
+}
+
+func (i *iterator) Valid() bool {
+	return len(i.stack) > 0
+}
+
+func (i *iterator) Value() []byte {
+	return i.Pair().Value
+}
+
+// top returns the current node.
+func (i *iterator) top() *node {
+	return i.stack[len(i.stack)-1]
+}
@@ -1,80 +1,98 @@
 package btree
 
-import "github.com/jmgilman/kv"
+import (
+	"time"
 
-// node represents a node in a Tree
+	"github.com/jmgilman/kv"
+)
+
+// node represents a node in a Tree. It holds the newest version of its key
+// along with any older versions, ordered from newest to oldest. Nodes are
+// colored to keep the tree balanced as a left-leaning red-black tree: red
+// nodes are always the left child of a black node and every path from the
+// root to a leaf passes through the same number of black nodes.
+//
+// Nodes are never modified once they're part of a tree. Putting a KVPair
+// copies every node it changes, so a root keeps describing the tree as it was
+// when it was read.
 type node struct {
 	pair  kv.KVPair
 	left  *node
+	older []kv.KVPair
+	red   bool
 	right *node
 }
 
 // get searches for the given key in the tree node and returns its associated
-// KVPair or ErrorNoSuchKey if the key was not found.
-func (n *node) get(key string) (*kv.KVPair, error) {
-	if n == nil {
+// KVPair or ErrorNoSuchKey if the key was not found, has been deleted or has
+// expired.
+func (n *node) get(key string, cmp kv.Comparator) (*kv.KVPair, error) {
+	pair, err := n.lookup(key, cmp)
+	if err != nil {
+		return pair, err
+	}
+
+	if pair.Tombstone || pair.Expired(time.Now()) {
 		return &kv.KVPair{}, kv.ErrorNoSuchKey
 	}
 
-	if key == n.pair.Key {
-		if n.pair.Tombstone {
-			return &kv.KVPair{}, kv.ErrorNoSuchKey
+	return pair, nil
+}
+
+// getClosestLeft returns the node with the highest key which is lower than the
+// given key, or nil if there's none.
+func (n *node) getClosestLeft(key string, cmp kv.Comparator) *node {
+	var closest *node
+	for n != nil {
+		if cmp.Compare(n.pair.Key, key) < 0 {
+			closest = n
+			n = n.right
 		} else {
-			return &n.pair, nil
+			n = n.left
 		}
 	}
 
-	if key < n.pair.Key {
-		return n.left.get(key)
-	} else {
-		return n.right.get(key)
-	}
+	return closest
 }
 
-// getClosestLeft attempts to find the closest left-side node of the given key.
-// It is assumed that the key being passed falls within the range of the tree
-// and is not the lowest key.
-func (n *node) getClosestLeft(key string) *node {
-	if key <= n.pair.Key {
-		if n.left == nil {
-			return n
+// getClosestRight returns the node with the lowest key which is higher than the
+// given key, or nil if there's none.
+func (n *node) getClosestRight(key string, cmp kv.Comparator) *node {
+	var closest *node
+	for n != nil {
+		if cmp.Compare(n.pair.Key, key) > 0 {
+			closest = n
+			n = n.left
 		} else {
-			return n.left.getClosestLeft(key)
-		}
-	} else {
-		if n.right == nil {
-			return n
-		} else if key <= n.right.pair.Key && n.right.left == nil {
-			return n
-		} else {
-			return n.right.getClosestLeft(key)
+			n = n.right
 		}
 	}
+
+	return closest
 }
 
-// getClosestRight attempts to find the closest right-side node of the given
-// key. It is assumed that the key being passed falls within the range of the
-// tree and is not the highest key.
-func (n *node) getClosestRight(key string) *node {
-	if key < n.pair.Key {
-		if n.left == nil {
-			return n
-		} else if key >= n.left.pair.Key && n.left.right == nil {
-			return n
-		} else {
-			return n.left.getClosestRight(key)
-		}
+// lookup searches for the given key in the tree node and returns its
+// associated KVPair, including tombstones, or ErrorNoSuchKey if the key was not
+// found.
+func (n *node) lookup(key string, cmp kv.Comparator) (*kv.KVPair, error) {
+	if n == nil {
+		return &kv.KVPair{}, kv.ErrorNoSuchKey
+	}
+
+	c := cmp.Compare(key, n.pair.Key)
+	if c == 0 {
+		return &n.pair, nil
+	}
+
+	if c < 0 {
+		return n.left.lookup(key, cmp)
 	} else {
-		if n.right == nil {
-			return n
-		} else {
-			return n.right.getClosestRight(key)
-		}
+		return n.right.lookup(key, cmp)
 	}
 }
 
-// pairs returns the contents of the tree node as an ordered slice of
-// KVPair's.
+// pairs returns the contents of the tree node, including every version of each
+// key, as an ordered slice of KVPair's.
 func (n *node) pairs() []*kv.KVPair {
 	var pairs []*kv.KVPair
 	if n == nil {
@@ -86,47 +104,149 @@ func (n *node) pairs() []*kv.KVPair {
 
 	pairs = append(pairs, left...)
 	pairs = append(pairs, &n.pair)
+	for i := range n.older {
+		pairs = append(pairs, &n.older[i])
+	}
 	pairs = append(pairs, right...)
 	return pairs
 }
 
-// put adds a new KVPair into the tree node or updates the value of the
-// associated KVPair if the key already exists.
-func (n *node) put(kv kv.KVPair) bool {
-	if kv.Key < n.pair.Key {
-		if n.left == nil {
-			n.left = &node{kv, nil, nil}
-			return true
-		} else {
-			return n.left.put(kv)
-		}
-	} else if kv.Key > n.pair.Key {
-		if n.right == nil {
-			n.right = &node{kv, nil, nil}
-			return true
-		} else {
-			return n.right.put(kv)
-		}
+// put adds a new KVPair into the subtree rooted at the node, or adds it as a
+// version of the associated KVPair if the key already exists, and rebalances
+// the subtree on the way back up. The nodes it changes are copied rather than
+// modified. Returns the new root of the subtree and true if the tree grew.
+// The caller must color the root of the tree black.
+func (n *node) put(pair kv.KVPair, cmp kv.Comparator) (*node, bool) {
+	if n == nil {
+		return &node{pair: pair, red: true}, true
+	}
+
+	n = n.clone()
+	var grown bool
+	if c := cmp.Compare(pair.Key, n.pair.Key); c < 0 {
+		n.left, grown = n.left.put(pair, cmp)
+	} else if c > 0 {
+		n.right, grown = n.right.put(pair, cmp)
 	} else {
-		n.pair = kv
-		return false
+		grown = n.putVersion(pair)
+	}
+
+	if n.right.isRed() && !n.left.isRed() {
+		n = n.rotateLeft()
+	}
+	if n.left.isRed() && n.left.left.isRed() {
+		n = n.rotateRight()
 	}
+	if n.left.isRed() && n.right.isRed() {
+		n.flipColors()
+	}
+
+	return n, grown
 }
 
-// newNode returns a new node created from a slice of ordered KVPair's.
-func newNode(pairs []kv.KVPair) *node {
-	size := len(pairs)
-	if size == 0 {
-		return nil
+// putVersion adds the given KVPair as a version of the node's key, keeping
+// versions ordered from newest to oldest. A KVPair with the same sequence
+// number as an existing version replaces it. Older versions are copied into a
+// new slice rather than modified. Returns true if a version was added.
+func (n *node) putVersion(pair kv.KVPair) bool {
+	if pair.Seq == n.pair.Seq {
+		n.pair = pair
+		return false
+	} else if pair.Seq > n.pair.Seq {
+		n.older = append([]kv.KVPair{n.pair}, n.older...)
+		n.pair = pair
+		return true
+	}
+
+	older := make([]kv.KVPair, 0, len(n.older)+1)
+	for i := range n.older {
+		if pair.Seq == n.older[i].Seq {
+			older = append(older, pair)
+			n.older = append(older, n.older[i+1:]...)
+			return false
+		} else if pair.Seq > n.older[i].Seq {
+			older = append(older, pair)
+			n.older = append(older, n.older[i:]...)
+			return true
+		}
+
+		older = append(older, n.older[i])
 	}
 
-	node := &node{
-		pair: pairs[size/2],
-		left: newNode(pairs[0 : size/2]),
+	n.older = append(older, pair)
+	return true
+}
+
+// clone returns a copy of the node which can be modified without affecting
+// trees which hold the node.
+func (n *node) clone() *node {
+	c := *n
+	return &c
+}
+
+// flipColors splits a node with two red children by coloring them black and
+// passing the red up to the node. The children are copied before they're
+// recolored.
+func (n *node) flipColors() {
+	n.left = n.left.clone()
+	n.right = n.right.clone()
+
+	n.red = !n.red
+	n.left.red = !n.left.red
+	n.right.red = !n.right.red
+}
+
+// isRed returns true if the node is red. Nil nodes are black.
+func (n *node) isRed() bool {
+	return n != nil && n.red
+}
+
+// rotateLeft turns a red right child of the node into its parent and returns
+// it. The child is copied before it's changed.
+func (n *node) rotateLeft() *node {
+	x := n.right.clone()
+	n.right = x.left
+	x.left = n
+	x.red = n.red
+	n.red = true
+
+	return x
+}
+
+// rotateRight turns a red left child of the node into its parent and returns
+// it. The child is copied before it's changed.
+func (n *node) rotateRight() *node {
+	x := n.left.clone()
+	n.left = x.right
+	x.right = n
+	x.red = n.red
+	n.red = true
+
+	return x
+}
+
+// version returns the i'th newest version of the node's key.
+func (n *node) version(i int) kv.KVPair {
+	if i == 0 {
+		return n.pair
 	}
-	if i := size/2 + 1; i < size {
-		node.right = newNode(pairs[i:size])
+
+	return n.older[i-1]
+}
+
+// versions returns the number of versions of the node's key.
+func (n *node) versions() int {
+	return len(n.older) + 1
+}
+
+// newNode returns the root of a new tree created from a slice of KVPair's
+// ordered by the given Comparator.
+func newNode(pairs []kv.KVPair, cmp kv.Comparator) *node {
+	var root *node
+	for _, pair := range pairs {
+		root, _ = root.put(pair, cmp)
+		root.red = false
 	}
 
-	return node
+	return root
 }
@@ -3,28 +3,24 @@ package btree
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/jmgilman/kv"
 	"github.com/jmgilman/kv/mock/helper"
 	"github.com/matryer/is"
 )
 
-func NewFixedNode() node {
-	var node node
+// bytewise is the Comparator nodes are tested with.
+var bytewise = kv.BytewiseComparator{}
 
-	node.put(kv.NewKVPair("m", []byte("m")))
-	node.put(kv.NewKVPair("i", []byte("i")))
-	node.put(kv.NewKVPair("q", []byte("q")))
-	node.put(kv.NewKVPair("t", []byte("t")))
-	node.put(kv.NewKVPair("b", []byte("b")))
-	node.put(kv.NewKVPair("y", []byte("y")))
-
-	return node
+func NewFixedNode() *node {
+	tree := NewFixedTree()
+	return tree.root
 }
 
 func NewRandomNode(size int) (*node, []kv.KVPair) {
 	pairs := helper.NewRandomSortedPairs(size)
-	return newNode(pairs), pairs
+	return newNode(pairs, bytewise), pairs
 }
 
 func TestNodeGet(t *testing.T) {
@@ -33,19 +29,26 @@ func TestNodeGet(t *testing.T) {
 
 	// Get all keys
 	for _, pair := range pairs {
-		result, err := node.get(pair.Key)
+		result, err := node.get(pair.Key, bytewise)
 		is.NoErr(err)
 		is.Equal(result.Value, pair.Value)
 	}
 
 	// Nonexistent key
-	_, err := node.get("1")
+	_, err := node.get("1", bytewise)
 	is.True(errors.Is(err, kv.ErrorNoSuchKey))
 
 	// Deleted key
 	pair := kv.DeleteKVPair(pairs[0].Key)
-	node.put(pair)
-	_, err = node.get(pairs[0].Key)
+	node, _ = node.put(pair, bytewise)
+	_, err = node.get(pairs[0].Key, bytewise)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Expired key
+	pair = kv.NewKVPair(pairs[1].Key, pairs[1].Value)
+	pair.Expires = time.Now().Add(-time.Second).UnixNano()
+	node, _ = node.put(pair, bytewise)
+	_, err = node.get(pairs[1].Key, bytewise)
 	is.True(errors.Is(err, kv.ErrorNoSuchKey))
 }
 
@@ -53,13 +56,13 @@ func TestNodeGetClosestLeft(t *testing.T) {
 	is := is.New(t)
 	node := NewFixedNode()
 
-	closest := node.getClosestLeft("c")
+	closest := node.getClosestLeft("c", bytewise)
 	is.Equal(closest.pair.Key, "b")
 
-	closest = node.getClosestLeft("l")
+	closest = node.getClosestLeft("l", bytewise)
 	is.Equal(closest.pair.Key, "i")
 
-	closest = node.getClosestLeft("s")
+	closest = node.getClosestLeft("s", bytewise)
 	is.Equal(closest.pair.Key, "q")
 }
 
@@ -67,13 +70,13 @@ func TestNodeGetClosestRight(t *testing.T) {
 	node := NewFixedNode()
 	is := is.New(t)
 
-	closest := node.getClosestRight("c")
+	closest := node.getClosestRight("c", bytewise)
 	is.Equal(closest.pair.Key, "i")
 
-	closest = node.getClosestRight("l")
+	closest = node.getClosestRight("l", bytewise)
 	is.Equal(closest.pair.Key, "m")
 
-	closest = node.getClosestRight("t")
+	closest = node.getClosestRight("t", bytewise)
 	is.Equal(closest.pair.Key, "y")
 }
 
@@ -89,22 +92,39 @@ func TestNodePairs(t *testing.T) {
 
 func TestNodePut(t *testing.T) {
 	is := is.New(t)
-	node := node{kv.NewKVPair("j", []byte("j")), nil, nil}
+	root := &node{pair: kv.NewKVPair("j", []byte("j"))}
 
 	// First node to the left
 	pair := kv.NewKVPair("a", []byte("a"))
-	node.put(pair)
-	is.Equal(node.left.pair.Key, pair.Key)
+	root, grown := root.put(pair, bytewise)
+	is.True(grown)
+	is.Equal(root.left.pair.Key, pair.Key)
 
 	// Second node to the right
 	pair = kv.NewKVPair("z", []byte("z"))
-	node.put(pair)
-	is.Equal(node.right.pair.Key, pair.Key)
+	root, _ = root.put(pair, bytewise)
+	is.Equal(root.right.pair.Key, pair.Key)
 
 	// Updates node
 	pair = kv.NewKVPair("j", []byte("test"))
-	node.put(pair)
-	is.Equal(node.pair.Value, []byte("test"))
+	root, grown = root.put(pair, bytewise)
+	is.True(!grown)
+	is.Equal(root.pair.Value, []byte("test"))
+
+	// A right leaning red node is rotated left
+	root = &node{pair: kv.NewKVPair("a", []byte("a"))}
+	root, _ = root.put(kv.NewKVPair("b", []byte("b")), bytewise)
+	is.Equal(root.pair.Key, "b")
+	is.True(root.left.isRed())
+	is.Equal(root.left.pair.Key, "a")
+
+	// Two red nodes in a row are rotated right and split
+	root, _ = root.put(kv.NewKVPair("0", []byte("0")), bytewise)
+	is.Equal(root.pair.Key, "a")
+	is.Equal(root.left.pair.Key, "0")
+	is.Equal(root.right.pair.Key, "b")
+	is.True(!root.left.isRed())
+	is.True(!root.right.isRed())
 }
 
 func TestNewNode(t *testing.T) {
@@ -115,10 +135,42 @@ func TestNewNode(t *testing.T) {
 	pairs = append(pairs, kv.NewKVPair("b", []byte("b")))
 	pairs = append(pairs, kv.NewKVPair("c", []byte("c")))
 
-	node := newNode(pairs)
+	node := newNode(pairs, bytewise)
 
 	// Nodes should be balanced
 	is.Equal(node.pair.Key, "b")
 	is.Equal(node.left.pair.Key, "a")
 	is.Equal(node.right.pair.Key, "c")
 }
+
+func TestNodePutVersion(t *testing.T) {
+	is := is.New(t)
+
+	pair := kv.NewKVPair("j", []byte("2"))
+	pair.Seq = 2
+	node := node{pair: pair}
+
+	// Newer versions go first
+	pair = kv.NewKVPair("j", []byte("5"))
+	pair.Seq = 5
+	is.True(node.putVersion(pair))
+
+	// Older versions are ordered after newer ones
+	pair = kv.NewKVPair("j", []byte("1"))
+	pair.Seq = 1
+	is.True(node.putVersion(pair))
+	pair = kv.NewKVPair("j", []byte("3"))
+	pair.Seq = 3
+	is.True(node.putVersion(pair))
+
+	// Same sequence number replaces the version
+	pair = kv.NewKVPair("j", []byte("three"))
+	pair.Seq = 3
+	is.True(!node.putVersion(pair))
+
+	is.Equal(node.versions(), 4)
+	is.Equal(node.version(0).Value, []byte("5"))
+	is.Equal(node.version(1).Value, []byte("three"))
+	is.Equal(node.version(2).Value, []byte("2"))
+	is.Equal(node.version(3).Value, []byte("1"))
+}
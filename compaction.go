@@ -1,116 +1,139 @@
 package kv
 
-// import (
-// 	"container/heap"
-// 	"errors"
-// 	"io"
-// )
-
-// type CursorWrapper struct {
-// 	current  KVPair
-// 	cursor   Cursor
-// 	priority int
-// }
-
-// func (c *CursorWrapper) Done() bool {
-// 	return c.cursor.Done()
-// }
-
-// func (c *CursorWrapper) Next() error {
-// 	next, err := c.cursor.Next()
-// 	c.current = next
-// 	return err
-// }
-
-// func NewCursorWrapper(cursor Cursor, priority int) CursorWrapper {
-// 	return CursorWrapper{cursor: cursor, priority: priority}
-// }
-
-// type CursorWrapperHeap []CursorWrapper
-
-// func (h CursorWrapperHeap) Len() int {
-// 	return len(h)
-// }
-
-// func (h CursorWrapperHeap) Less(i, j int) bool {
-// 	return h[i].current.Key < h[j].current.Key
-// }
-
-// func (h CursorWrapperHeap) Swap(i, j int) {
-// 	h[i], h[j] = h[j], h[i]
-// }
-
-// func (h *CursorWrapperHeap) Push(x interface{}) {
-// 	*h = append(*h, x.(CursorWrapper))
-// }
-
-// func (h *CursorWrapperHeap) Pop() interface{} {
-// 	old := *h
-// 	n := len(old)
-// 	x := old[n-1]
-// 	*h = old[0 : n-1]
-// 	return x
-// }
-
-// func Compact(cursors []Cursor, writer SegmentWriter) error {
-// 	// Wrap the passed in cursors to make them compatible with the heap
-// 	h := CursorWrapperHeap{}
-// 	for i, cursor := range cursors {
-// 		// Order of cursors is highest priority (newest data) -> lowest priority
-// 		wrapper := NewCursorWrapper(cursor, i)
-// 		wrapper.Next() // Initialize the current field with the first pair
-// 		heap.Push(&h, wrapper)
-// 	}
-
-// 	// Setup the last read pair
-// 	c := heap.Pop(&h).(CursorWrapper)
-// 	last := c.current
-// 	lastPri := c.priority
-// 	if err := processCursor(c, &h); err != nil {
-// 		return err
-// 	}
-
-// 	// Iterate through the heap until it's empty
-// 	for h.Len() > 0 {
-// 		c := heap.Pop(&h).(CursorWrapper)
-
-// 		// Check for duplicate keys
-// 		if c.current.Key == last.Key {
-// 			// Lower priority means the data is newer
-// 			if c.priority < lastPri {
-// 				last = c.current
-// 				lastPri = c.priority
-// 			}
-
-// 			// Intentionally skip appending the current pair in case the next
-// 			// pair is a duplicate as well
-// 		} else {
-// 			// Safe to append if the current pair is not a duplicate
-// 			writer.Write(last)
-// 			last = c.current
-// 			lastPri = c.priority
-// 		}
-
-// 		// Push the cursor back to the heap
-// 		if err := processCursor(c, &h); err != nil {
-// 			return err
-// 		}
-// 	}
-
-// 	writer.Write(last)
-// 	return nil
-// }
-
-// func processCursor(c CursorWrapper, h *CursorWrapperHeap) error {
-// 	if err := c.Next(); err != nil {
-// 		if !errors.Is(err, io.EOF) {
-// 			return err
-// 		}
-// 	}
-
-// 	if !c.Done() {
-// 		heap.Push(h, c)
-// 	}
-
-// 	return nil
-// }
+import (
+	"container/heap"
+	"errors"
+	"io"
+	"time"
+)
+
+// cursorWrapper holds the current KVPair read from a Cursor along with the
+// priority of the Cursor. Lower priorities hold newer data.
+type cursorWrapper struct {
+	current  KVPair
+	cursor   Cursor
+	priority int
+}
+
+// next advances the wrapped Cursor. Returns io.EOF when it has no pairs left.
+func (c *cursorWrapper) next() error {
+	next, err := c.cursor.Next()
+	if err != nil {
+		return err
+	}
+
+	c.current = next
+	return nil
+}
+
+// cursorHeap is a min-heap of cursorWrapper's ordered by key, then by sequence
+// number, highest first, and then by priority so that the versions of a key
+// are popped from newest to oldest.
+type cursorHeap struct {
+	cmp      Comparator
+	wrappers []*cursorWrapper
+}
+
+func (h *cursorHeap) Len() int {
+	return len(h.wrappers)
+}
+
+func (h *cursorHeap) Less(i, j int) bool {
+	a, b := h.wrappers[i].current, h.wrappers[j].current
+	if c := h.cmp.Compare(a.Key, b.Key); c != 0 {
+		return c < 0
+	} else if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+
+	return h.wrappers[i].priority < h.wrappers[j].priority
+}
+
+func (h *cursorHeap) Swap(i, j int) {
+	h.wrappers[i], h.wrappers[j] = h.wrappers[j], h.wrappers[i]
+}
+
+func (h *cursorHeap) Push(x interface{}) {
+	h.wrappers = append(h.wrappers, x.(*cursorWrapper))
+}
+
+func (h *cursorHeap) Pop() interface{} {
+	old := h.wrappers
+	n := len(old)
+	x := old[n-1]
+	h.wrappers = old[0 : n-1]
+	return x
+}
+
+// Compact performs a k-way merge of the given cursors, writing the result in
+// key order to the given SegmentWriter. Cursors are ordered by priority with
+// the first cursor holding the newest data. Every version of a key with a
+// sequence number higher than oldest is written, along with the newest version
+// which isn't, as that's the one seen by a snapshot pinned at oldest. Older
+// versions are dropped. When the same version appears in more than one cursor
+// only the newest copy of it is written. Expired versions are written as
+// tombstones, so that they keep hiding older versions without keeping their
+// values. If dropTombstones is true, which should only be the case when
+// writing to the bottom level, a tombstone which no snapshot needs is removed
+// entirely rather than written. The cursors must be ordered by the given
+// Comparator, or bytewise if it's nil.
+func Compact(cursors []Cursor, writer SegmentWriter, dropTombstones bool, oldest uint64, cmp Comparator) error {
+	// Wrap the passed in cursors to make them compatible with the heap
+	h := cursorHeap{cmp: DefaultComparator(cmp)}
+	for i := range cursors {
+		wrapper := &cursorWrapper{cursor: cursors[i], priority: i}
+		if err := push(&h, wrapper); err != nil {
+			return err
+		}
+	}
+
+	var last KVPair
+	var started, settled bool
+	now := time.Now()
+	for h.Len() > 0 {
+		c := heap.Pop(&h).(*cursorWrapper)
+		pair := c.current
+		if pair.Expired(now) {
+			pair = KVPair{Key: pair.Key, Seq: pair.Seq, Tombstone: true, Value: []byte{}}
+		}
+
+		// Versions of a key are popped from newest to oldest, so everything
+		// after the first one which is visible at oldest can be skipped, as
+		// can other copies of the version which was just written
+		if !started || pair.Key != last.Key {
+			settled = false
+		}
+		duplicate := started && pair.Key == last.Key && pair.Seq == last.Seq
+
+		if !settled && !duplicate {
+			settled = pair.Seq <= oldest
+			if !(pair.Tombstone && dropTombstones && settled) {
+				if _, err := writer.Write(pair); err != nil {
+					return err
+				}
+			}
+		}
+
+		last = pair
+		started = true
+		if err := push(&h, c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// push advances the given cursor and pushes it back on to the heap unless it
+// has no pairs left.
+func push(h *cursorHeap, c *cursorWrapper) error {
+	if err := c.next(); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		return err
+	}
+
+	heap.Push(h, c)
+	return nil
+}
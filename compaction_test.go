@@ -1,72 +1,227 @@
-package kv
-
-// import (
-// 	"fmt"
-// 	"reflect"
-// 	"testing"
-
-// 	"github.com/matryer/is"
-// )
-
-// func TestCompact(t *testing.T) {
-// 	const count = 10
-// 	const size = 100
-// 	const factor = 3
-// 	is := is.New(t)
-
-// 	// Test with large random set
-// 	var segments []TestSegment
-// 	for i := 0; i < count; i++ {
-// 		seg, err := NewRandomTestSegment(size, factor)
-// 		is.NoErr(err)
-
-// 		segments = append(segments, seg)
-// 	}
-
-// 	var cursors []Cursor
-// 	for _, seg := range segments {
-// 		cursors = append(cursors, seg.segment.Cursor())
-// 	}
-
-// 	writer, err := NewTestSegmentWriter()
-// 	is.NoErr(err)
-
-// 	err = Compact(cursors, writer.writer)
-// 	is.NoErr(err)
-// 	result := writer.encoder.EncodedPairs
-
-// 	// Reduce expectation by 10% to account for possibility of duplicates
-// 	expectedSize := (count * size) * 0.90
-// 	is.True(len(result) > int(expectedSize))
-
-// 	// Perform a sort on the result and then compare it to itself to validate
-// 	// that the segments were merged in order
-// 	resultPairs := make([]KVPair, len(result))
-// 	copy(resultPairs, result)
-// 	SortPairs(result)
-// 	is.True(reflect.DeepEqual(resultPairs, result))
-
-// 	// Test overwriting duplicates
-// 	for i := 0; i < count; i++ {
-// 		var pairs []KVPair
-// 		for k := 'a'; k < 'd'; k++ {
-// 			pairs = append(pairs, NewKVPair(string(k), []byte(fmt.Sprintf("%c%d", k, i+1))))
-// 		}
-
-// 		seg, err := NewTestSegment(pairs, factor)
-// 		is.NoErr(err)
-// 		cursors[i] = seg.segment.Cursor()
-// 	}
-
-// 	writer, err = NewTestSegmentWriter()
-// 	is.NoErr(err)
-
-// 	err = Compact(cursors, writer.writer)
-// 	is.NoErr(err)
-// 	result = writer.encoder.EncodedPairs
-
-// 	// Order of precedent is lowest level > highest level
-// 	is.Equal(result[0].Value, []byte("a1"))
-// 	is.Equal(result[1].Value, []byte("b1"))
-// 	is.Equal(result[2].Value, []byte("c1"))
-// }
+package kv_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dsnet/golib/memfile"
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+// TestSegmentWriter implements kv.SegmentWriter by collecting written pairs.
+type TestSegmentWriter struct {
+	pairs []kv.KVPair
+}
+
+func (t *TestSegmentWriter) Close() error {
+	return nil
+}
+
+func (t *TestSegmentWriter) Write(pair kv.KVPair) (int, error) {
+	t.pairs = append(t.pairs, pair)
+	return 1, nil
+}
+
+func (t *TestSegmentWriter) WriteAll(pairs []kv.KVPair) (int, error) {
+	t.pairs = append(t.pairs, pairs...)
+	return len(pairs), nil
+}
+
+func NewTestCursor(pairs []kv.KVPair) kv.Cursor {
+	encoder := mock.MockEncoder{}
+	file, _ := encoder.Set(pairs)
+	return kv.NewCursor(&encoder, file)
+}
+
+func TestCompact(t *testing.T) {
+	const count = 10
+	const size = 100
+	is := is.New(t)
+
+	// Test with large random set
+	var cursors []kv.Cursor
+	for i := 0; i < count; i++ {
+		cursors = append(cursors, NewTestCursor(helper.NewRandomSortedPairs(size)))
+	}
+
+	writer := TestSegmentWriter{}
+	err := kv.Compact(cursors, &writer, false, kv.LatestSeq, nil)
+	is.NoErr(err)
+	result := writer.pairs
+
+	// Reduce expectation by 10% to account for possibility of duplicates
+	expectedSize := (count * size) * 0.90
+	is.True(len(result) > int(expectedSize))
+
+	// Result is ordered and contains no duplicates
+	for i := 1; i < len(result); i++ {
+		is.True(result[i-1].Key < result[i].Key)
+	}
+
+	// Test overwriting duplicates
+	for i := 0; i < count; i++ {
+		var pairs []kv.KVPair
+		for k := 'a'; k < 'd'; k++ {
+			pairs = append(pairs, kv.NewKVPair(string(k), []byte(fmt.Sprintf("%c%d", k, i+1))))
+		}
+
+		cursors[i] = NewTestCursor(pairs)
+	}
+
+	writer = TestSegmentWriter{}
+	err = kv.Compact(cursors, &writer, false, kv.LatestSeq, nil)
+	is.NoErr(err)
+	result = writer.pairs
+
+	// Order of precedent is lowest level > highest level
+	is.Equal(len(result), 3)
+	is.Equal(result[0].Value, []byte("a1"))
+	is.Equal(result[1].Value, []byte("b1"))
+	is.Equal(result[2].Value, []byte("c1"))
+}
+
+func TestCompactEmpty(t *testing.T) {
+	is := is.New(t)
+	pairs := helper.NewRandomSortedPairs(10)
+
+	// Empty cursors are skipped
+	cursors := []kv.Cursor{
+		NewTestCursor([]kv.KVPair{}),
+		NewTestCursor(pairs),
+		NewTestCursor([]kv.KVPair{}),
+	}
+
+	writer := TestSegmentWriter{}
+	err := kv.Compact(cursors, &writer, false, kv.LatestSeq, nil)
+	is.NoErr(err)
+	is.True(reflect.DeepEqual(writer.pairs, pairs))
+
+	// No cursors writes nothing
+	writer = TestSegmentWriter{}
+	err = kv.Compact([]kv.Cursor{}, &writer, false, kv.LatestSeq, nil)
+	is.NoErr(err)
+	is.Equal(len(writer.pairs), 0)
+}
+
+func TestCompactTombstones(t *testing.T) {
+	is := is.New(t)
+	newer := []kv.KVPair{kv.DeleteKVPair("a"), kv.NewKVPair("c", []byte("c"))}
+	older := []kv.KVPair{kv.NewKVPair("a", []byte("a")), kv.NewKVPair("b", []byte("b"))}
+
+	// Tombstones shadow older versions and are kept
+	writer := TestSegmentWriter{}
+	err := kv.Compact([]kv.Cursor{NewTestCursor(newer), NewTestCursor(older)}, &writer, false, kv.LatestSeq, nil)
+	is.NoErr(err)
+	is.Equal(len(writer.pairs), 3)
+	is.True(writer.pairs[0].Tombstone)
+
+	// Tombstones and the versions they shadow are dropped at the bottom level
+	writer = TestSegmentWriter{}
+	err = kv.Compact([]kv.Cursor{NewTestCursor(newer), NewTestCursor(older)}, &writer, true, kv.LatestSeq, nil)
+	is.NoErr(err)
+	is.Equal(len(writer.pairs), 2)
+	is.Equal(writer.pairs[0].Key, "b")
+	is.Equal(writer.pairs[1].Key, "c")
+}
+
+func TestCompactDecodeError(t *testing.T) {
+	is := is.New(t)
+
+	// Cursor data ends in the middle of an entry
+	encoder := mock.MockEncoder{}
+	file, _ := encoder.Set(helper.NewRandomSortedPairs(2))
+	data := file.(*memfile.File).Bytes()
+	truncated := bytes.NewReader(data[:len(data)-2])
+
+	cursors := []kv.Cursor{kv.NewCursor(&encoder, truncated)}
+	err := kv.Compact(cursors, &TestSegmentWriter{}, false, kv.LatestSeq, nil)
+	is.Equal(err, io.ErrUnexpectedEOF)
+}
+
+func TestCompactSnapshots(t *testing.T) {
+	is := is.New(t)
+	pair := func(key string, seq uint64) kv.KVPair {
+		pair := kv.NewKVPair(key, []byte(fmt.Sprintf("%s%d", key, seq)))
+		pair.Seq = seq
+		return pair
+	}
+	tombstone := kv.DeleteKVPair("b")
+	tombstone.Seq = 4
+
+	newer := []kv.KVPair{pair("a", 8), pair("a", 6), tombstone, pair("c", 9)}
+	older := []kv.KVPair{pair("a", 6), pair("a", 3), pair("a", 1), pair("b", 2)}
+	compact := func(dropTombstones bool, oldest uint64) []kv.KVPair {
+		writer := TestSegmentWriter{}
+		err := kv.Compact([]kv.Cursor{NewTestCursor(newer), NewTestCursor(older)}, &writer, dropTombstones, oldest, nil)
+		is.NoErr(err)
+		return writer.pairs
+	}
+
+	// Without snapshots only the newest version of each key is kept
+	is.Equal(compact(false, kv.LatestSeq), []kv.KVPair{pair("a", 8), tombstone, pair("c", 9)})
+
+	// Versions newer than the oldest snapshot are kept along with the version
+	// it sees, and duplicate copies are only written once
+	is.Equal(compact(false, 5), []kv.KVPair{pair("a", 8), pair("a", 6), pair("a", 3), tombstone, pair("c", 9)})
+
+	// A tombstone is only dropped if the oldest snapshot doesn't need what it
+	// shadows
+	is.Equal(compact(true, 3), []kv.KVPair{pair("a", 8), pair("a", 6), pair("a", 3), tombstone, pair("b", 2), pair("c", 9)})
+	is.Equal(compact(true, 5), []kv.KVPair{pair("a", 8), pair("a", 6), pair("a", 3), pair("c", 9)})
+}
+
+func TestCompactExpired(t *testing.T) {
+	is := is.New(t)
+	pair := func(key string, seq uint64, expires int64) kv.KVPair {
+		pair := kv.NewKVPair(key, []byte(fmt.Sprintf("%s%d", key, seq)))
+		pair.Expires = expires
+		pair.Seq = seq
+		return pair
+	}
+	future := time.Now().Add(time.Hour).UnixNano()
+
+	newer := []kv.KVPair{pair("a", 5, 1), pair("b", 6, future)}
+	older := []kv.KVPair{pair("a", 2, 0), pair("c", 3, 1)}
+	compact := func(dropTombstones bool) []kv.KVPair {
+		writer := TestSegmentWriter{}
+		err := kv.Compact([]kv.Cursor{NewTestCursor(newer), NewTestCursor(older)}, &writer, dropTombstones, kv.LatestSeq, nil)
+		is.NoErr(err)
+		return writer.pairs
+	}
+
+	// Expired pairs lose their values but keep hiding older versions
+	expired := func(key string, seq uint64) kv.KVPair {
+		tombstone := kv.DeleteKVPair(key)
+		tombstone.Seq = seq
+		return tombstone
+	}
+	is.Equal(compact(false), []kv.KVPair{expired("a", 5), pair("b", 6, future), expired("c", 3)})
+
+	// They're dropped entirely at the bottom level
+	is.Equal(compact(true), []kv.KVPair{pair("b", 6, future)})
+}
+
+func TestCompactComparator(t *testing.T) {
+	is := is.New(t)
+	cmp := mock.ReverseComparator{}
+	pair := func(key string, seq uint64) kv.KVPair {
+		pair := kv.NewKVPair(key, []byte(fmt.Sprintf("%s%d", key, seq)))
+		pair.Seq = seq
+		return pair
+	}
+
+	// Cursors ordered by the comparator are merged in the same order
+	newer := []kv.KVPair{pair("c", 5), pair("b", 4)}
+	older := []kv.KVPair{pair("d", 3), pair("b", 2), pair("a", 1)}
+	writer := TestSegmentWriter{}
+	err := kv.Compact([]kv.Cursor{NewTestCursor(newer), NewTestCursor(older)}, &writer, false, kv.LatestSeq, cmp)
+	is.NoErr(err)
+	is.Equal(writer.pairs, []kv.KVPair{pair("d", 3), pair("c", 5), pair("b", 4), pair("a", 1)})
+}
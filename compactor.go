@@ -0,0 +1,253 @@
+package kv
+
+import (
+	"sync"
+	"time"
+)
+
+// Compactor runs compactions against a SegmentStore in the background using
+// the CompactionStrategy the store was opened with. Merged output is split
+// into segments of roughly segmentSize bytes.
+type Compactor struct {
+	done        chan struct{}
+	err         error
+	mu          sync.Mutex
+	segmentSize int
+	stop        chan struct{}
+	store       *SegmentStore
+}
+
+// Compact runs a single compaction if one is needed. Returns true if a
+// compaction was run.
+func (c *Compactor) Compact() (bool, error) {
+	if c.store.strategy == nil {
+		return false, nil
+	}
+
+	task := c.store.strategy.Pick(c.store.Layout())
+	if task == nil || len(task.Inputs) == 0 {
+		return false, nil
+	}
+
+	return true, c.run(*task)
+}
+
+// Err returns the last error encountered by the background goroutine.
+func (c *Compactor) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// Start runs compactions in a background goroutine, checking if one is needed
+// every interval until Stop is called. It does nothing if the Compactor is
+// already running.
+func (c *Compactor) Start(interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	c.stop = stop
+	c.done = done
+
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			// Keep compacting until there's nothing left to do
+			for {
+				ran, err := c.Compact()
+				if err != nil {
+					c.mu.Lock()
+					c.err = err
+					c.mu.Unlock()
+					break
+				} else if !ran {
+					break
+				}
+
+				select {
+				case <-stop:
+					return
+				default:
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background goroutine and waits for any running compaction
+// to finish. It does nothing if the Compactor isn't running.
+func (c *Compactor) Stop() {
+	c.mu.Lock()
+	stop, done := c.stop, c.done
+	c.stop, c.done = nil, nil
+	c.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+
+	close(stop)
+	<-done
+}
+
+// run merges the inputs of the given task into new segments and swaps them
+// into the store. If the task drops its inputs they're removed without being
+// merged.
+func (c *Compactor) run(task CompactionTask) error {
+	if task.Drop {
+		return c.store.replace(task.Level, nil, task.Inputs)
+	}
+
+	var cursors []Cursor
+	for _, segment := range task.Inputs {
+		cursor, err := segment.Cursor()
+		if err != nil {
+			return err
+		}
+
+		cursors = append(cursors, cursor)
+	}
+
+	writer := newSplitWriter(c.store.backend, c.segmentSize)
+	if err := Compact(cursors, writer, task.DropTombstones, c.store.snapshots.Oldest(), c.store.cmp); err != nil {
+		writer.abort()
+		return err
+	}
+
+	outputs, err := writer.segments()
+	if err != nil {
+		writer.abort()
+		return err
+	}
+
+	return c.store.replace(task.Level, outputs, task.Inputs)
+}
+
+// NewCompactor returns a new Compactor for the given store which splits
+// merged output into segments of roughly segmentSize bytes.
+func NewCompactor(store *SegmentStore, segmentSize int) *Compactor {
+	return &Compactor{
+		segmentSize: segmentSize,
+		store:       store,
+	}
+}
+
+// splitWriter implements SegmentWriter by writing to a series of new segments,
+// starting a new one once the current one reaches the given size. The versions
+// of a key are never split across segments, so a segment may grow past the
+// given size to hold all of them.
+type splitWriter struct {
+	backend SegmentBackend
+	current SegmentWriter
+	ids     []SegmentID
+	lastKey string
+	size    int
+	written int
+}
+
+func (s *splitWriter) Close() error {
+	if s.current == nil {
+		return nil
+	}
+
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
+
+func (s *splitWriter) Write(pair KVPair) (int, error) {
+	if s.current != nil && s.written >= s.size && pair.Key != s.lastKey {
+		if err := s.Close(); err != nil {
+			return 0, err
+		}
+	}
+
+	if s.current == nil {
+		id := NewSegmentID()
+		writer, err := s.backend.NewWriter(id)
+		if err != nil {
+			return 0, err
+		}
+
+		s.current = writer
+		s.ids = append(s.ids, id)
+		s.written = 0
+	}
+
+	n, err := s.current.Write(pair)
+	if err != nil {
+		return n, err
+	}
+
+	s.lastKey = pair.Key
+	s.written += n
+	return n, nil
+}
+
+func (s *splitWriter) WriteAll(pairs []KVPair) (int, error) {
+	var total int
+	for _, pair := range pairs {
+		n, err := s.Write(pair)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// abort closes the current segment and deletes every segment written so far.
+func (s *splitWriter) abort() {
+	s.Close()
+	for _, id := range s.ids {
+		s.backend.Delete(id)
+	}
+}
+
+// segments closes the current segment and loads every segment written.
+func (s *splitWriter) segments() ([]Segment, error) {
+	if err := s.Close(); err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+	for _, id := range s.ids {
+		segment, err := s.backend.Get(id)
+		if err != nil {
+			for _, segment := range segments {
+				segment.Close()
+			}
+			return nil, err
+		}
+
+		segments = append(segments, segment)
+	}
+
+	return segments, nil
+}
+
+func newSplitWriter(backend SegmentBackend, size int) *splitWriter {
+	return &splitWriter{
+		backend: backend,
+		size:    size,
+	}
+}
@@ -0,0 +1,400 @@
+package kv_test
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+// NewBufferedStore returns a SegmentStore using the given strategy whose
+// buffer holds count segments. Every segment holds the same keys with values
+// naming the segment they're in, and the newest segment deletes the first key.
+func NewBufferedStore(count int, size int, strategy kv.CompactionStrategy) (*kv.SegmentStore, error) {
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	return FillBufferedStore(&backend, &log, count, size, strategy)
+}
+
+// FillBufferedStore is the same as NewBufferedStore but opens the store using
+// the given backend and log.
+func FillBufferedStore(backend kv.SegmentBackend, log kv.Log, count int, size int, strategy kv.CompactionStrategy) (*kv.SegmentStore, error) {
+	store, err := kv.OpenSegmentStore(backend, log, strategy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < count; i++ {
+		var pairs []kv.KVPair
+		for j := 0; j < size; j++ {
+			key := fmt.Sprintf("key%04d", j)
+			if j == 0 && i == count-1 {
+				pairs = append(pairs, kv.DeleteKVPair(key))
+			} else {
+				pairs = append(pairs, kv.NewKVPair(key, []byte(fmt.Sprintf("segment%d", i))))
+			}
+		}
+
+		memStore := mock.NewMockMemoryStore(pairs)
+		if _, err := store.New(&memStore); err != nil {
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+func TestCompactorCompact(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	strategy := kv.NewLeveledStrategy(count, 1024*1024, 10)
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+	compactor := kv.NewCompactor(store, 1024*1024)
+
+	// Buffer is merged into the first level
+	buffer := store.Buffer()
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+	is.Equal(len(store.Buffer()), 0)
+	is.Equal(len(store.Levels()), 1)
+	is.Equal(len(store.Levels()[0].Segments()), 1)
+
+	// Inputs are closed once they're replaced
+	for _, segment := range buffer {
+		is.True(segment.(*mock.MockSegment).Closed())
+	}
+
+	// Newest versions are kept
+	for i := 1; i < size; i++ {
+		pair, err := store.Get(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+	}
+
+	// Tombstones are dropped at the bottom level
+	_, err = store.Lookup("key0000")
+	is.Equal(err, kv.ErrorNoSuchKey)
+
+	// Nothing left to do
+	ran, err = compactor.Compact()
+	is.NoErr(err)
+	is.True(!ran)
+}
+
+func TestCompactorCompactLevels(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	// Small level budget and segment size forces data down to the next level
+	strategy := kv.NewLeveledStrategy(count, 50, 10)
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+	compactor := kv.NewCompactor(store, 40)
+
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+
+	// Output was split into multiple ordered segments
+	segments := store.Levels()[0].Segments()
+	is.True(len(segments) > 1)
+	for i := 1; i < len(segments); i++ {
+		is.True(segments[i-1].Max().Key < segments[i].Min().Key)
+	}
+
+	// Level is over budget and gets compacted into the next level
+	for {
+		ran, err := compactor.Compact()
+		is.NoErr(err)
+		if !ran {
+			break
+		}
+	}
+	is.True(len(store.Levels()) > 1)
+
+	levels := store.Levels()
+	for i, level := range levels {
+		var levelSize int
+		for _, segment := range level.Segments() {
+			levelSize += segment.Size()
+		}
+		is.True(levelSize <= 50*pow(10, i))
+	}
+
+	// All data is still readable
+	for i := 1; i < size; i++ {
+		pair, err := store.Get(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+	}
+}
+
+func TestCompactorStart(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	strategy := kv.NewLeveledStrategy(count, 1024*1024, 10)
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+
+	// Starting twice only runs a single goroutine
+	goroutines := runtime.NumGoroutine()
+	compactor := kv.NewCompactor(store, 1024*1024)
+	compactor.Start(time.Millisecond)
+	compactor.Start(time.Millisecond)
+	is.Equal(runtime.NumGoroutine(), goroutines+1)
+
+	// Wait for the background goroutine to empty the buffer
+	deadline := time.Now().Add(5 * time.Second)
+	for len(store.Buffer()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	compactor.Stop()
+
+	is.NoErr(compactor.Err())
+	is.Equal(len(store.Buffer()), 0)
+	is.Equal(len(store.Levels()), 1)
+
+	// Stopping twice is a no-op
+	compactor.Stop()
+	is.Equal(runtime.NumGoroutine(), goroutines)
+}
+
+func TestCompactorStop(t *testing.T) {
+	is := is.New(t)
+
+	strategy := kv.NewLeveledStrategy(4, 1024*1024, 10)
+	store, err := NewBufferedStore(4, 10, strategy)
+	is.NoErr(err)
+
+	// Stopping a Compactor which was never started is a no-op
+	compactor := kv.NewCompactor(store, 1024*1024)
+	compactor.Stop()
+
+	// It can still be started and stopped afterwards
+	compactor.Start(time.Millisecond)
+	compactor.Stop()
+	is.NoErr(compactor.Err())
+}
+
+// failingLog is a kv.Log which refuses to write entries with the given action.
+type failingLog struct {
+	kv.Log
+	action kv.LogAction
+}
+
+func (f failingLog) Write(index uint64, entry kv.LogEntry) error {
+	if entry.Action == f.action {
+		return errors.New("log failed")
+	}
+
+	return f.Log.Write(index, entry)
+}
+
+func TestCompactorReplay(t *testing.T) {
+	count := 4
+	size := 10
+
+	strategies := map[string]func() kv.CompactionStrategy{
+		"leveled": func() kv.CompactionStrategy {
+			return kv.NewLeveledStrategy(count, 50, 10)
+		},
+		"size-tiered": func() kv.CompactionStrategy {
+			return kv.NewSizeTieredStrategy(count, 32, 0.5, 1.5)
+		},
+	}
+
+	for name, strategy := range strategies {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			backend := mock.NewMockSegmentBackend()
+			log := mock.NewMockLog()
+			store, err := FillBufferedStore(&backend, &log, count, size, strategy())
+			is.NoErr(err)
+			compactor := kv.NewCompactor(store, 40)
+
+			// Every compaction is logged as a single entry
+			compactions := 0
+			for {
+				before, err := log.Last()
+				is.NoErr(err)
+
+				ran, err := compactor.Compact()
+				is.NoErr(err)
+				if !ran {
+					break
+				}
+
+				last, err := log.Last()
+				is.NoErr(err)
+				is.Equal(last, before+1)
+
+				entry, err := log.Read(last)
+				is.NoErr(err)
+				is.Equal(entry.Action, kv.LogReplace)
+				compactions++
+			}
+			is.True(compactions > 0)
+
+			// The reopened store has the same layout
+			recovered, err := kv.OpenSegmentStore(&backend, &log, strategy(), nil)
+			is.NoErr(err)
+			is.Equal(SegmentIDs(recovered.Buffer()), SegmentIDs(store.Buffer()))
+			is.Equal(len(recovered.Levels()), len(store.Levels()))
+			for i, level := range store.Levels() {
+				is.Equal(SegmentIDs(recovered.Levels()[i].Segments()), SegmentIDs(level.Segments()))
+			}
+
+			for i := 1; i < size; i++ {
+				pair, err := recovered.Get(fmt.Sprintf("key%04d", i))
+				is.NoErr(err)
+				is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+			}
+		})
+	}
+}
+
+func TestCompactorReplayFailure(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+	strategy := kv.NewLeveledStrategy(count, 1024*1024, 10)
+	store, err := FillBufferedStore(&backend, failingLog{Log: &log, action: kv.LogReplace}, count, size, strategy)
+	is.NoErr(err)
+	buffer := SegmentIDs(store.Buffer())
+
+	// Nothing is swapped when the swap can't be logged
+	_, err = kv.NewCompactor(store, 1024*1024).Compact()
+	is.True(err != nil)
+	is.Equal(SegmentIDs(store.Buffer()), buffer)
+	is.Equal(len(store.Levels()), 0)
+
+	// The reopened store still holds every input
+	recovered, err := kv.OpenSegmentStore(&backend, &log, strategy, nil)
+	is.NoErr(err)
+	is.Equal(SegmentIDs(recovered.Buffer()), buffer)
+	is.Equal(len(recovered.Levels()), 0)
+}
+
+func TestCompactorLayout(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	// A layout taken during a compaction sees either its inputs or its outputs
+	for i := 0; i < 100; i++ {
+		strategy := kv.NewLeveledStrategy(count, 1024*1024, 10)
+		store, err := NewBufferedStore(count, size, strategy)
+		is.NoErr(err)
+
+		done := make(chan error)
+		go func() {
+			_, err := kv.NewCompactor(store, 1024*1024).Compact()
+			done <- err
+		}()
+
+		for running := true; running; {
+			select {
+			case err := <-done:
+				is.NoErr(err)
+				running = false
+			default:
+			}
+
+			layout := store.Layout()
+			is.True(len(layout.Buffer) == 0 || len(layout.Levels) == 0)
+		}
+	}
+}
+
+func TestCompactorSnapshots(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+	strategy := kv.NewLeveledStrategy(count, 1024*1024, 10)
+	store, err := kv.OpenSegmentStore(&backend, &log, strategy, nil)
+	is.NoErr(err)
+
+	// Every segment writes a new version of each key
+	for i := 0; i < count; i++ {
+		var pairs []kv.KVPair
+		for j := 0; j < size; j++ {
+			pair := kv.NewKVPair(fmt.Sprintf("key%04d", j), []byte(fmt.Sprintf("segment%d", i)))
+			pair.Seq = uint64(i*size + j + 1)
+			pairs = append(pairs, pair)
+		}
+
+		memStore := mock.NewMockMemoryStore(pairs)
+		_, err := store.New(&memStore)
+		is.NoErr(err)
+	}
+	is.Equal(store.Seq(), uint64(count*size))
+
+	// Pin the state after the second segment was written
+	seq := uint64(2 * size)
+	store.Snapshots().Acquire(seq)
+
+	compactor := kv.NewCompactor(store, 40)
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+
+	// The versions of a key are never split across segments
+	segments := store.Levels()[0].Segments()
+	is.True(len(segments) > 1)
+	for i := 1; i < len(segments); i++ {
+		is.True(segments[i-1].Max().Key < segments[i].Min().Key)
+	}
+
+	// Both the snapshot and the newest versions are readable
+	read := func(seq uint64) []kv.KVPair {
+		result, err := helper.ReadIterator(store.Iterator(seq), "")
+		is.NoErr(err)
+		return result
+	}
+
+	pinned := read(seq)
+	is.Equal(len(pinned), size)
+	for _, pair := range pinned {
+		is.Equal(pair.Value, []byte("segment1"))
+	}
+
+	for _, pair := range read(kv.LatestSeq) {
+		is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+	}
+
+	// Versions older than those seen by the snapshot were dropped
+	is.Equal(len(read(uint64(size))), 0)
+
+	// Releasing the snapshot unpins it
+	store.Snapshots().Release(seq)
+	is.Equal(store.Snapshots().Oldest(), kv.LatestSeq)
+}
+
+func pow(base int, exp int) int {
+	result := 1
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+
+	return result
+}
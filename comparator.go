@@ -0,0 +1,59 @@
+package kv
+
+import (
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Comparator defines the order of keys. Every ordered structure of a store,
+// from its MemoryStore's to the index of each segment, must use the same
+// Comparator and it must never change once data has been written with it.
+// Only identical keys may compare as equal; a KeyNormalizer should be used to
+// treat different keys as the same one.
+type Comparator interface {
+	// Compare returns a negative number if a is lower than b, zero if they're
+	// equal and a positive number if a is higher than b.
+	Compare(a string, b string) int
+}
+
+// BytewiseComparator implements Comparator by comparing the raw bytes of keys.
+// It's used wherever no Comparator is given. Prefix scans rely on keys which
+// share a prefix being ordered together, which a bytewise order guarantees.
+type BytewiseComparator struct{}
+
+func (BytewiseComparator) Compare(a string, b string) int {
+	return strings.Compare(a, b)
+}
+
+// DefaultComparator returns the given Comparator, or a BytewiseComparator if
+// it's nil.
+func DefaultComparator(cmp Comparator) Comparator {
+	if cmp == nil {
+		return BytewiseComparator{}
+	}
+
+	return cmp
+}
+
+// KeyNormalizer rewrites a key into the form it's stored and searched for in.
+// Keys which normalize to the same form are treated as the same key.
+type KeyNormalizer func(key string) string
+
+// IdentityNormalizer leaves keys untouched, which makes them case sensitive
+// and allows them to hold arbitrary bytes.
+func IdentityNormalizer(key string) string {
+	return key
+}
+
+// LowercaseNormalizer makes keys case insensitive by lowercasing them.
+func LowercaseNormalizer(key string) string {
+	return strings.ToLower(key)
+}
+
+// NFCNormalizer converts keys to Unicode Normalization Form C so that
+// canonically equivalent keys, such as a precomposed character and the same
+// character followed by a combining mark, are the same key.
+func NFCNormalizer(key string) string {
+	return norm.NFC.String(key)
+}
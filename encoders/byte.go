@@ -10,6 +10,9 @@ import (
 	"github.com/jmgilman/kv"
 )
 
+// ByteEncoderID identifies data encoded by ByteEncoder.
+const ByteEncoderID uint32 = 3
+
 const headerSize = 8
 const maxKeySize = math.MaxUint32
 const maxValueSize = math.MaxUint32
@@ -118,7 +121,22 @@ func (b ByteEncoder) DecodePair(data io.Reader) (kv.KVPair, error) {
 		return kv.KVPair{}, err
 	}
 
-	return NewKVPair(key, value, tombstone), nil
+	// Read sequence number
+	var seq uint64
+	if err := binary.Read(data, binary.BigEndian, &seq); err != nil {
+		return kv.KVPair{}, err
+	}
+
+	// Read expiry time
+	var expires int64
+	if err := binary.Read(data, binary.BigEndian, &expires); err != nil {
+		return kv.KVPair{}, err
+	}
+
+	pair := NewKVPair(key, value, tombstone)
+	pair.Expires = expires
+	pair.Seq = seq
+	return pair, nil
 }
 
 func (b ByteEncoder) EncodePair(pair kv.KVPair) ([]byte, error) {
@@ -139,7 +157,7 @@ func (b ByteEncoder) EncodePair(pair kv.KVPair) ([]byte, error) {
 		return nil, err
 	}
 
-	buf := bytes.NewBuffer(make([]byte, 0, headerSize+keySize+valueSize))
+	buf := bytes.NewBuffer(make([]byte, 0, headerSize+keySize+valueSize+17))
 
 	// Write header
 	if _, err := buf.Write(headerBytes); err != nil {
@@ -161,9 +179,23 @@ func (b ByteEncoder) EncodePair(pair kv.KVPair) ([]byte, error) {
 		return nil, err
 	}
 
+	// Write sequence number
+	if err := binary.Write(buf, binary.BigEndian, pair.Seq); err != nil {
+		return nil, err
+	}
+
+	// Write expiry time
+	if err := binary.Write(buf, binary.BigEndian, pair.Expires); err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
 
+func (b ByteEncoder) ID() uint32 {
+	return ByteEncoderID
+}
+
 func HeaderSize() int {
 	return headerSize
 }
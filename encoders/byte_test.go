@@ -60,12 +60,16 @@ func TestBasicEncoderDecodePair(t *testing.T) {
 	buf.Write(key)
 	buf.Write(value)
 	binary.Write(buf, binary.BigEndian, tombstone)
+	binary.Write(buf, binary.BigEndian, uint64(42))
+	binary.Write(buf, binary.BigEndian, int64(1000))
 
 	result, err := encoder.DecodePair(buf)
 	is.NoErr(err)
 	is.Equal(result.Key, "key")
 	is.Equal(result.Value, []byte("value"))
 	is.Equal(result.Tombstone, false)
+	is.Equal(result.Seq, uint64(42))
+	is.Equal(result.Expires, int64(1000))
 
 	// Invalid key
 	badKey := []byte("key")
@@ -98,6 +102,31 @@ func TestBasicEncoderDecodePair(t *testing.T) {
 	_, err = encoder.DecodePair(buf)
 	is.True(errors.Is(err, io.EOF))
 
+	// Invalid sequence number
+	buf.Reset()
+	binary.Write(buf, binary.BigEndian, uint32(len(key)))
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(key)
+	buf.Write(value)
+	binary.Write(buf, binary.BigEndian, tombstone)
+	binary.Write(buf, binary.BigEndian, uint32(42))
+
+	_, err = encoder.DecodePair(buf)
+	is.True(errors.Is(err, io.ErrUnexpectedEOF))
+
+	// Invalid expiry time
+	buf.Reset()
+	binary.Write(buf, binary.BigEndian, uint32(len(key)))
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(key)
+	buf.Write(value)
+	binary.Write(buf, binary.BigEndian, tombstone)
+	binary.Write(buf, binary.BigEndian, uint64(42))
+	binary.Write(buf, binary.BigEndian, uint32(1000))
+
+	_, err = encoder.DecodePair(buf)
+	is.True(errors.Is(err, io.ErrUnexpectedEOF))
+
 	// EOF
 	_, err = encoder.DecodePair(buf)
 	is.True(errors.Is(err, io.EOF))
@@ -112,5 +141,15 @@ func TestBasicEncoderEncodePair(t *testing.T) {
 	encoder := ByteEncoder{}
 	result, err := encoder.EncodePair(pair)
 	is.NoErr(err)
-	is.Equal(len(result), headerSize+len([]byte(key))+len(value)+1)
+	is.Equal(len(result), headerSize+len([]byte(key))+len(value)+17)
+
+	// Sequence numbers and expiry times survive a round trip
+	pair.Expires = 1000
+	pair.Seq = 42
+	result, err = encoder.EncodePair(pair)
+	is.NoErr(err)
+
+	decoded, err := encoder.DecodePair(bytes.NewReader(result))
+	is.NoErr(err)
+	is.Equal(decoded, pair)
 }
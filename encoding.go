@@ -8,10 +8,30 @@ import (
 type Encoder interface {
 	DecodePair(data io.Reader) (KVPair, error)
 	EncodePair(pair KVPair) ([]byte, error)
+
+	// ID returns a unique identifier for the encoding, which is recorded
+	// alongside data written with it.
+	ID() uint32
+}
+
+// Cursor provides an interface for iterating over a sequence of KVPair's.
+type Cursor interface {
+	// Done returns true when all underlying entries have been read.
+	Done() bool
+
+	// Next returns the next KVPair. It returns io.EOF when no more remain.
+	Next() (KVPair, error)
+
+	// ReadToEnd reads all remaining KVPair's.
+	ReadToEnd() ([]KVPair, error)
+
+	// Reset moves the cursor back to the first KVPair.
+	Reset() error
 }
 
-// Cursor provides an interface for iterating over a stream of encoded KVPair's.
-type Cursor struct {
+// StreamCursor implements Cursor by decoding KVPair's from a stream of encoded
+// KVPair's.
+type StreamCursor struct {
 	data    io.ReadSeeker
 	done    bool
 	encoder Encoder
@@ -19,13 +39,13 @@ type Cursor struct {
 }
 
 // Done returns true when all underlying entries have been read.
-func (c *Cursor) Done() bool {
+func (c *StreamCursor) Done() bool {
 	return c.done
 }
 
 // Next returns the next decoded KVPair from the underlying segment data. It
 // returns io.EOF when no more data remains.
-func (c *Cursor) Next() (KVPair, error) {
+func (c *StreamCursor) Next() (KVPair, error) {
 	pair, err := c.encoder.DecodePair(c.data)
 	if errors.Is(err, io.EOF) {
 		c.done = true
@@ -37,7 +57,7 @@ func (c *Cursor) Next() (KVPair, error) {
 
 // ReadToEnd reads all remaining decoded KVPair's from the underlying segment
 // data. It returns io.EOF if there were no KVPair's left.
-func (c *Cursor) ReadToEnd() ([]KVPair, error) {
+func (c *StreamCursor) ReadToEnd() ([]KVPair, error) {
 	var pairs []KVPair
 	for {
 		pair, err := c.Next()
@@ -57,13 +77,13 @@ func (c *Cursor) ReadToEnd() ([]KVPair, error) {
 
 // Reset will set the internal io.ReadSeeker back to the beginning and allow
 // iterating over the decoded KVPair's again after reaching io.EOF.
-func (c *Cursor) Reset() error {
+func (c *StreamCursor) Reset() error {
 	_, err := c.data.Seek(0, io.SeekStart)
 	return err
 }
 
-func NewCursor(encoder Encoder, data io.ReadSeeker) Cursor {
-	return Cursor{
+func NewCursor(encoder Encoder, data io.ReadSeeker) *StreamCursor {
+	return &StreamCursor{
 		data:    data,
 		encoder: encoder,
 	}
@@ -9,6 +9,7 @@ require (
 	github.com/matryer/is v1.4.0
 	github.com/spf13/afero v1.6.0
 	github.com/tjarratt/babble v0.0.0-20210505082055-cbca2a4833c1
+	golang.org/x/text v0.3.6
 )
 
 require (
@@ -19,5 +20,4 @@ require (
 	github.com/tidwall/pretty v1.2.0 // indirect
 	github.com/tidwall/tinylru v1.1.0 // indirect
 	github.com/tidwall/wal v0.1.5 // indirect
-	golang.org/x/text v0.3.6 // indirect
 )
@@ -1,20 +1,111 @@
 package http
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/service"
 )
 
+// batchOp is the JSON representation of each operation in a write batch. Op is
+// either "put" or "delete" and Value is ignored for deletes. Value is decoded
+// as standard base64, the same encoding scans return values in, unless
+// Encoding is "text", in which case it's stored as it is.
+type batchOp struct {
+	Op       string `json:"op"`
+	Key      string `json:"key"`
+	Value    string `json:"value"`
+	Encoding string `json:"encoding"`
+}
+
+// decode returns the value of the operation according to its encoding.
+func (b batchOp) decode() ([]byte, error) {
+	switch b.Encoding {
+	case "", "base64":
+		value, err := base64.StdEncoding.DecodeString(b.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 value: %w", err)
+		}
+		return value, nil
+	case "text":
+		return []byte(b.Value), nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", b.Encoding)
+	}
+}
+
+// scanPair is the JSON representation of each KVPair returned by a scan.
+type scanPair struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
 func (s *Server) routes() {
+	s.router.HandleFunc("/v1", s.handleScan()).Methods("GET")
+	s.router.HandleFunc("/v1/_batch", s.handleBatch()).Methods("POST")
 	s.router.HandleFunc("/v1/{key}", s.handlePut()).Methods("PUT")
 	s.router.HandleFunc("/v1/{key}", s.handleGet()).Methods("GET")
 	s.router.HandleFunc("/v1/{key}", s.handleDelete()).Methods("DELETE")
 }
 
+// handleBatch applies a JSON list of operations, see batchOp, as a single
+// atomic write. At most batchMaxOps operations may be sent at once.
+func (s *Server) handleBatch() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var ops []batchOp
+		if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+			http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(ops) > batchMaxOps {
+			http.Error(w, fmt.Sprintf("batch exceeds %d operations", batchMaxOps), http.StatusBadRequest)
+			return
+		}
+
+		batch := service.NewWriteBatch()
+		for i, op := range ops {
+			if op.Key == "" {
+				http.Error(w, fmt.Sprintf("operation %d has no key", i), http.StatusBadRequest)
+				return
+			}
+
+			switch op.Op {
+			case "put":
+				value, err := op.decode()
+				if err != nil {
+					http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+					return
+				}
+				batch.Put(op.Key, value)
+			case "delete":
+				batch.Delete(op.Key)
+			default:
+				http.Error(w, fmt.Sprintf("operation %d has unknown op %q", i, op.Op), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := s.kvService.Write(&batch); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
 func (s *Server) handleDelete() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -49,11 +140,20 @@ func (s *Server) handleGet() http.HandlerFunc {
 	}
 }
 
+// handlePut stores the request body under the given key. A TTL may be given in
+// either the TTL header or the ttl query parameter, after which the key
+// expires.
 func (s *Server) handlePut() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		key := vars["key"]
 
+		ttl, err := parseTTL(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		value, err := io.ReadAll(r.Body)
 		defer r.Body.Close()
 
@@ -62,7 +162,11 @@ func (s *Server) handlePut() http.HandlerFunc {
 			return
 		}
 
-		err = s.kvService.Put(key, value)
+		if ttl > 0 {
+			err = s.kvService.PutWithTTL(key, value, ttl)
+		} else {
+			err = s.kvService.Put(key, value)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -71,3 +175,171 @@ func (s *Server) handlePut() http.HandlerFunc {
 		w.WriteHeader(http.StatusCreated)
 	}
 }
+
+// handleScan lists keys in the range given by the start and end query
+// parameters, or under the given prefix, as newline delimited JSON. Keys are
+// listed in descending order if reverse is true. Pairs are streamed as they're
+// read. At most limit pairs are returned and, if there are more, the
+// X-Continuation-Token trailer holds a token which can be passed back as the
+// token query parameter to fetch the next page.
+func (s *Server) handleScan() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Bounds are normalized up front since the end of a prefix and
+		// continuation tokens mustn't be normalized again
+		query := r.URL.Query()
+		start := s.kvService.Normalize(query.Get("start"))
+		end := s.kvService.Normalize(query.Get("end"))
+		prefix := query.Get("prefix")
+
+		if prefix != "" {
+			if start != "" || end != "" {
+				http.Error(w, "prefix can't be combined with start or end", http.StatusBadRequest)
+				return
+			}
+
+			start = s.kvService.Normalize(prefix)
+
+			var err error
+			end, err = s.kvService.PrefixEnd(start)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := scanDefaultLimit
+		if value := query.Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+				return
+			}
+
+			if n < scanMaxLimit {
+				limit = n
+			} else {
+				limit = scanMaxLimit
+			}
+		}
+
+		reverse := false
+		if value := query.Get("reverse"); value != "" {
+			var err error
+			reverse, err = strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "reverse must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// A continuation token holds the last key of the previous page. It's
+		// an exclusive end when scanning in reverse, otherwise the next page
+		// starts at it and skips it, which doesn't depend on the key order.
+		page := scanToken{end: end, reverse: reverse, start: start}
+		var after string
+		if value := query.Get("token"); value != "" {
+			token, err := decodeScanToken(value)
+			if err != nil || !s.validToken(token, page) {
+				http.Error(w, ErrorInvalidToken.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if reverse {
+				end = token.key
+			} else {
+				start = token.key
+				after = token.key
+			}
+		}
+
+		// Pairs are sent as they're read, so whether there's another page is
+		// only known once the last one has been sent
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Trailer", "X-Continuation-Token")
+
+		flusher, _ := w.(http.Flusher)
+		encoder := json.NewEncoder(w)
+		sent := 0
+		var last string
+		err := s.kvService.RangeNormalized(start, end, reverse, func(pair kv.KVPair) bool {
+			if after != "" && pair.Key == after {
+				return true
+			}
+
+			if sent == limit {
+				page.key = last
+				w.Header().Set("X-Continuation-Token", page.encode())
+				return false
+			}
+
+			if err := encoder.Encode(scanPair{Key: pair.Key, Value: pair.Value}); err != nil {
+				return false
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			sent++
+			last = pair.Key
+			return true
+		})
+
+		// A failure can only be reported before the response has started,
+		// otherwise it's aborted so that it isn't mistaken for a full page
+		if err != nil && sent == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else if err != nil {
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// validToken returns true if the given token belongs to the scan described by
+// page and its key lies within the bounds of that scan.
+func (s *Server) validToken(token scanToken, page scanToken) bool {
+	if token.start != page.start || token.end != page.end || token.reverse != page.reverse {
+		return false
+	}
+
+	cmp := s.kvService.Comparator()
+	if page.start != "" && cmp.Compare(token.key, page.start) < 0 {
+		return false
+	}
+
+	return page.end == "" || cmp.Compare(token.key, page.end) < 0
+}
+
+// parseTTL reads the TTL of a put from either the TTL header or the ttl query
+// parameter, preferring the header. A TTL is either a whole number of seconds
+// or a duration such as "1h30m", and must be positive and fit in a
+// time.Duration. Returns zero if neither is set.
+func parseTTL(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get("TTL")
+	if value == "" {
+		value = r.URL.Query().Get("ttl")
+	}
+
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.ParseInt(value, 10, 64)
+		if convErr != nil {
+			return 0, fmt.Errorf("invalid ttl %q", value)
+		}
+
+		// Larger values overflow a time.Duration
+		if seconds > math.MaxInt64/int64(time.Second) {
+			return 0, fmt.Errorf("invalid ttl %q: too large", value)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	if ttl <= 0 {
+		return 0, fmt.Errorf("invalid ttl %q: %w", value, service.ErrorInvalidTTL)
+	}
+
+	return ttl, nil
+}
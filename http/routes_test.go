@@ -0,0 +1,337 @@
+package http
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/btree"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/service"
+	"github.com/matryer/is"
+)
+
+// NewTestServer returns a Server backed by an in-memory KVService which
+// normalizes and orders keys with the given KeyNormalizer and Comparator.
+func NewTestServer(normalizer kv.KeyNormalizer, cmp kv.Comparator) (*Server, error) {
+	factory := func() kv.MemoryStore {
+		return btree.NewTree(cmp)
+	}
+	nvStore := mock.NewMockNVStore()
+	wal := mock.NewMockLog()
+
+	kvService, err := service.NewKVService(factory, &nvStore, &wal, memStoreThreshold, normalizer, cmp)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &Server{
+		kvService: kvService,
+		router:    mux.NewRouter(),
+	}
+	server.routes()
+
+	return server, nil
+}
+
+// ScanKeys sends the given scan request to the server and returns the keys it
+// lists along with the continuation token sent in the trailer.
+func ScanKeys(server *Server, target string) ([]string, string, error) {
+	recorder := httptest.NewRecorder()
+	server.router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+
+	var keys []string
+	scanner := bufio.NewScanner(recorder.Body)
+	for scanner.Scan() {
+		var pair scanPair
+		if err := json.Unmarshal(scanner.Bytes(), &pair); err != nil {
+			return nil, "", err
+		}
+
+		keys = append(keys, pair.Key)
+	}
+
+	return keys, recorder.Result().Trailer.Get("X-Continuation-Token"), nil
+}
+
+func TestHandleScanPrefix(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(kv.LowercaseNormalizer, nil)
+	is.NoErr(err)
+
+	for _, key := range []string{"user@1", "User@2", "user@3", "user_4", "userA"} {
+		is.NoErr(server.kvService.Put(key, []byte(key)))
+	}
+
+	// The end of a prefix isn't normalized again
+	keys, _, err := ScanKeys(server, "/v1?prefix=USER@")
+	is.NoErr(err)
+	is.Equal(keys, []string{"user@1", "user@2", "user@3"})
+
+	keys, _, err = ScanKeys(server, "/v1?prefix=user@&reverse=true")
+	is.NoErr(err)
+	is.Equal(keys, []string{"user@3", "user@2", "user@1"})
+
+	// Pages stay within the prefix
+	keys, token, err := ScanKeys(server, "/v1?prefix=user@&limit=2")
+	is.NoErr(err)
+	is.Equal(keys, []string{"user@1", "user@2"})
+
+	keys, token, err = ScanKeys(server, "/v1?prefix=user@&limit=2&token="+token)
+	is.NoErr(err)
+	is.Equal(keys, []string{"user@3"})
+	is.Equal(token, "")
+
+	// Range bounds are normalized
+	keys, _, err = ScanKeys(server, "/v1?start=USER@2&end=USER_")
+	is.NoErr(err)
+	is.Equal(keys, []string{"user@2", "user@3"})
+}
+
+func TestHandleScanStream(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(nil, nil)
+	is.NoErr(err)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		is.NoErr(server.kvService.Put(key, []byte(key)))
+	}
+
+	// Every pair is flushed as it's sent
+	recorder := httptest.NewRecorder()
+	server.router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1", nil))
+	is.Equal(recorder.Code, http.StatusOK)
+	is.True(recorder.Flushed)
+	is.Equal(recorder.Header().Get("Content-Type"), "application/x-ndjson")
+
+	// No token is sent when the last page is exactly full
+	keys, token, err := ScanKeys(server, "/v1?limit=5")
+	is.NoErr(err)
+	is.Equal(len(keys), 5)
+	is.Equal(token, "")
+
+	// Pages cover every key in both directions
+	for _, reverse := range []string{"false", "true"} {
+		var all []string
+		token := ""
+		for {
+			keys, next, err := ScanKeys(server, "/v1?limit=2&reverse="+reverse+"&token="+token)
+			is.NoErr(err)
+			all = append(all, keys...)
+			if next == "" {
+				break
+			}
+			token = next
+		}
+
+		if reverse == "true" {
+			is.Equal(all, []string{"e", "d", "c", "b", "a"})
+		} else {
+			is.Equal(all, []string{"a", "b", "c", "d", "e"})
+		}
+	}
+}
+
+func TestHandleScanComparator(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(nil, mock.ReverseComparator{})
+	is.NoErr(err)
+
+	for _, key := range []string{"a", "a\x00", "b", "c"} {
+		is.NoErr(server.kvService.Put(key, []byte(key)))
+	}
+
+	// Prefixes aren't ordered together
+	recorder := httptest.NewRecorder()
+	server.router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/v1?prefix=a", nil))
+	is.Equal(recorder.Code, http.StatusBadRequest)
+
+	// Pages follow the order of the comparator without repeating keys
+	var all []string
+	token := ""
+	for {
+		keys, next, err := ScanKeys(server, "/v1?limit=1&token="+token)
+		is.NoErr(err)
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	is.Equal(all, []string{"c", "b", "a\x00", "a"})
+}
+
+func TestHandleScanToken(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(nil, nil)
+	is.NoErr(err)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		is.NoErr(server.kvService.Put(key, []byte(key)))
+	}
+
+	_, token, err := ScanKeys(server, "/v1?start=b&end=e&limit=1")
+	is.NoErr(err)
+	is.True(token != "")
+
+	// Tokens are only accepted by the scan they came from
+	keys, _, err := ScanKeys(server, "/v1?start=b&end=e&limit=1&token="+token)
+	is.NoErr(err)
+	is.Equal(keys, []string{"c"})
+
+	status := func(target string) int {
+		recorder := httptest.NewRecorder()
+		server.router.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		return recorder.Code
+	}
+
+	is.Equal(status("/v1?start=a&end=e&token="+token), http.StatusBadRequest)
+	is.Equal(status("/v1?start=b&end=e&reverse=true&token="+token), http.StatusBadRequest)
+	is.Equal(status("/v1?prefix=b&token="+token), http.StatusBadRequest)
+
+	// Keys outside the bounds of the scan are rejected
+	for _, key := range []string{"a", "e", "z"} {
+		forged := scanToken{end: "e", key: key, start: "b"}.encode()
+		is.Equal(status("/v1?start=b&end=e&token="+forged), http.StatusBadRequest)
+	}
+
+	// Malformed tokens and unknown versions are rejected
+	is.Equal(status("/v1?token=!"), http.StatusBadRequest)
+	is.Equal(status("/v1?token="+base64.RawURLEncoding.EncodeToString([]byte("b"))), http.StatusBadRequest)
+
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	is.NoErr(err)
+	buf[0] = scanTokenVersion + 1
+	is.Equal(status("/v1?start=b&end=e&token="+base64.RawURLEncoding.EncodeToString(buf)), http.StatusBadRequest)
+	buf[0] = scanTokenVersion
+	is.Equal(status("/v1?start=b&end=e&token="+base64.RawURLEncoding.EncodeToString(buf[:len(buf)-1])), http.StatusBadRequest)
+}
+
+func TestHandleBatch(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(kv.LowercaseNormalizer, nil)
+	is.NoErr(err)
+	is.NoErr(server.kvService.Put("c", []byte("c")))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		server.router.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/v1/_batch", strings.NewReader(body)))
+		return recorder
+	}
+
+	// Values are base64 unless they're sent as text
+	recorder := post(`[
+		{"op": "put", "key": "A", "value": "dmFsdWU="},
+		{"op": "put", "key": "b", "value": "text", "encoding": "text"},
+		{"op": "delete", "key": "c"}
+	]`)
+	is.Equal(recorder.Code, http.StatusOK)
+
+	pair, err := server.kvService.Get("a")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("value"))
+
+	pair, err = server.kvService.Get("b")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("text"))
+
+	_, err = server.kvService.Get("c")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Invalid batches are rejected without writing anything
+	invalid := map[string]string{
+		"unknown op":       `[{"op": "put", "key": "d", "value": ""}, {"op": "rename", "key": "e"}]`,
+		"missing key":      `[{"op": "put", "key": "d", "value": ""}, {"op": "put", "value": ""}]`,
+		"invalid base64":   `[{"op": "put", "key": "d", "value": "!"}]`,
+		"unknown encoding": `[{"op": "put", "key": "d", "value": "", "encoding": "hex"}]`,
+		"malformed":        `{"op": "put"}`,
+	}
+	for name, body := range invalid {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			is.Equal(post(body).Code, http.StatusBadRequest)
+
+			_, err := server.kvService.Get("d")
+			is.True(errors.Is(err, kv.ErrorNoSuchKey))
+		})
+	}
+
+	// Batches are limited in size
+	ops := make([]string, batchMaxOps+1)
+	for i := range ops {
+		ops[i] = fmt.Sprintf(`{"op": "delete", "key": "key%d"}`, i)
+	}
+	recorder = post("[" + strings.Join(ops, ",") + "]")
+	is.Equal(recorder.Code, http.StatusBadRequest)
+
+	recorder = post("[" + strings.Join(ops[:batchMaxOps], ",") + "]")
+	is.Equal(recorder.Code, http.StatusOK)
+}
+
+func TestHandlePutTTL(t *testing.T) {
+	is := is.New(t)
+	server, err := NewTestServer(nil, nil)
+	is.NoErr(err)
+
+	put := func(target string, header string) int {
+		request := httptest.NewRequest(http.MethodPut, target, strings.NewReader("value"))
+		if header != "" {
+			request.Header.Set("TTL", header)
+		}
+
+		recorder := httptest.NewRecorder()
+		server.router.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	// expires checks that the given key expires after the given TTL
+	expires := func(key string, ttl time.Duration, before time.Time) {
+		pair, err := server.kvService.Get(key)
+		is.NoErr(err)
+		is.True(pair.Expires >= before.Add(ttl).UnixNano())
+		is.True(pair.Expires <= time.Now().Add(ttl).UnixNano())
+	}
+
+	// Keys without a TTL never expire
+	is.Equal(put("/v1/forever", ""), http.StatusCreated)
+	pair, err := server.kvService.Get("forever")
+	is.NoErr(err)
+	is.Equal(pair.Expires, int64(0))
+
+	// TTLs are either seconds or durations, in a header or a query parameter
+	before := time.Now()
+	is.Equal(put("/v1/header", "60"), http.StatusCreated)
+	expires("header", time.Minute, before)
+
+	before = time.Now()
+	is.Equal(put("/v1/query?ttl=1h30m", ""), http.StatusCreated)
+	expires("query", 90*time.Minute, before)
+
+	// The header takes precedence over the query parameter
+	before = time.Now()
+	is.Equal(put("/v1/both?ttl=1h", "30s"), http.StatusCreated)
+	expires("both", 30*time.Second, before)
+
+	// Invalid TTLs are rejected without writing anything
+	for _, ttl := range []string{"abc", "0", "-5", "-1m", "9223372037", "9223372036854775807"} {
+		is.Equal(put("/v1/invalid?ttl="+ttl, ""), http.StatusBadRequest)
+		is.Equal(put("/v1/invalid", ttl), http.StatusBadRequest)
+	}
+
+	_, err = server.kvService.Get("invalid")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// The largest TTL which fits is accepted
+	is.Equal(put("/v1/largest", "9223372036"), http.StatusCreated)
+	_, err = server.kvService.Get("largest")
+	is.NoErr(err)
+}
@@ -1,23 +1,78 @@
 package http
 
 import (
+	"compress/flate"
 	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/jmgilman/kv"
 	"github.com/jmgilman/kv/btree"
-	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/encoders"
 	"github.com/jmgilman/kv/service"
+	"github.com/jmgilman/kv/sstable"
+	"github.com/jmgilman/kv/wal"
+	"github.com/spf13/afero"
 )
 
+// batchMaxOps is the maximum number of operations in a single write batch.
+const batchMaxOps = 1000
+
+// dataDir is the directory in which all persistent data is stored.
+const dataDir = "data"
+
+// Compaction settings. See kv.LeveledStrategy and kv.Compactor for a
+// description of each.
+const (
+	compactionFanOut    = 10
+	compactionInterval  = time.Second
+	compactionL0Trigger = 4
+	compactionLevelSize = 10 * 1024 * 1024
+	compactionSegSize   = 2 * 1024 * 1024
+)
+
+// Key settings. Keys are lowercased, as they always were before normalization
+// could be configured, and ordered bytewise, which prefix scans rely on.
+// Neither can change once data has been written.
+var (
+	keyComparator kv.Comparator    = kv.BytewiseComparator{}
+	keyNormalizer kv.KeyNormalizer = kv.LowercaseNormalizer
+)
+
+// memStoreThreshold is the number of pairs the in-memory store may hold before
+// it's flushed to the non-volatile store.
+const memStoreThreshold = 1000
+
+// Scan limits. Scans return scanDefaultLimit pairs unless a limit is given, in
+// which case it's capped at scanMaxLimit.
+const (
+	scanDefaultLimit = 100
+	scanMaxLimit     = 1000
+)
+
+// segmentBloomBits is the number of bits used for each key in the Bloom filter
+// of a segment.
+const segmentBloomBits = 10
+
+// segmentBlockSize is the size, in bytes, of the blocks KVPair's are grouped
+// into within a segment.
+const segmentBlockSize = 4 * 1024
+
+// walSegmentSize is the size, in bytes, at which the write-ahead log starts a
+// new segment file.
+const walSegmentSize = 64 * 1024 * 1024
+
 type Server struct {
-	kvService service.KVService
+	compactor *kv.Compactor
+	kvService *service.KVService
+	manifest  kv.Log
 	router    *mux.Router
 	server    http.Server
 }
@@ -38,6 +93,13 @@ func (s *Server) ListenAndServe() {
 		if err := s.server.Shutdown(ctx); err != nil {
 			log.Fatal(err)
 		}
+		s.compactor.Stop()
+		if err := s.kvService.Close(); err != nil {
+			log.Printf("error closing key/value service: %v", err)
+		}
+		if err := s.manifest.Close(); err != nil {
+			log.Printf("error closing manifest: %v", err)
+		}
 
 		cancel()
 		close(done)
@@ -52,13 +114,48 @@ func (s *Server) ListenAndServe() {
 }
 
 func NewServer() (*Server, error) {
+	factory := func() kv.MemoryStore {
+		return btree.NewTree(keyComparator)
+	}
+	encoder := encoders.NewByteEncoder()
+
+	// Create non-volatile store
+	compressor := sstable.FlateCompressor{Level: flate.BestSpeed}
+	backend, err := sstable.OpenSegmentBackend(path.Join(dataDir, "segments"), encoder, compressor, segmentBlockSize, segmentBloomBits, factory, keyComparator)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := wal.Open(afero.NewOsFs(), path.Join(dataDir, "manifest"), encoder, walSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy := kv.NewLeveledStrategy(compactionL0Trigger, compactionLevelSize, compactionFanOut)
+	nvStore, err := kv.OpenSegmentStore(&backend, manifest, strategy, keyComparator)
+	if err != nil {
+		return nil, err
+	}
+
+	compactor := kv.NewCompactor(nvStore, compactionSegSize)
+
 	// Create key/value service
-	kvService := service.NewKVService(&btree.Tree{}, &mock.MockNVStore{})
+	writeLog, err := wal.Open(afero.NewOsFs(), path.Join(dataDir, "wal"), encoder, walSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	kvService, err := service.NewKVService(factory, nvStore, writeLog, memStoreThreshold, keyNormalizer, keyComparator)
+	if err != nil {
+		return nil, err
+	}
 
 	// Create server
 	router := mux.NewRouter()
 	server := &Server{
+		compactor: compactor,
 		kvService: kvService,
+		manifest:  manifest,
 		router:    router,
 		server:    http.Server{Addr: ":8080", Handler: router},
 	}
@@ -66,5 +163,7 @@ func NewServer() (*Server, error) {
 	// Register routes
 	server.routes()
 
+	compactor.Start(compactionInterval)
+
 	return server, nil
 }
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrorInvalidToken = errors.New("invalid continuation token")
+
+// scanTokenVersion is the version of the continuation token format, which is
+// the first byte of every token.
+const scanTokenVersion = 1
+
+// scanToken is the state of a paged scan which is handed to clients as an
+// opaque continuation token. Along with the last key sent it holds the bounds
+// and direction of the scan, so that a token can't be used to resume a
+// different scan.
+type scanToken struct {
+	end     string
+	key     string
+	reverse bool
+	start   string
+}
+
+// encode returns the token as a base64url string. It's laid out as the version
+// and direction, one byte each, followed by the start, end and key, each
+// prefixed with its length as a big-endian uint32.
+func (t scanToken) encode() string {
+	buf := []byte{scanTokenVersion, 0}
+	if t.reverse {
+		buf[1] = 1
+	}
+
+	size := make([]byte, 4)
+	for _, field := range []string{t.start, t.end, t.key} {
+		binary.BigEndian.PutUint32(size, uint32(len(field)))
+		buf = append(buf, size...)
+		buf = append(buf, field...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// decodeScanToken parses a token created by scanToken.encode. Returns
+// ErrorInvalidToken if it's malformed or has an unknown version.
+func decodeScanToken(token string) (scanToken, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buf) < 2 || buf[0] != scanTokenVersion || buf[1] > 1 {
+		return scanToken{}, ErrorInvalidToken
+	}
+
+	result := scanToken{reverse: buf[1] == 1}
+	buf = buf[2:]
+	for _, field := range []*string{&result.start, &result.end, &result.key} {
+		if len(buf) < 4 {
+			return scanToken{}, ErrorInvalidToken
+		}
+
+		size := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint64(len(buf)) < uint64(size) {
+			return scanToken{}, ErrorInvalidToken
+		}
+
+		*field = string(buf[:size])
+		buf = buf[size:]
+	}
+
+	if len(buf) != 0 {
+		return scanToken{}, ErrorInvalidToken
+	}
+
+	return result, nil
+}
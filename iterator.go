@@ -0,0 +1,386 @@
+package kv
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// Iterator provides an interface for walking over KVPair's in key order, in
+// either direction. A new Iterator isn't positioned at any KVPair until Seek or
+// SeekToLast is called.
+type Iterator interface {
+	// Close releases any resources held by the iterator.
+	Close() error
+
+	// Key returns the key of the current KVPair.
+	Key() string
+
+	// Next moves the iterator to the next KVPair. The iterator is no longer
+	// valid once it moves past the last KVPair.
+	Next() error
+
+	// Pair returns the current KVPair as it's stored, including tombstones.
+	Pair() KVPair
+
+	// Prev moves the iterator to the previous KVPair. The iterator is no
+	// longer valid once it moves before the first KVPair.
+	Prev() error
+
+	// Seek moves the iterator to the first KVPair whose key isn't lower than
+	// the given key. Seeking to an empty key moves it to the first KVPair,
+	// whatever the order of keys.
+	Seek(key string) error
+
+	// SeekToLast moves the iterator to the last KVPair.
+	SeekToLast() error
+
+	// Valid returns true if the iterator is positioned at a KVPair.
+	Valid() bool
+
+	// Value returns the value of the current KVPair.
+	Value() []byte
+}
+
+// iteratorWrapper holds an Iterator along with its priority. Lower priorities
+// hold newer data.
+type iteratorWrapper struct {
+	iterator Iterator
+	priority int
+}
+
+// iteratorHeap is a heap of iteratorWrapper's ordered by key, lowest first
+// or highest first if reverse is set, and then by priority so that the newest
+// version of a key is always on top.
+type iteratorHeap struct {
+	cmp      Comparator
+	reverse  bool
+	wrappers []*iteratorWrapper
+}
+
+func (h *iteratorHeap) Len() int {
+	return len(h.wrappers)
+}
+
+func (h *iteratorHeap) Less(i, j int) bool {
+	a, b := h.wrappers[i], h.wrappers[j]
+	c := h.cmp.Compare(a.iterator.Key(), b.iterator.Key())
+	if c == 0 {
+		return a.priority < b.priority
+	} else if h.reverse {
+		return c > 0
+	}
+
+	return c < 0
+}
+
+func (h *iteratorHeap) Swap(i, j int) {
+	h.wrappers[i], h.wrappers[j] = h.wrappers[j], h.wrappers[i]
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+	h.wrappers = append(h.wrappers, x.(*iteratorWrapper))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := h.wrappers
+	n := len(old)
+	x := old[n-1]
+	h.wrappers = old[0 : n-1]
+	return x
+}
+
+// top returns the iterator on top of the heap.
+func (h *iteratorHeap) top() Iterator {
+	return h.wrappers[0].iterator
+}
+
+// MergeIterator implements Iterator by merging several Iterator's into a
+// single view. Only the newest version of each key whose sequence number isn't
+// higher than the MergeIterator's is returned, and keys whose newest visible
+// version is a tombstone, or had expired when the MergeIterator was created,
+// are skipped entirely. Versions with the same sequence number are resolved in
+// favor of the newest Iterator.
+//
+// The merged Iterator's all move in the same direction. Changing direction
+// repositions each of them around the current key before moving on.
+type MergeIterator struct {
+	cmp     Comparator
+	current KVPair
+	heap    iteratorHeap
+	now     time.Time
+	seq     uint64
+	valid   bool
+	wrapped []*iteratorWrapper
+}
+
+// Close closes every merged Iterator, returning the first error encountered.
+func (m *MergeIterator) Close() error {
+	var result error
+	for _, wrapper := range m.wrapped {
+		if err := wrapper.iterator.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	m.valid = false
+	return result
+}
+
+// Key returns the key of the current KVPair.
+func (m *MergeIterator) Key() string {
+	return m.current.Key
+}
+
+// Next moves to the next live key.
+func (m *MergeIterator) Next() error {
+	if !m.valid {
+		return nil
+	}
+
+	// Move every merged Iterator past the current key
+	if m.heap.reverse {
+		key := m.current.Key
+		err := m.reset(false, func(iterator Iterator) error {
+			if err := iterator.Seek(key); err != nil {
+				return err
+			}
+
+			// Skip every version of the key, not just the newest
+			for iterator.Valid() && iterator.Key() == key {
+				if err := iterator.Next(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.settle()
+}
+
+// Pair returns the current KVPair, which is never a tombstone.
+func (m *MergeIterator) Pair() KVPair {
+	return m.current
+}
+
+// Prev moves to the previous live key.
+func (m *MergeIterator) Prev() error {
+	if !m.valid {
+		return nil
+	}
+
+	// Move every merged Iterator before the current key
+	if !m.heap.reverse {
+		key := m.current.Key
+		err := m.reset(true, func(iterator Iterator) error {
+			if err := iterator.Seek(key); err != nil {
+				return err
+			}
+
+			if iterator.Valid() {
+				return iterator.Prev()
+			}
+			return iterator.SeekToLast()
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.settle()
+}
+
+// Seek moves every merged Iterator to the given key and then to the first live
+// key which isn't lower than it.
+func (m *MergeIterator) Seek(key string) error {
+	err := m.reset(false, func(iterator Iterator) error {
+		return iterator.Seek(key)
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.settle()
+}
+
+// SeekToLast moves every merged Iterator to its last KVPair and then to the
+// last live key.
+func (m *MergeIterator) SeekToLast() error {
+	err := m.reset(true, func(iterator Iterator) error {
+		return iterator.SeekToLast()
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.settle()
+}
+
+// Valid returns true if the iterator is positioned at a KVPair.
+func (m *MergeIterator) Valid() bool {
+	return m.valid
+}
+
+// Value returns the value of the current KVPair.
+func (m *MergeIterator) Value() []byte {
+	return m.current.Value
+}
+
+// reset positions every merged Iterator with the given function and rebuilds
+// the heap from the ones which are still valid, ordered in the given
+// direction.
+func (m *MergeIterator) reset(reverse bool, position func(Iterator) error) error {
+	m.heap = iteratorHeap{cmp: m.cmp, reverse: reverse}
+	m.valid = false
+	for _, wrapper := range m.wrapped {
+		if err := position(wrapper.iterator); err != nil {
+			return err
+		}
+
+		if wrapper.iterator.Valid() {
+			m.heap.wrappers = append(m.heap.wrappers, wrapper)
+		}
+	}
+	heap.Init(&m.heap)
+
+	return nil
+}
+
+// settle takes every version of the next key off of the heap and moves each
+// Iterator holding that key past it, keeping the newest visible version. This
+// repeats until a key whose newest visible version is neither a tombstone nor
+// expired is found or the heap is empty.
+func (m *MergeIterator) settle() error {
+	for m.heap.Len() > 0 {
+		key := m.heap.top().Key()
+
+		var pair KVPair
+		var priority int
+		visible := false
+		for m.heap.Len() > 0 && m.heap.top().Key() == key {
+			wrapper := heap.Pop(&m.heap).(*iteratorWrapper)
+
+			version := wrapper.iterator.Pair()
+			if version.Seq <= m.seq {
+				if !visible || version.Seq > pair.Seq || (version.Seq == pair.Seq && wrapper.priority < priority) {
+					pair, priority, visible = version, wrapper.priority, true
+				}
+			}
+
+			var err error
+			if m.heap.reverse {
+				err = wrapper.iterator.Prev()
+			} else {
+				err = wrapper.iterator.Next()
+			}
+			if err != nil {
+				m.valid = false
+				return err
+			}
+
+			if wrapper.iterator.Valid() {
+				heap.Push(&m.heap, wrapper)
+			}
+		}
+
+		if visible && !pair.Tombstone && !pair.Expired(m.now) {
+			m.current = pair
+			m.valid = true
+			return nil
+		}
+	}
+
+	m.current = KVPair{}
+	m.valid = false
+	return nil
+}
+
+// NewMergeIterator returns a MergeIterator over the given Iterator's, which
+// must be ordered from newest to oldest, that only sees versions whose sequence
+// number isn't higher than seq. Use LatestSeq to see every version. Keys are
+// ordered by the given Comparator, or bytewise if it's nil.
+func NewMergeIterator(iterators []Iterator, seq uint64, cmp Comparator) *MergeIterator {
+	wrapped := make([]*iteratorWrapper, len(iterators))
+	for i := range iterators {
+		wrapped[i] = &iteratorWrapper{iterator: iterators[i], priority: i}
+	}
+
+	return &MergeIterator{
+		cmp:     DefaultComparator(cmp),
+		now:     time.Now(),
+		seq:     seq,
+		wrapped: wrapped,
+	}
+}
+
+// SliceIterator implements Iterator over a slice of KVPair's which is ordered
+// by key.
+type SliceIterator struct {
+	cmp   Comparator
+	index int
+	pairs []KVPair
+}
+
+func (s *SliceIterator) Close() error {
+	s.pairs = nil
+	return nil
+}
+
+func (s *SliceIterator) Key() string {
+	return s.pairs[s.index].Key
+}
+
+func (s *SliceIterator) Next() error {
+	if s.Valid() {
+		s.index++
+	}
+
+	return nil
+}
+
+func (s *SliceIterator) Pair() KVPair {
+	return s.pairs[s.index]
+}
+
+func (s *SliceIterator) Prev() error {
+	if s.Valid() {
+		s.index--
+	}
+
+	return nil
+}
+
+func (s *SliceIterator) Seek(key string) error {
+	s.index = sort.Search(len(s.pairs), func(i int) bool {
+		return key == "" || s.cmp.Compare(s.pairs[i].Key, key) >= 0
+	})
+
+	return nil
+}
+
+func (s *SliceIterator) SeekToLast() error {
+	s.index = len(s.pairs) - 1
+	return nil
+}
+
+func (s *SliceIterator) Valid() bool {
+	return s.index >= 0 && s.index < len(s.pairs)
+}
+
+func (s *SliceIterator) Value() []byte {
+	return s.pairs[s.index].Value
+}
+
+// NewSliceIterator returns a SliceIterator over the given pairs, which must be
+// ordered by the given Comparator, or bytewise if it's nil.
+func NewSliceIterator(pairs []KVPair, cmp Comparator) *SliceIterator {
+	return &SliceIterator{
+		cmp:   DefaultComparator(cmp),
+		index: len(pairs),
+		pairs: pairs,
+	}
+}
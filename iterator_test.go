@@ -0,0 +1,289 @@
+package kv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+func NewTestIterator(pairs []kv.KVPair) kv.Iterator {
+	iterator := mock.NewMockIterator(pairs)
+	return &iterator
+}
+
+func TestMergeIterator(t *testing.T) {
+	is := is.New(t)
+
+	newest := []kv.KVPair{
+		kv.NewKVPair("b", []byte("new")),
+		kv.DeleteKVPair("d"),
+		kv.NewKVPair("f", []byte("new")),
+	}
+	oldest := []kv.KVPair{
+		kv.NewKVPair("a", []byte("old")),
+		kv.NewKVPair("b", []byte("old")),
+		kv.NewKVPair("c", []byte("old")),
+		kv.NewKVPair("d", []byte("old")),
+		kv.DeleteKVPair("e"),
+	}
+	iterator := kv.NewMergeIterator([]kv.Iterator{
+		NewTestIterator(newest),
+		NewTestIterator(oldest),
+	}, kv.LatestSeq, nil)
+
+	// Not positioned until seeked
+	is.True(!iterator.Valid())
+
+	// Newest versions win and tombstones are hidden
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{
+		kv.NewKVPair("a", []byte("old")),
+		kv.NewKVPair("b", []byte("new")),
+		kv.NewKVPair("c", []byte("old")),
+		kv.NewKVPair("f", []byte("new")),
+	})
+
+	// Seeking lands on the first live key which isn't lower
+	is.NoErr(iterator.Seek("bb"))
+	is.True(iterator.Valid())
+	is.Equal(iterator.Key(), "c")
+	is.Equal(iterator.Value(), []byte("old"))
+
+	is.NoErr(iterator.Seek("d"))
+	is.Equal(iterator.Key(), "f")
+
+	// Seeking past the end
+	is.NoErr(iterator.Seek("g"))
+	is.True(!iterator.Valid())
+	is.NoErr(iterator.Close())
+}
+
+func TestMergeIteratorReverse(t *testing.T) {
+	is := is.New(t)
+
+	newest := []kv.KVPair{
+		kv.NewKVPair("b", []byte("new")),
+		kv.DeleteKVPair("d"),
+		kv.NewKVPair("f", []byte("new")),
+	}
+	oldest := []kv.KVPair{
+		kv.NewKVPair("a", []byte("old")),
+		kv.NewKVPair("b", []byte("old")),
+		kv.NewKVPair("c", []byte("old")),
+		kv.NewKVPair("d", []byte("old")),
+		kv.DeleteKVPair("g"),
+	}
+	iterator := kv.NewMergeIterator([]kv.Iterator{
+		NewTestIterator(newest),
+		NewTestIterator(oldest),
+	}, kv.LatestSeq, nil)
+
+	// Newest versions win and tombstones are hidden
+	result, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{
+		kv.NewKVPair("f", []byte("new")),
+		kv.NewKVPair("c", []byte("old")),
+		kv.NewKVPair("b", []byte("new")),
+		kv.NewKVPair("a", []byte("old")),
+	})
+
+	// Changing direction
+	is.NoErr(iterator.Seek("b"))
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Key(), "b")
+	is.Equal(iterator.Value(), []byte("new"))
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Key(), "a")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "b")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "f")
+
+	// Moving before the first key
+	is.NoErr(iterator.Seek("a"))
+	is.NoErr(iterator.Prev())
+	is.True(!iterator.Valid())
+}
+
+func TestMergeIteratorEmpty(t *testing.T) {
+	is := is.New(t)
+
+	iterator := kv.NewMergeIterator([]kv.Iterator{NewTestIterator(nil)}, kv.LatestSeq, nil)
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+
+	// Only tombstones
+	iterator = kv.NewMergeIterator([]kv.Iterator{NewTestIterator([]kv.KVPair{kv.DeleteKVPair("a")})}, kv.LatestSeq, nil)
+	result, err = helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestMergeIteratorReverseVersions(t *testing.T) {
+	is := is.New(t)
+	pair := func(key string, value string, seq uint64) kv.KVPair {
+		pair := kv.NewKVPair(key, []byte(value))
+		pair.Seq = seq
+		return pair
+	}
+
+	// Older versions of a key are shadowed in both directions
+	pairs := []kv.KVPair{pair("a", "a1", 1), pair("b", "b5", 5), pair("b", "b3", 3), pair("c", "c2", 2)}
+	iterator := kv.NewMergeIterator([]kv.Iterator{NewTestIterator(pairs)}, kv.LatestSeq, nil)
+
+	is.NoErr(iterator.SeekToLast())
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Value(), []byte("b5"))
+
+	// Changing direction moves past every version of the current key
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Value(), []byte("b5"))
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Key(), "a")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Value(), []byte("b5"))
+}
+
+func TestMergeIteratorSeq(t *testing.T) {
+	is := is.New(t)
+	pair := func(key string, value string, seq uint64) kv.KVPair {
+		pair := kv.NewKVPair(key, []byte(value))
+		pair.Seq = seq
+		return pair
+	}
+	tombstone := kv.DeleteKVPair("b")
+	tombstone.Seq = 6
+
+	// Versions are spread across iterators and ordered newest first within one
+	newest := []kv.KVPair{pair("a", "a5", 5), pair("a", "a3", 3), tombstone}
+	oldest := []kv.KVPair{pair("a", "a1", 1), pair("b", "b2", 2), pair("c", "c7", 7)}
+	read := func(seq uint64) []kv.KVPair {
+		iterator := kv.NewMergeIterator([]kv.Iterator{
+			NewTestIterator(newest),
+			NewTestIterator(oldest),
+		}, seq, nil)
+
+		result, err := helper.ReadIterator(iterator, "")
+		is.NoErr(err)
+		return result
+	}
+
+	// Only versions up to the sequence number are visible
+	is.Equal(read(kv.LatestSeq), []kv.KVPair{pair("a", "a5", 5), pair("c", "c7", 7)})
+	is.Equal(read(5), []kv.KVPair{pair("a", "a5", 5), pair("b", "b2", 2)})
+	is.Equal(read(4), []kv.KVPair{pair("a", "a3", 3), pair("b", "b2", 2)})
+	is.Equal(read(1), []kv.KVPair{pair("a", "a1", 1)})
+	is.Equal(len(read(0)), 0)
+
+	// Reverse iteration sees the same versions
+	iterator := kv.NewMergeIterator([]kv.Iterator{
+		NewTestIterator(newest),
+		NewTestIterator(oldest),
+	}, 4, nil)
+	result, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{pair("b", "b2", 2), pair("a", "a3", 3)})
+}
+
+func TestMergeIteratorExpired(t *testing.T) {
+	is := is.New(t)
+
+	expired := kv.NewKVPair("a", []byte("expired"))
+	expired.Expires = 1
+	expired.Seq = 2
+	older := kv.NewKVPair("a", []byte("older"))
+	older.Seq = 1
+	live := kv.NewKVPair("b", []byte("live"))
+	live.Expires = time.Now().Add(time.Hour).UnixNano()
+
+	// An expired version hides the key along with its older versions
+	iterator := kv.NewMergeIterator([]kv.Iterator{
+		NewTestIterator([]kv.KVPair{expired, live}),
+		NewTestIterator([]kv.KVPair{older}),
+	}, kv.LatestSeq, nil)
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{live})
+}
+
+func TestSliceIterator(t *testing.T) {
+	is := is.New(t)
+
+	pairs := []kv.KVPair{
+		kv.NewKVPair("a", []byte("a")),
+		kv.NewKVPair("c", []byte("c")),
+		kv.NewKVPair("e", []byte("e")),
+	}
+	iterator := kv.NewSliceIterator(pairs, nil)
+	is.True(!iterator.Valid())
+
+	// Seeks to the first key which isn't lower
+	is.NoErr(iterator.Seek("b"))
+	is.True(iterator.Valid())
+	is.Equal(iterator.Key(), "c")
+
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Value(), []byte("e"))
+	is.NoErr(iterator.Next())
+	is.True(!iterator.Valid())
+
+	// Walks backwards from the last key
+	is.NoErr(iterator.SeekToLast())
+	is.Equal(iterator.Key(), "e")
+	is.NoErr(iterator.Prev())
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Pair(), pairs[0])
+	is.NoErr(iterator.Prev())
+	is.True(!iterator.Valid())
+
+	// Seeking past the last key
+	is.NoErr(iterator.Seek("f"))
+	is.True(!iterator.Valid())
+}
+
+func TestMergeIteratorComparator(t *testing.T) {
+	is := is.New(t)
+	cmp := mock.ReverseComparator{}
+
+	newest := []kv.KVPair{
+		kv.NewKVPair("d", []byte("new")),
+		kv.DeleteKVPair("b"),
+	}
+	oldest := []kv.KVPair{
+		kv.NewKVPair("e", []byte("old")),
+		kv.NewKVPair("d", []byte("old")),
+		kv.NewKVPair("b", []byte("old")),
+		kv.NewKVPair("a", []byte("old")),
+	}
+	iterator := kv.NewMergeIterator([]kv.Iterator{
+		kv.NewSliceIterator(newest, cmp),
+		kv.NewSliceIterator(oldest, cmp),
+	}, kv.LatestSeq, cmp)
+
+	// Keys are merged in the order of the comparator
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{oldest[0], newest[0], oldest[3]})
+
+	reverse, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(reverse, helper.ReversePairs(result))
+
+	// Seeking moves to the next live key in the order of the comparator
+	is.NoErr(iterator.Seek("c"))
+	is.Equal(iterator.Key(), "a")
+}
@@ -2,7 +2,7 @@ package kv
 
 import (
 	"errors"
-	"strings"
+	"time"
 )
 
 var ErrorKeyTooLarge = errors.New("key exceeds max size")
@@ -10,17 +10,59 @@ var ErrorNoSuchKey = errors.New("no such key")
 var ErrorOutOfRange = errors.New("key is out of range")
 var ErrorValueTooLarge = errors.New("value exceeds max size")
 
-// KVPair is the elementary structure for storing key/value pairs
+// KVPair is the elementary structure for storing key/value pairs. Every write
+// is given a sequence number which is higher than that of any write before it,
+// so that multiple versions of a key can be told apart. A pair may also be
+// given an expiry time, in Unix nanoseconds, after which it's treated as
+// deleted. Pairs with a zero expiry time never expire.
 type KVPair struct {
+	Expires   int64
 	Key       string
+	Seq       uint64
 	Tombstone bool
 	Value     []byte
 }
 
+// NewKVPair returns a KVPair holding the given key/value. The key is kept as
+// is, see KeyNormalizer.
 func NewKVPair(key string, value []byte) KVPair {
-	return KVPair{strings.ToLower(key), false, value}
+	return KVPair{Key: key, Value: value}
 }
 
+// DeleteKVPair returns a tombstone for the given key.
 func DeleteKVPair(key string) KVPair {
-	return KVPair{strings.ToLower(key), true, []byte{}}
+	return KVPair{Key: key, Tombstone: true, Value: []byte{}}
+}
+
+// Expired returns true if the pair has an expiry time which isn't after the
+// given time.
+func (k KVPair) Expired(now time.Time) bool {
+	return k.Expires != 0 && k.Expires <= now.UnixNano()
+}
+
+// PrefixEnd returns the lowest key which is greater than every key starting
+// with the given prefix, or an empty string if there is no such key. Keys are
+// compared bytewise, see BytewiseComparator.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+
+	return ""
+}
+
+// hideTombstone converts the result of a lookup which found a tombstone, or a
+// pair which has expired, into ErrorNoSuchKey.
+func hideTombstone(pair *KVPair, err error) (*KVPair, error) {
+	if err != nil {
+		return nil, err
+	} else if pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, ErrorNoSuchKey
+	}
+
+	return pair, nil
 }
@@ -0,0 +1,56 @@
+package kv_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/matryer/is"
+)
+
+func TestPrefixEnd(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(kv.PrefixEnd("user:"), "user;")
+	is.Equal(kv.PrefixEnd("a\xff"), "b")
+	is.Equal(kv.PrefixEnd("\xff\xff"), "")
+	is.Equal(kv.PrefixEnd(""), "")
+}
+
+func TestKVPairExpired(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+
+	// Pairs without an expiry time never expire
+	pair := kv.NewKVPair("a", []byte("a"))
+	is.True(!pair.Expired(now))
+
+	pair.Expires = now.Add(time.Second).UnixNano()
+	is.True(!pair.Expired(now))
+	is.True(pair.Expired(now.Add(time.Second)))
+}
+
+func TestKeyNormalizers(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(kv.IdentityNormalizer("Key\xff"), "Key\xff")
+	is.Equal(kv.LowercaseNormalizer("Key"), "key")
+
+	// Canonically equivalent keys normalize to the same key
+	is.Equal(kv.NFCNormalizer("cafe\u0301"), "caf\u00e9")
+	is.Equal(kv.NFCNormalizer("caf\u00e9"), "caf\u00e9")
+}
+
+func TestComparator(t *testing.T) {
+	is := is.New(t)
+
+	cmp := kv.DefaultComparator(nil)
+	is.Equal(cmp, kv.BytewiseComparator{})
+	is.True(cmp.Compare("a", "b") < 0)
+	is.True(cmp.Compare("B", "a") < 0)
+	is.True(cmp.Compare("\xff", "\x00") > 0)
+	is.Equal(cmp.Compare("a", "a"), 0)
+
+	is.Equal(kv.DefaultComparator(mock.ReverseComparator{}), mock.ReverseComparator{})
+}
@@ -6,6 +6,11 @@ const (
 	LogDelete LogAction = iota
 	LogNew
 	LogPut
+	LogKeyDelete
+	LogKeyPut
+	LogInsert
+	LogKeyBatch
+	LogReplace
 )
 
 type Log interface {
@@ -13,6 +18,10 @@ type Log interface {
 	First() (uint64, error)
 	Last() (uint64, error)
 	Read(index uint64) (LogEntry, error)
+
+	// TruncateFront removes all entries with an index lower than the given
+	// index. Passing Last()+1 removes every entry from the log.
+	TruncateFront(index uint64) error
 	Write(index uint64, entry LogEntry) error
 }
 
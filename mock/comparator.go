@@ -0,0 +1,11 @@
+package mock
+
+import "strings"
+
+// ReverseComparator implements kv.Comparator by ordering keys from the highest
+// to the lowest byte value.
+type ReverseComparator struct{}
+
+func (ReverseComparator) Compare(a string, b string) int {
+	return strings.Compare(b, a)
+}
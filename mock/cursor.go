@@ -17,12 +17,13 @@ func (m *MockCursor) Done() bool {
 }
 
 func (m *MockCursor) Next() (kv.KVPair, error) {
-	m.index++
 	if m.index >= len(m.pairs) {
+		m.done = true
 		return kv.KVPair{}, io.EOF
 	}
 
-	return m.pairs[m.index], nil
+	m.index++
+	return m.pairs[m.index-1], nil
 }
 
 func (m *MockCursor) ReadToEnd() ([]kv.KVPair, error) {
@@ -36,6 +37,7 @@ func (m *MockCursor) ReadToEnd() ([]kv.KVPair, error) {
 }
 
 func (m *MockCursor) Reset() error {
+	m.done = false
 	m.index = 0
 	return nil
 }
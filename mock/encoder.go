@@ -9,6 +9,9 @@ import (
 	"github.com/jmgilman/kv"
 )
 
+// MockEncoderID identifies data encoded by MockEncoder.
+const MockEncoderID uint32 = 0xffffffff
+
 // MockEncoder implements Encoder by appending encoded pairs to a private slice
 // and returning the index of the pair in byte form. Subsequent calls to decode
 // with the index will return the original pair.
@@ -47,6 +50,11 @@ func (t *MockEncoder) EncodePair(pair kv.KVPair) ([]byte, error) {
 	return buf, nil
 }
 
+// ID returns the identifier of the mock encoding.
+func (m *MockEncoder) ID() uint32 {
+	return MockEncoderID
+}
+
 // Pairs returns the cumalative list of pairs that were passed into
 // EncodePair().
 func (m *MockEncoder) Pairs() []kv.KVPair {
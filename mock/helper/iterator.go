@@ -0,0 +1,51 @@
+package helper
+
+import (
+	"github.com/jmgilman/kv"
+)
+
+// ReadIterator seeks the given iterator to the given key and returns every
+// pair from there on.
+func ReadIterator(iterator kv.Iterator, key string) ([]kv.KVPair, error) {
+	if err := iterator.Seek(key); err != nil {
+		return nil, err
+	}
+
+	var pairs []kv.KVPair
+	for iterator.Valid() {
+		pairs = append(pairs, iterator.Pair())
+		if err := iterator.Next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return pairs, nil
+}
+
+// ReadIteratorReverse moves the given iterator to its last pair and returns
+// every pair from there back to the first.
+func ReadIteratorReverse(iterator kv.Iterator) ([]kv.KVPair, error) {
+	if err := iterator.SeekToLast(); err != nil {
+		return nil, err
+	}
+
+	var pairs []kv.KVPair
+	for iterator.Valid() {
+		pairs = append(pairs, iterator.Pair())
+		if err := iterator.Prev(); err != nil {
+			return nil, err
+		}
+	}
+
+	return pairs, nil
+}
+
+// ReversePairs returns a copy of the given pairs in reverse order.
+func ReversePairs(pairs []kv.KVPair) []kv.KVPair {
+	reversed := make([]kv.KVPair, len(pairs))
+	for i := range pairs {
+		reversed[len(pairs)-1-i] = pairs[i]
+	}
+
+	return reversed
+}
@@ -0,0 +1,71 @@
+package mock
+
+import (
+	"sort"
+
+	"github.com/jmgilman/kv"
+)
+
+// MockIterator implements kv.Iterator over an ordered slice of KVPair's.
+type MockIterator struct {
+	index int
+	pairs []kv.KVPair
+}
+
+func (m *MockIterator) Close() error {
+	return nil
+}
+
+func (m *MockIterator) Key() string {
+	return m.pairs[m.index].Key
+}
+
+func (m *MockIterator) Next() error {
+	if m.Valid() {
+		m.index++
+	}
+
+	return nil
+}
+
+func (m *MockIterator) Pair() kv.KVPair {
+	return m.pairs[m.index]
+}
+
+func (m *MockIterator) Prev() error {
+	if m.Valid() {
+		m.index--
+	}
+
+	return nil
+}
+
+func (m *MockIterator) Seek(key string) error {
+	m.index = sort.Search(len(m.pairs), func(i int) bool {
+		return m.pairs[i].Key >= key
+	})
+
+	return nil
+}
+
+func (m *MockIterator) SeekToLast() error {
+	m.index = len(m.pairs) - 1
+	return nil
+}
+
+func (m *MockIterator) Valid() bool {
+	return m.index >= 0 && m.index < len(m.pairs)
+}
+
+func (m *MockIterator) Value() []byte {
+	return m.pairs[m.index].Value
+}
+
+// NewMockIterator returns a MockIterator over the given pairs, which must be
+// ordered by key.
+func NewMockIterator(pairs []kv.KVPair) MockIterator {
+	return MockIterator{
+		index: len(pairs),
+		pairs: pairs,
+	}
+}
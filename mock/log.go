@@ -46,6 +46,20 @@ func (m *MockLog) Read(index uint64) (kv.LogEntry, error) {
 	return entry, nil
 }
 
+func (m *MockLog) TruncateFront(index uint64) error {
+	var indexes []uint64
+	for _, i := range m.indexes {
+		if i < index {
+			delete(m.entries, i)
+		} else {
+			indexes = append(indexes, i)
+		}
+	}
+
+	m.indexes = indexes
+	return nil
+}
+
 func (m *MockLog) Write(index uint64, entry kv.LogEntry) error {
 	m.entries[index] = entry
 	m.indexes = append(m.indexes, index)
@@ -55,3 +69,9 @@ func (m *MockLog) Write(index uint64, entry kv.LogEntry) error {
 
 	return nil
 }
+
+func NewMockLog() MockLog {
+	return MockLog{
+		entries: map[uint64]kv.LogEntry{},
+	}
+}
@@ -2,6 +2,7 @@ package mock
 
 import (
 	"sort"
+	"time"
 
 	"github.com/jmgilman/kv"
 )
@@ -22,6 +23,22 @@ func (m *MockMemoryStore) Delete(key string) error {
 }
 
 func (m *MockMemoryStore) Get(key string) (*kv.KVPair, error) {
+	pair, err := m.Lookup(key)
+	if err != nil {
+		return nil, err
+	} else if pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	return pair, nil
+}
+
+func (m *MockMemoryStore) Iterator() kv.Iterator {
+	iterator := NewMockIterator(append([]kv.KVPair{}, m.store...))
+	return &iterator
+}
+
+func (m *MockMemoryStore) Lookup(key string) (*kv.KVPair, error) {
 	for _, pair := range m.store {
 		if pair.Key == key {
 			return &pair, nil
@@ -57,8 +74,18 @@ func (m *MockMemoryStore) Pairs() []*kv.KVPair {
 }
 
 func (m *MockMemoryStore) Put(pair kv.KVPair) error {
+	for i := range m.store {
+		if m.store[i].Key == pair.Key && m.store[i].Seq == pair.Seq {
+			m.store[i] = pair
+			return nil
+		}
+	}
+
 	m.store = append(m.store, pair)
-	sort.Slice(m.store, func(i, j int) bool {
+	sort.SliceStable(m.store, func(i, j int) bool {
+		if m.store[i].Key == m.store[j].Key {
+			return m.store[i].Seq > m.store[j].Seq
+		}
 		return m.store[i].Key < m.store[j].Key
 	})
 	return nil
@@ -1,17 +1,119 @@
 package mock
 
-import "github.com/jmgilman/kv"
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/jmgilman/kv"
+)
 
 // MockNVStore represents a mock of kv.NVStore
 type MockNVStore struct {
-	GetFn func(key string) (*kv.KVPair, error)
-	PutFn func(store kv.MemoryStore) (kv.SegmentID, error)
+	GetFn      func(key string) (*kv.KVPair, error)
+	IteratorFn func(seq uint64) kv.Iterator
+	LookupFn   func(key string) (*kv.KVPair, error)
+	PutFn      func(store kv.MemoryStore) (kv.SegmentID, error)
+	SeqFn      func() uint64
+	snapshots  kv.SnapshotList
 }
 
 func (m *MockNVStore) Get(key string) (*kv.KVPair, error) {
 	return m.GetFn(key)
 }
 
+func (m *MockNVStore) Iterator(seq uint64) kv.Iterator {
+	return m.IteratorFn(seq)
+}
+
+func (m *MockNVStore) Lookup(key string) (*kv.KVPair, error) {
+	return m.LookupFn(key)
+}
+
 func (m *MockNVStore) New(store kv.MemoryStore) (kv.SegmentID, error) {
 	return m.PutFn(store)
 }
+
+func (m *MockNVStore) Seq() uint64 {
+	return m.SeqFn()
+}
+
+func (m *MockNVStore) Snapshots() *kv.SnapshotList {
+	return &m.snapshots
+}
+
+// NewMockNVStore returns a MockNVStore which keeps every MemoryStore passed to
+// New() in memory and searches them from newest to oldest on Get() and
+// Lookup(), stopping at the first store which holds the key or a tombstone for
+// it. Iterator() merges every store from newest to oldest in bytewise key
+// order and Seq() returns the highest sequence number in any of them. It's safe
+// for concurrent use.
+func NewMockNVStore() MockNVStore {
+	var mu sync.RWMutex
+	var stores []kv.MemoryStore
+	lookup := func(key string) (*kv.KVPair, error) {
+		mu.RLock()
+		defer mu.RUnlock()
+
+		for i := len(stores) - 1; i >= 0; i-- {
+			pair, err := stores[i].Lookup(key)
+			if err != nil {
+				if errors.Is(err, kv.ErrorNoSuchKey) {
+					continue
+				}
+				return nil, err
+			}
+
+			return pair, nil
+		}
+
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	return MockNVStore{
+		GetFn: func(key string) (*kv.KVPair, error) {
+			pair, err := lookup(key)
+			if err != nil {
+				return nil, err
+			} else if pair.Tombstone || pair.Expired(time.Now()) {
+				return nil, kv.ErrorNoSuchKey
+			}
+
+			return pair, nil
+		},
+		IteratorFn: func(seq uint64) kv.Iterator {
+			mu.RLock()
+			defer mu.RUnlock()
+
+			var iterators []kv.Iterator
+			for i := len(stores) - 1; i >= 0; i-- {
+				iterators = append(iterators, stores[i].Iterator())
+			}
+
+			return kv.NewMergeIterator(iterators, seq, nil)
+		},
+		LookupFn: lookup,
+		PutFn: func(store kv.MemoryStore) (kv.SegmentID, error) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			stores = append(stores, store)
+			return kv.NewSegmentID(), nil
+		},
+		SeqFn: func() uint64 {
+			mu.RLock()
+			defer mu.RUnlock()
+
+			var seq uint64
+			for _, store := range stores {
+				for _, pair := range store.Pairs() {
+					if pair.Seq > seq {
+						seq = pair.Seq
+					}
+				}
+			}
+
+			return seq
+		},
+	}
+}
@@ -1,18 +1,50 @@
 package mock
 
 import (
+	"time"
+
 	"github.com/jmgilman/kv"
 )
 
 type MockSegment struct {
-	id    kv.SegmentID
-	store MockMemoryStore
+	closed  bool
+	created time.Time
+	id      kv.SegmentID
+	store   MockMemoryStore
+}
+
+func (m *MockSegment) Close() error {
+	m.closed = true
+	return nil
+}
+
+// Closed returns true if the segment has been closed.
+func (m *MockSegment) Closed() bool {
+	return m.closed
+}
+
+func (m *MockSegment) Cursor() (kv.Cursor, error) {
+	encoder := MockEncoder{}
+	file, _ := encoder.Set(m.store.store)
+	return kv.NewCursor(&encoder, file), nil
+}
+
+func (m *MockSegment) Created() time.Time {
+	return m.created
 }
 
 func (m *MockSegment) Get(key string) (*kv.KVPair, error) {
 	return m.store.Get(key)
 }
 
+func (m *MockSegment) Iterator() kv.Iterator {
+	return m.store.Iterator()
+}
+
+func (m *MockSegment) Lookup(key string) (*kv.KVPair, error) {
+	return m.store.Lookup(key)
+}
+
 func (m *MockSegment) Min() *kv.KVPair {
 	return m.store.Min()
 }
@@ -25,12 +57,33 @@ func (m *MockSegment) ID() kv.SegmentID {
 	return m.id
 }
 
+func (m *MockSegment) Seq() uint64 {
+	var seq uint64
+	for _, pair := range m.store.store {
+		if pair.Seq > seq {
+			seq = pair.Seq
+		}
+	}
+
+	return seq
+}
+
+func (m *MockSegment) Size() int {
+	var size int
+	for _, pair := range m.store.store {
+		size += len(pair.Key) + len(pair.Value)
+	}
+
+	return size
+}
+
 func NewMockSegment(pairs []kv.KVPair) MockSegment {
 	id := kv.NewSegmentID()
 	store := NewMockMemoryStore(pairs)
 	return MockSegment{
-		id:    id,
-		store: store,
+		created: time.Now(),
+		id:      id,
+		store:   store,
 	}
 }
 
@@ -64,8 +117,9 @@ func (m *MockSegmentBackend) New(id kv.SegmentID, store kv.MemoryStore) error {
 	}
 
 	segment := MockSegment{
-		id:    id,
-		store: NewMockMemoryStore(pairs),
+		created: time.Now(),
+		id:      id,
+		store:   NewMockMemoryStore(pairs),
 	}
 	m.segments[id] = segment
 
@@ -90,7 +144,9 @@ type MockSegmentWriter struct {
 }
 
 func (m *MockSegmentWriter) Close() error {
-	m.backend.segments[m.id] = NewMockSegment(m.pairs)
+	segment := NewMockSegment(m.pairs)
+	segment.id = m.id
+	m.backend.segments[m.id] = segment
 	return nil
 }
 
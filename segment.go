@@ -3,22 +3,53 @@ package kv
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var ErrorInvalidLogEntry = errors.New("invalid log entry")
 var ErrorInvalidSegmentLevel = errors.New("invalid segment level")
 var ErrorSegmentNotFound = errors.New("segment not found")
 
+// ErrorCorrupted is returned when the data stored in a segment fails its
+// checksum. It names the segment and the offset of the data which failed.
+type ErrorCorrupted struct {
+	ID     SegmentID
+	Offset int
+}
+
+func (e ErrorCorrupted) Error() string {
+	return fmt.Sprintf("segment %s is corrupted at offset %d", e.ID, e.Offset)
+}
+
 type SegmentID = uuid.UUID
 
 // Segment is the base building block for a non-volatile KV store and provides
 // a durable version of a MemoryStore.
 type Segment interface {
+	// Close releases the segment once it's no longer part of a store. Any
+	// Iterator opened from it keeps working until it's closed itself.
+	Close() error
+
+	// Cursor returns a Cursor over every KVPair stored in this segment,
+	// including tombstones, in key order.
+	Cursor() (Cursor, error)
+
+	// Created returns the time at which this segment was written.
+	Created() time.Time
+
 	// ID returns the unique ID of this segment.
 	ID() SegmentID
 
+	// Iterator returns an Iterator over every KVPair stored in this segment,
+	// including tombstones and older versions.
+	Iterator() Iterator
+
 	// Min returns the lowest key stored in this segment.
 	Min() *KVPair
 
@@ -26,8 +57,20 @@ type Segment interface {
 	Max() *KVPair
 
 	// Get searches the segment for the given key and returns the KVPair if found.
-	// Returns ErrorNoSuchKey if the key was not found.
+	// Returns ErrorNoSuchKey if the key was not found, has been deleted or has
+	// expired.
 	Get(key string) (*KVPair, error)
+
+	// Lookup searches the segment for the given key and returns the newest
+	// version of its KVPair as it's stored, including tombstones. Returns
+	// ErrorNoSuchKey only if the key was not found.
+	Lookup(key string) (*KVPair, error)
+
+	// Seq returns the highest sequence number stored in this segment.
+	Seq() uint64
+
+	// Size returns the size of this segment in bytes.
+	Size() int
 }
 
 // SegmentBackend represents an interface which is capable of persistently
@@ -36,7 +79,8 @@ type SegmentBackend interface {
 	// Delete removes the segment with the given ID.
 	Delete(id SegmentID) error
 
-	// Get returns the Segment with the given ID.
+	// Get returns the Segment with the given ID. Returns ErrorSegmentNotFound
+	// if the segment doesn't exist or was never completely written.
 	Get(id SegmentID) (Segment, error)
 
 	// New creates a new Segment from a MemoryStore and returns its ID.
@@ -60,29 +104,11 @@ type SegmentWriter interface {
 	WriteAll(pairs []KVPair) (int, error)
 }
 
-// // SegmentLevel is an ordered slice of Segment's where smaller indexed Segment's
-// // contain newer data and larger indexed Segment's contain older data. It
-// // provides a common interface for searching across mulitiple Segment's.
-// type SegmentLevel []Segment
-
-// // Get queries the internal list of Segment's for the given key and returns the
-// // first found result.
-// func (s *SegmentLevel) Get(key string) (*KVPair, error) {
-// 	for _, segment := range *s {
-// 		pair, err := segment.Get(key)
-// 		if err != nil {
-// 			if !errors.Is(err, ErrorNoSuchKey) {
-// 				return nil, err
-// 			}
-// 		}
-
-// 		return pair, nil
-// 	}
-
-// 	return nil, ErrorNoSuchKey
-// }
-
+// SegmentLevel is a collection of non-overlapping Segment's ordered by their
+// lowest key. It provides a common interface for searching across multiple
+// Segment's.
 type SegmentLevel struct {
+	cmp      Comparator
 	segments []Segment
 }
 
@@ -97,16 +123,10 @@ func (s *SegmentLevel) DeleteSegment(id SegmentID) error {
 	return ErrorSegmentNotFound
 }
 
+// Get searches the segment whose range contains the given key. Returns
+// ErrorNoSuchKey if no segment contains the key or it has been deleted.
 func (s *SegmentLevel) Get(key string) (*KVPair, error) {
-	for _, segment := range s.segments {
-		if key >= segment.Min().Key {
-			if key <= segment.Max().Key {
-				return segment.Get(key)
-			}
-		}
-	}
-
-	return nil, ErrorNoSuchKey
+	return hideTombstone(s.Lookup(key))
 }
 
 func (s *SegmentLevel) GetSegment(id SegmentID) (*Segment, error) {
@@ -119,15 +139,39 @@ func (s *SegmentLevel) GetSegment(id SegmentID) (*Segment, error) {
 	return nil, ErrorSegmentNotFound
 }
 
+// Lookup searches the segment whose range contains the given key and returns
+// the KVPair as it's stored, including tombstones. Returns ErrorNoSuchKey if
+// no segment contains the key.
+func (s *SegmentLevel) Lookup(key string) (*KVPair, error) {
+	for _, segment := range s.segments {
+		if s.cmp.Compare(key, segment.Min().Key) >= 0 {
+			if s.cmp.Compare(key, segment.Max().Key) <= 0 {
+				return segment.Lookup(key)
+			}
+		}
+	}
+
+	return nil, ErrorNoSuchKey
+}
+
+// Segments returns the segments in this level ordered by their lowest key.
+func (s *SegmentLevel) Segments() []Segment {
+	return s.segments
+}
+
 func (s *SegmentLevel) Put(segment Segment) {
 	s.segments = append(s.segments, segment)
 	sort.Slice(s.segments, func(i, j int) bool {
-		return s.segments[i].Min().Key < s.segments[j].Min().Key
+		return s.cmp.Compare(s.segments[i].Min().Key, s.segments[j].Min().Key) < 0
 	})
 }
 
-func NewSegmentLevel(segments []Segment) SegmentLevel {
+// NewSegmentLevel returns a new SegmentLevel holding the given segments, which
+// must be ordered by their lowest key using the given Comparator, or bytewise
+// if it's nil.
+func NewSegmentLevel(segments []Segment, cmp Comparator) SegmentLevel {
 	return SegmentLevel{
+		cmp:      DefaultComparator(cmp),
 		segments: segments,
 	}
 }
@@ -136,59 +180,141 @@ func NewSegmentID() SegmentID {
 	return uuid.New()
 }
 
+// SegmentStore manages a collection of Segment's stored in a SegmentBackend.
+// Newly created segments are appended to a buffer and can later be moved into
+// one of several SegmentLevel's. Every change is recorded in a Log so that the
+// layout can be recovered when the store is reopened.
+//
+// Every version of a key newer than the oldest snapshot is kept when segments
+// are compacted, see Snapshots.
+//
+// Keys are ordered by the Comparator of the store, which must match the one
+// used by its SegmentBackend.
+//
+// A SegmentStore is safe for concurrent use.
 type SegmentStore struct {
-	backend SegmentBackend
-	buffer  []Segment
-	levels  []SegmentLevel
-	log     Log
+	backend   SegmentBackend
+	buffer    []Segment
+	cmp       Comparator
+	levels    []SegmentLevel
+	log       Log
+	mu        sync.RWMutex
+	snapshots SnapshotList
+	strategy  CompactionStrategy
 }
 
+// Buffer returns the segments in the buffer ordered from oldest to newest.
+func (s *SegmentStore) Buffer() []Segment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.copyBuffer()
+}
+
+// Delete removes the segment with the given ID from the store, deletes it from
+// the backend and closes it.
 func (s *SegmentStore) Delete(id SegmentID) error {
-	// Log delete
-	meta := []KVPair{NewKVPair("ID", []byte(id.String()))}
-	if err := s.newLogEntry(LogDelete, meta); err != nil {
-		return err
-	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Search for segment in buffer
-	for i, segment := range s.buffer {
-		if segment.ID() == id {
-			// Delete segment from backend
-			if err := s.backend.Delete(id); err != nil {
-				return err
-			}
+	return s.delete(id)
+}
 
-			// Delete segment from buffer
-			s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
-			return nil
-		}
+// Get searches the store for the given key. Returns ErrorNoSuchKey if the key
+// doesn't exist or the newest version of it is a tombstone.
+func (s *SegmentStore) Get(key string) (*KVPair, error) {
+	return hideTombstone(s.Lookup(key))
+}
+
+// Iterator returns a MergeIterator over every segment in the store which sees
+// versions up to the given sequence number. The buffer is ordered from the
+// newest to the oldest segment and comes before each level in order.
+func (s *SegmentStore) Iterator(seq uint64) Iterator {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var iterators []Iterator
+	for i := len(s.buffer) - 1; i >= 0; i-- {
+		iterators = append(iterators, s.buffer[i].Iterator())
 	}
 
-	// Search for segment in levels
 	for _, level := range s.levels {
-		if _, err := level.GetSegment(id); err == nil {
-			// Delete segment from backend
-			if err := s.backend.Delete(id); err != nil {
-				return err
-			}
+		for _, segment := range level.segments {
+			iterators = append(iterators, segment.Iterator())
+		}
+	}
 
-			// Delete segment from level
-			if err := level.DeleteSegment(id); err != nil {
-				return err
+	return NewMergeIterator(iterators, seq, s.cmp)
+}
+
+// Levels returns the levels of the store ordered from newest to oldest.
+func (s *SegmentStore) Levels() []SegmentLevel {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.copyLevels()
+}
+
+// Layout returns a snapshot of the buffer and levels of the store. Both are
+// copied under the same lock, so a concurrent compaction is either seen in
+// full or not at all.
+func (s *SegmentStore) Layout() Layout {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return Layout{
+		Buffer:     s.copyBuffer(),
+		Comparator: s.cmp,
+		Levels:     s.copyLevels(),
+	}
+}
+
+// Lookup searches the store for the given key. The buffer is searched from the
+// newest to the oldest segment and then each level is searched in order,
+// stopping at the first segment which holds the key, even if it holds a
+// tombstone for it. Returns ErrorNoSuchKey if no segment holds the key.
+func (s *SegmentStore) Lookup(key string) (*KVPair, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for i := len(s.buffer) - 1; i >= 0; i-- {
+		pair, err := s.buffer[i].Lookup(key)
+		if err != nil {
+			if errors.Is(err, ErrorNoSuchKey) {
+				continue
 			}
+			return nil, err
+		}
 
-			return nil
+		return pair, nil
+	}
+
+	for i := range s.levels {
+		pair, err := s.levels[i].Lookup(key)
+		if err != nil {
+			if errors.Is(err, ErrorNoSuchKey) {
+				continue
+			}
+			return nil, err
 		}
+
+		return pair, nil
 	}
 
-	return ErrorSegmentNotFound
+	return nil, ErrorNoSuchKey
 }
 
+// New writes the given MemoryStore to a new segment and appends it to the
+// buffer. The store is only locked while the segment is logged and added, not
+// while it's being written.
 func (s *SegmentStore) New(store MemoryStore) (SegmentID, error) {
 	// Log new segment
 	id := NewSegmentID()
 	meta := []KVPair{NewKVPair("ID", []byte(id.String()))}
-	if err := s.newLogEntry(LogNew, meta); err != nil {
+	s.mu.Lock()
+	err := s.newLogEntry(LogNew, meta)
+	s.mu.Unlock()
+	if err != nil {
 		return id, err
 	}
 
@@ -203,40 +329,560 @@ func (s *SegmentStore) New(store MemoryStore) (SegmentID, error) {
 		return id, err
 	}
 
+	s.mu.Lock()
 	s.buffer = append(s.buffer, segment)
+	s.mu.Unlock()
+
 	return id, nil
 }
 
+// Seq returns the highest sequence number stored in any segment.
+func (s *SegmentStore) Seq() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var seq uint64
+	for _, segment := range s.buffer {
+		if segment.Seq() > seq {
+			seq = segment.Seq()
+		}
+	}
+
+	for _, level := range s.levels {
+		for _, segment := range level.segments {
+			if segment.Seq() > seq {
+				seq = segment.Seq()
+			}
+		}
+	}
+
+	return seq
+}
+
+// Snapshots returns the list of snapshots pinned against the store. Versions
+// which are visible to any of them survive compaction.
+func (s *SegmentStore) Snapshots() *SnapshotList {
+	return &s.snapshots
+}
+
+// Put adds the given segment to a level. The level must either already exist
+// or be the next level after the last existing one.
 func (s *SegmentStore) Put(level int, segment Segment) error {
-	// Log put
-	buf := make([]byte, 4)
-	binary.BigEndian.PutUint32(buf, uint32(level))
-	meta := []KVPair{NewKVPair("ID", []byte(segment.ID().String())), NewKVPair("Level", buf)}
-	if err := s.newLogEntry(LogPut, meta); err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(level, segment)
+}
+
+// before returns the ID of the segment in the buffer which comes before the
+// segment with the given ID, or uuid.Nil if it's the first segment.
+func (s *SegmentStore) before(id SegmentID) (SegmentID, error) {
+	for i, segment := range s.buffer {
+		if segment.ID() == id {
+			if i == 0 {
+				return uuid.Nil, nil
+			}
+			return s.buffer[i-1].ID(), nil
+		}
+	}
+
+	return uuid.Nil, ErrorSegmentNotFound
+}
+
+// contains returns true if the segment with the given ID is in the store.
+func (s *SegmentStore) contains(id SegmentID) bool {
+	for _, segment := range s.buffer {
+		if segment.ID() == id {
+			return true
+		}
+	}
+
+	for i := range s.levels {
+		if _, err := s.levels[i].GetSegment(id); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// copyBuffer returns a copy of the buffer. The caller must hold the lock.
+func (s *SegmentStore) copyBuffer() []Segment {
+	return append([]Segment{}, s.buffer...)
+}
+
+// copyLevels returns a copy of every level. The caller must hold the lock.
+func (s *SegmentStore) copyLevels() []SegmentLevel {
+	levels := make([]SegmentLevel, len(s.levels))
+	for i, level := range s.levels {
+		levels[i] = NewSegmentLevel(append([]Segment{}, level.segments...), s.cmp)
+	}
+
+	return levels
+}
+
+// delete removes the segment with the given ID from the store.
+func (s *SegmentStore) delete(id SegmentID) error {
+	if !s.contains(id) {
+		return ErrorSegmentNotFound
+	}
+
+	if err := s.logDelete(id); err != nil {
+		return err
+	}
+
+	return s.remove(id)
+}
+
+// insert adds the given segments to the buffer directly after the segment with
+// the given ID, or at the front of the buffer if the ID is uuid.Nil. Nothing is
+// logged.
+func (s *SegmentStore) insert(after SegmentID, segments []Segment) error {
+	index := 0
+	if after != uuid.Nil {
+		index = -1
+		for i, segment := range s.buffer {
+			if segment.ID() == after {
+				index = i + 1
+				break
+			}
+		}
+
+		if index < 0 {
+			return ErrorSegmentNotFound
+		}
+	}
+
+	buffer := append([]Segment{}, s.buffer[:index]...)
+	buffer = append(buffer, segments...)
+	s.buffer = append(buffer, s.buffer[index:]...)
+
+	return nil
+}
+
+// logDelete records the deletion of the given segment in the log.
+func (s *SegmentStore) logDelete(id SegmentID) error {
+	meta := []KVPair{NewKVPair("ID", []byte(id.String()))}
+	return s.newLogEntry(LogDelete, meta)
+}
+
+func (s *SegmentStore) newLogEntry(action LogAction, meta []KVPair) error {
+	entry := NewLogEntry(action, meta)
+	index, err := s.log.Last()
+	if err != nil {
 		return err
 	}
 
+	return s.log.Write(index+1, entry)
+}
+
+// put adds the given segment to a level.
+func (s *SegmentStore) put(level int, segment Segment) error {
 	// Check if level is valid
-	if level > len(s.levels) {
+	if level < 0 || level > len(s.levels) {
 		return ErrorInvalidSegmentLevel
 	}
 
+	// Log put
+	meta := []KVPair{NewKVPair("ID", []byte(segment.ID().String())), NewKVPair("Level", levelMeta(level))}
+	if err := s.newLogEntry(LogPut, meta); err != nil {
+		return err
+	}
+
+	s.putLevel(level, segment)
+	return nil
+}
+
+// putLevel adds the given segment to a level, which must be at most one past
+// the last level, without logging it.
+func (s *SegmentStore) putLevel(level int, segment Segment) {
 	// Check if a new level needs to be added
 	if level > len(s.levels)-1 {
-		s.levels = append(s.levels, NewSegmentLevel([]Segment{}))
+		s.levels = append(s.levels, NewSegmentLevel([]Segment{}, s.cmp))
 	}
 
 	// Add segment to level
 	s.levels[level].Put(segment)
+}
+
+// remove deletes the segment with the given ID from the backend, removes it
+// from the buffer or its level and closes it. Nothing is logged.
+func (s *SegmentStore) remove(id SegmentID) error {
+	// Search for segment in buffer
+	for i, segment := range s.buffer {
+		if segment.ID() == id {
+			// Delete segment from backend
+			if err := s.backend.Delete(id); err != nil {
+				return err
+			}
+
+			// Delete segment from buffer
+			s.buffer = append(s.buffer[:i], s.buffer[i+1:]...)
+			return segment.Close()
+		}
+	}
+
+	// Search for segment in levels
+	for i := range s.levels {
+		if segment, err := s.levels[i].GetSegment(id); err == nil {
+			// Delete segment from backend
+			if err := s.backend.Delete(id); err != nil {
+				return err
+			}
+
+			// Delete segment from level
+			if err := s.levels[i].DeleteSegment(id); err != nil {
+				return err
+			}
+
+			return (*segment).Close()
+		}
+	}
+
+	return ErrorSegmentNotFound
+}
+
+// replace swaps the given inputs for the given outputs while holding the
+// lock, so readers either see all of the inputs or all of the outputs. The
+// whole swap is recorded as a single LogReplace entry, so a crash part way
+// through is either replayed in full or not at all and never leaves an older
+// version of a key visible where a newer one should be.
+//
+// If the level is BufferLevel the outputs are inserted into the buffer where
+// the inputs are, which must be adjacent, so that they keep their position
+// relative to newer and older segments. The inputs are ordered from newest to
+// oldest.
+func (s *SegmentStore) replace(level int, outputs []Segment, inputs []Segment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Everything is checked up front so that nothing fails once it's logged
+	var after SegmentID
+	var meta []KVPair
+	if level == BufferLevel {
+		if len(outputs) > 0 {
+			var err error
+			after, err = s.before(inputs[len(inputs)-1].ID())
+			if err != nil {
+				return err
+			}
+		}
+		meta = append(meta, NewKVPair("After", []byte(after.String())))
+	} else {
+		if level < 0 || level > len(s.levels) {
+			return ErrorInvalidSegmentLevel
+		}
+		meta = append(meta, NewKVPair("Level", levelMeta(level)))
+	}
+
+	for _, segment := range outputs {
+		meta = append(meta, NewKVPair("Output", []byte(segment.ID().String())))
+	}
+	for _, segment := range inputs {
+		if !s.contains(segment.ID()) {
+			return ErrorSegmentNotFound
+		}
+		meta = append(meta, NewKVPair("Input", []byte(segment.ID().String())))
+	}
+
+	if err := s.newLogEntry(LogReplace, meta); err != nil {
+		return err
+	}
+
+	if level == BufferLevel {
+		if err := s.insert(after, outputs); err != nil {
+			return err
+		}
+	} else {
+		for _, segment := range outputs {
+			s.putLevel(level, segment)
+		}
+	}
+
+	for i := len(inputs) - 1; i >= 0; i-- {
+		if err := s.remove(inputs[i].ID()); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (s *SegmentStore) newLogEntry(action LogAction, meta []KVPair) error {
-	entry := NewLogEntry(action, meta)
-	index, err := s.log.Last()
+// replay rebuilds the buffer and levels of the store from its log. The log is
+// first reduced to the set of segments which are still live and where they
+// belong, and then each of them is loaded from the backend. Segments whose
+// creation was logged but never completed are skipped.
+func (s *SegmentStore) replay() error {
+	first, err := s.log.First()
 	if err != nil {
 		return err
 	}
 
-	return s.log.Write(index+1, entry)
+	last, err := s.log.Last()
+	if err != nil {
+		return err
+	}
+
+	var buffer []SegmentID
+	var levels [][]SegmentID
+	for i := first; i <= last && first > 0; i++ {
+		entry, err := s.log.Read(i)
+		if err != nil {
+			return err
+		}
+
+		// A replace holds the IDs of several segments rather than one
+		if entry.Action == LogReplace {
+			buffer, levels, err = replayReplace(entry, buffer, levels)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		id, err := logSegmentID(entry)
+		if err != nil {
+			return err
+		}
+
+		switch entry.Action {
+		case LogNew:
+			buffer = append(buffer, id)
+		case LogPut:
+			value, err := logMeta(entry, "Level")
+			if err != nil {
+				return err
+			}
+
+			levels, err = appendLevelID(levels, value, id)
+			if err != nil {
+				return err
+			}
+		case LogInsert:
+			value, err := logMeta(entry, "After")
+			if err != nil {
+				return err
+			}
+
+			after, err := uuid.Parse(string(value))
+			if err != nil {
+				return ErrorInvalidLogEntry
+			}
+
+			buffer, err = insertSegmentID(buffer, after, id)
+			if err != nil {
+				return err
+			}
+		case LogDelete:
+			buffer = removeSegmentID(buffer, id)
+			for l := range levels {
+				levels[l] = removeSegmentID(levels[l], id)
+			}
+		}
+	}
+
+	// Load the buffer, skipping any segments which were never completed
+	for _, id := range buffer {
+		segment, err := s.backend.Get(id)
+		if err != nil {
+			if errors.Is(err, ErrorSegmentNotFound) {
+				continue
+			}
+			return err
+		}
+
+		s.buffer = append(s.buffer, segment)
+	}
+
+	// Segments are only put into a level once they exist, so all of them
+	// must be found
+	for _, ids := range levels {
+		level := NewSegmentLevel([]Segment{}, s.cmp)
+		for _, id := range ids {
+			segment, err := s.backend.Get(id)
+			if err != nil {
+				return err
+			}
+
+			level.Put(segment)
+		}
+
+		s.levels = append(s.levels, level)
+	}
+
+	return nil
+}
+
+// appendLevelID returns the given levels with the given ID added to the level
+// encoded in the given log metadata, adding the level if it's one past the
+// last level.
+func appendLevelID(levels [][]SegmentID, value []byte, id SegmentID) ([][]SegmentID, error) {
+	if len(value) != 4 {
+		return nil, ErrorInvalidLogEntry
+	}
+
+	level := int(binary.BigEndian.Uint32(value))
+	if level > len(levels) {
+		return nil, ErrorInvalidSegmentLevel
+	} else if level == len(levels) {
+		levels = append(levels, []SegmentID{})
+	}
+	levels[level] = append(levels[level], id)
+
+	return levels, nil
+}
+
+// levelMeta returns the given level encoded as log metadata.
+func levelMeta(level int) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(level))
+	return buf
+}
+
+// logMeta returns the value of the given metadata key in a log entry. Keys are
+// matched regardless of case since older logs hold them lowercased.
+func logMeta(entry LogEntry, key string) ([]byte, error) {
+	for _, pair := range entry.Meta {
+		if strings.EqualFold(pair.Key, key) {
+			return pair.Value, nil
+		}
+	}
+
+	return nil, ErrorInvalidLogEntry
+}
+
+// logSegmentIDs returns every segment ID stored under the given metadata key
+// of a log entry, in the order they were logged.
+func logSegmentIDs(entry LogEntry, key string) ([]SegmentID, error) {
+	var ids []SegmentID
+	for _, pair := range entry.Meta {
+		if !strings.EqualFold(pair.Key, key) {
+			continue
+		}
+
+		id, err := uuid.Parse(string(pair.Value))
+		if err != nil {
+			return nil, ErrorInvalidLogEntry
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// logSegmentID returns the segment ID stored in a log entry's metadata.
+func logSegmentID(entry LogEntry) (SegmentID, error) {
+	value, err := logMeta(entry, "ID")
+	if err != nil {
+		return SegmentID{}, err
+	}
+
+	id, err := uuid.Parse(string(value))
+	if err != nil {
+		return SegmentID{}, ErrorInvalidLogEntry
+	}
+
+	return id, nil
+}
+
+// replayReplace applies a LogReplace entry to the given buffer and levels. The
+// outputs are added first, either to the buffer after the logged segment or to
+// the logged level, and then the inputs are removed.
+func replayReplace(entry LogEntry, buffer []SegmentID, levels [][]SegmentID) ([]SegmentID, [][]SegmentID, error) {
+	outputs, err := logSegmentIDs(entry, "Output")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	inputs, err := logSegmentIDs(entry, "Input")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if value, err := logMeta(entry, "Level"); err == nil {
+		for _, id := range outputs {
+			if levels, err = appendLevelID(levels, value, id); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else {
+		value, err := logMeta(entry, "After")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		after, err := uuid.Parse(string(value))
+		if err != nil {
+			return nil, nil, ErrorInvalidLogEntry
+		}
+
+		for _, id := range outputs {
+			if buffer, err = insertSegmentID(buffer, after, id); err != nil {
+				return nil, nil, err
+			}
+			after = id
+		}
+	}
+
+	for _, id := range inputs {
+		buffer = removeSegmentID(buffer, id)
+		for l := range levels {
+			levels[l] = removeSegmentID(levels[l], id)
+		}
+	}
+
+	return buffer, levels, nil
+}
+
+// insertSegmentID returns the given slice with the given ID inserted after the
+// ID after, or at the front if after is uuid.Nil.
+func insertSegmentID(ids []SegmentID, after SegmentID, id SegmentID) ([]SegmentID, error) {
+	index := 0
+	if after != uuid.Nil {
+		index = -1
+		for i := range ids {
+			if ids[i] == after {
+				index = i + 1
+				break
+			}
+		}
+
+		if index < 0 {
+			return nil, ErrorInvalidLogEntry
+		}
+	}
+
+	return append(ids[:index], append([]SegmentID{id}, ids[index:]...)...), nil
+}
+
+// removeSegmentID returns the given slice with the given ID removed.
+func removeSegmentID(ids []SegmentID, id SegmentID) []SegmentID {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i], ids[i+1:]...)
+		}
+	}
+
+	return ids
+}
+
+// OpenSegmentStore returns a SegmentStore which uses the given backend to store
+// segments and the given log to record changes. Any entries already in the
+// log are replayed in order to recover the state of the store. The given
+// strategy is used by a Compactor to decide how segments are compacted; if
+// it's nil the store is never compacted. Keys are ordered by the given
+// Comparator, or bytewise if it's nil.
+func OpenSegmentStore(backend SegmentBackend, log Log, strategy CompactionStrategy, cmp Comparator) (*SegmentStore, error) {
+	store := &SegmentStore{
+		backend:  backend,
+		cmp:      DefaultComparator(cmp),
+		log:      log,
+		strategy: strategy,
+	}
+
+	if err := store.replay(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
 }
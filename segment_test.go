@@ -0,0 +1,263 @@
+package kv_test
+
+import (
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+func NewLevelSegment(backend kv.SegmentBackend, pairs []kv.KVPair) (kv.Segment, error) {
+	id := kv.NewSegmentID()
+	writer, err := backend.NewWriter(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := writer.WriteAll(pairs); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return backend.Get(id)
+}
+
+func SegmentIDs(segments []kv.Segment) []kv.SegmentID {
+	var ids []kv.SegmentID
+	for _, segment := range segments {
+		ids = append(ids, segment.ID())
+	}
+
+	return ids
+}
+
+func TestOpenSegmentStore(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+
+	// Create a few segments and delete one
+	var ids []kv.SegmentID
+	for i := 0; i < 3; i++ {
+		memStore := helper.NewRandomMemoryStore(size)
+		id, err := store.New(&memStore)
+		is.NoErr(err)
+
+		ids = append(ids, id)
+	}
+	is.NoErr(store.Delete(ids[1]))
+
+	// Put a few segments into levels and delete one
+	var levelIDs []kv.SegmentID
+	for i := 0; i < 3; i++ {
+		segment, err := NewLevelSegment(&backend, helper.NewRandomSortedPairs(size))
+		is.NoErr(err)
+		is.NoErr(store.Put(i/2, segment))
+
+		levelIDs = append(levelIDs, segment.ID())
+	}
+	is.NoErr(store.Delete(levelIDs[0]))
+
+	// Log a segment which was never created
+	last, err := log.Last()
+	is.NoErr(err)
+	meta := []kv.KVPair{kv.NewKVPair("ID", []byte(kv.NewSegmentID().String()))}
+	is.NoErr(log.Write(last+1, kv.NewLogEntry(kv.LogNew, meta)))
+
+	// Reopened store has the same layout
+	recovered, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+	is.Equal(SegmentIDs(recovered.Buffer()), []kv.SegmentID{ids[0], ids[2]})
+	is.Equal(len(recovered.Levels()), 2)
+	is.Equal(SegmentIDs(recovered.Levels()[0].Segments()), []kv.SegmentID{levelIDs[1]})
+	is.Equal(SegmentIDs(recovered.Levels()[1].Segments()), []kv.SegmentID{levelIDs[2]})
+}
+
+func TestOpenSegmentStoreLowercaseLog(t *testing.T) {
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	// Logs written while keys were always lowercased are still replayed
+	segment, err := NewLevelSegment(&backend, helper.NewRandomSortedPairs(10))
+	is.NoErr(err)
+	meta := []kv.KVPair{
+		kv.NewKVPair("id", []byte(segment.ID().String())),
+		kv.NewKVPair("level", []byte{0, 0, 0, 0}),
+	}
+	is.NoErr(log.Write(1, kv.NewLogEntry(kv.LogPut, meta)))
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+	is.Equal(len(store.Levels()), 1)
+	is.Equal(SegmentIDs(store.Levels()[0].Segments()), []kv.SegmentID{segment.ID()})
+}
+
+func TestSegmentStoreDelete(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+
+	// Delete from buffer
+	memStore := helper.NewRandomMemoryStore(size)
+	id, err := store.New(&memStore)
+	is.NoErr(err)
+	buffered := store.Buffer()[0].(*mock.MockSegment)
+
+	is.NoErr(store.Delete(id))
+	is.Equal(len(store.Buffer()), 0)
+	is.True(buffered.Closed())
+
+	_, err = backend.Get(id)
+	is.Equal(err, kv.ErrorSegmentNotFound)
+
+	// Delete from level
+	segment, err := NewLevelSegment(&backend, helper.NewRandomSortedPairs(size))
+	is.NoErr(err)
+	is.NoErr(store.Put(0, segment))
+
+	is.NoErr(store.Delete(segment.ID()))
+	is.Equal(len(store.Levels()[0].Segments()), 0)
+	is.True(segment.(*mock.MockSegment).Closed())
+
+	// Nonexistent segment
+	is.Equal(store.Delete(id), kv.ErrorSegmentNotFound)
+}
+
+func TestSegmentStoreGet(t *testing.T) {
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+
+	// Oldest data lives in a level
+	segment, err := NewLevelSegment(&backend, []kv.KVPair{
+		kv.NewKVPair("a", []byte("level")),
+		kv.NewKVPair("b", []byte("level")),
+		kv.NewKVPair("c", []byte("level")),
+	})
+	is.NoErr(err)
+	is.NoErr(store.Put(0, segment))
+
+	// Newer data lives in the buffer
+	older := mock.NewMockMemoryStore([]kv.KVPair{
+		kv.NewKVPair("a", []byte("older")),
+		kv.NewKVPair("b", []byte("older")),
+	})
+	_, err = store.New(&older)
+	is.NoErr(err)
+
+	newer := mock.NewMockMemoryStore([]kv.KVPair{
+		kv.NewKVPair("a", []byte("newer")),
+	})
+	_, err = store.New(&newer)
+	is.NoErr(err)
+
+	// Newest segment holding each key wins
+	for key, value := range map[string]string{"a": "newer", "b": "older", "c": "level"} {
+		pair, err := store.Get(key)
+		is.NoErr(err)
+		is.Equal(pair.Value, []byte(value))
+	}
+
+	// Nonexistent key
+	_, err = store.Get("d")
+	is.Equal(err, kv.ErrorNoSuchKey)
+
+	// Tombstones hide older versions of a key
+	deleted := mock.NewMockMemoryStore([]kv.KVPair{kv.DeleteKVPair("b"), kv.DeleteKVPair("c")})
+	_, err = store.New(&deleted)
+	is.NoErr(err)
+
+	for _, key := range []string{"b", "c"} {
+		_, err = store.Get(key)
+		is.Equal(err, kv.ErrorNoSuchKey)
+
+		pair, err := store.Lookup(key)
+		is.NoErr(err)
+		is.True(pair.Tombstone)
+	}
+}
+
+func TestSegmentStoreIterator(t *testing.T) {
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+
+	// Two non-overlapping segments in a level
+	for _, pairs := range [][]kv.KVPair{
+		{kv.NewKVPair("a", []byte("level")), kv.NewKVPair("b", []byte("level"))},
+		{kv.NewKVPair("c", []byte("level")), kv.NewKVPair("d", []byte("level"))},
+	} {
+		segment, err := NewLevelSegment(&backend, pairs)
+		is.NoErr(err)
+		is.NoErr(store.Put(0, segment))
+	}
+
+	// Newer versions and tombstones in the buffer
+	older := mock.NewMockMemoryStore([]kv.KVPair{
+		kv.NewKVPair("b", []byte("older")),
+		kv.NewKVPair("e", []byte("older")),
+	})
+	_, err = store.New(&older)
+	is.NoErr(err)
+
+	newer := mock.NewMockMemoryStore([]kv.KVPair{
+		kv.DeleteKVPair("c"),
+		kv.NewKVPair("e", []byte("newer")),
+	})
+	_, err = store.New(&newer)
+	is.NoErr(err)
+
+	result, err := helper.ReadIterator(store.Iterator(kv.LatestSeq), "")
+	is.NoErr(err)
+	is.Equal(result, []kv.KVPair{
+		kv.NewKVPair("a", []byte("level")),
+		kv.NewKVPair("b", []byte("older")),
+		kv.NewKVPair("d", []byte("level")),
+		kv.NewKVPair("e", []byte("newer")),
+	})
+}
+
+func TestSegmentStoreNew(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+
+	store, err := kv.OpenSegmentStore(&backend, &log, nil, nil)
+	is.NoErr(err)
+
+	// Add new MemoryStore
+	memStore := helper.NewRandomMemoryStore(size)
+	id, err := store.New(&memStore)
+	is.NoErr(err)
+
+	// Segment was added
+	is.Equal(SegmentIDs(store.Buffer()), []kv.SegmentID{id})
+
+	// Segment contains correct data
+	segment := store.Buffer()[0]
+	for _, pair := range memStore.Pairs() {
+		_, err := segment.Get(pair.Key)
+		is.NoErr(err)
+	}
+}
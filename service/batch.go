@@ -0,0 +1,37 @@
+package service
+
+import (
+	"github.com/jmgilman/kv"
+)
+
+// WriteBatch collects puts and deletes which are applied together by
+// KVService.Write. Operations are applied in the order they were added, so a
+// later operation on a key overrides an earlier one.
+type WriteBatch struct {
+	pairs []kv.KVPair
+}
+
+// Delete adds the deletion of the given key to the batch.
+func (w *WriteBatch) Delete(key string) {
+	w.pairs = append(w.pairs, kv.DeleteKVPair(key))
+}
+
+// Len returns the number of operations in the batch.
+func (w *WriteBatch) Len() int {
+	return len(w.pairs)
+}
+
+// Put adds the given key/value to the batch.
+func (w *WriteBatch) Put(key string, value []byte) {
+	w.pairs = append(w.pairs, kv.NewKVPair(key, value))
+}
+
+// Reset removes every operation from the batch so that it can be reused.
+func (w *WriteBatch) Reset() {
+	w.pairs = w.pairs[:0]
+}
+
+// NewWriteBatch returns an empty WriteBatch.
+func NewWriteBatch() WriteBatch {
+	return WriteBatch{}
+}
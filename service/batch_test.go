@@ -0,0 +1,94 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/matryer/is"
+)
+
+func TestWriteBatch(t *testing.T) {
+	is := is.New(t)
+
+	batch := NewWriteBatch()
+	batch.Put("A", []byte("a"))
+	batch.Delete("B")
+	is.Equal(batch.Len(), 2)
+
+	// Keys are only normalized once the batch is written
+	is.Equal(batch.pairs[0], kv.NewKVPair("A", []byte("a")))
+	is.Equal(batch.pairs[1], kv.DeleteKVPair("B"))
+
+	batch.Reset()
+	is.Equal(batch.Len(), 0)
+}
+
+func TestKVServiceWrite(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	wal := mock.NewMockLog()
+	service, _ := NewMockKVServiceWithLog(size*2, &wal)
+
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	snapshot := service.Snapshot()
+	defer snapshot.Release()
+
+	// Later operations on a key override earlier ones
+	batch := NewWriteBatch()
+	batch.Put(pairs[0].Key, []byte("first"))
+	batch.Put(pairs[0].Key, []byte("second"))
+	batch.Delete(pairs[1].Key)
+	batch.Put("new", []byte("new"))
+	is.NoErr(service.Write(&batch))
+
+	pair, err := service.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("second"))
+
+	_, err = service.Get(pairs[1].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	pair, err = service.Get("new")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("new"))
+
+	// The batch was logged as a single entry
+	last, err := wal.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size+1))
+
+	entry, err := wal.Read(last)
+	is.NoErr(err)
+	is.Equal(entry.Action, kv.LogKeyBatch)
+	is.Equal(len(entry.Meta), batch.Len())
+
+	// None of the batch is visible to an earlier snapshot
+	result, err := snapshot.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs)
+
+	// Empty batches aren't logged
+	empty := NewWriteBatch()
+	is.NoErr(service.Write(&empty))
+	last, err = wal.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size+1))
+
+	// A new service recovers the whole batch from the log
+	service, _ = NewMockKVServiceWithLog(size*2, &wal)
+	pair, err = service.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("second"))
+
+	_, err = service.Get(pairs[1].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	pair, err = service.Get("new")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("new"))
+}
@@ -2,47 +2,707 @@ package service
 
 import (
 	"errors"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/jmgilman/kv"
 )
 
+var ErrorInvalidTTL = errors.New("ttl must be positive")
+var ErrorPrefixOrder = errors.New("prefix scans need keys ordered bytewise")
+var ErrorServiceClosed = errors.New("service is closed")
+
+// KVService provides a persistent key/value store by layering MemoryStore's
+// on top of an NVStore. Writes are made to the active MemoryStore until it
+// grows past the configured threshold, at which point it's sealed and replaced
+// with a fresh MemoryStore. Sealed MemoryStore's are immutable and stay
+// readable while they're flushed into the NVStore in the background.
+//
+// Every write is appended to a write-ahead log before it's applied to the
+// MemoryStore so that unflushed writes can be recovered after a crash. Each
+// write is also given the next sequence number, which allows reads to be
+// pinned to a point in time with Snapshot.
+//
+// A KVService is safe for concurrent use. Reads search the active MemoryStore,
+// then the sealed ones from newest to oldest and finally the NVStore, which is
+// read without holding up writers.
+//
+// Keys are passed through a KeyNormalizer before they're written or searched
+// for and are ordered by a Comparator, which must match the order used by the
+// MemoryStore's and the NVStore.
 type KVService struct {
-	memStore kv.MemoryStore
-	nvStore  kv.NVStore
+	closed       bool
+	cmp          kv.Comparator
+	err          error
+	flushes      uint64
+	flushMu      sync.Mutex
+	immutable    []sealedStore
+	memStore     kv.MemoryStore
+	mu           sync.RWMutex
+	normalizer   kv.KeyNormalizer
+	nvStore      kv.NVStore
+	seq          uint64
+	storeFactory kv.MemoryStoreFactory
+	threshold    int
+	wal          kv.Log
+	wg           sync.WaitGroup
+}
+
+// sealedStore is a MemoryStore which no longer takes writes and is waiting to
+// be flushed, along with the index of the last write-ahead log entry it holds.
+type sealedStore struct {
+	last  uint64
+	store kv.MemoryStore
+}
+
+// Begin starts a new Txn which reads from a Snapshot of the store as it is now.
+func (k *KVService) Begin() *Txn {
+	return &Txn{
+		batch:    NewWriteBatch(),
+		reads:    map[string]struct{}{},
+		service:  k,
+		snapshot: k.Snapshot(),
+		writes:   map[string]kv.KVPair{},
+	}
+}
+
+// Close stops the KVService from taking further writes, waits for every
+// background flush to finish and then closes the write-ahead log. Returns the
+// error which stopped the flushes, if any. Unflushed writes are kept in the
+// write-ahead log. Reads keep working after the KVService is closed.
+func (k *KVService) Close() error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return ErrorServiceClosed
+	}
+	k.closed = true
+	k.mu.Unlock()
+
+	k.wg.Wait()
+
+	err := k.Err()
+	if closeErr := k.wal.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Comparator returns the Comparator which orders keys.
+func (k *KVService) Comparator() kv.Comparator {
+	return k.cmp
 }
 
+// Delete marks the given key as deleted.
 func (k *KVService) Delete(key string) error {
-	return k.memStore.Delete(key)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.write(kv.LogKeyDelete, kv.DeleteKVPair(k.Normalize(key))); err != nil {
+		return err
+	}
+
+	return k.checkFlush()
+}
+
+// Err returns the error hit by a background flush, if any. The KVService
+// refuses further writes once a flush has failed.
+func (k *KVService) Err() error {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.err
+}
+
+// Flush seals the active MemoryStore and waits until it, along with any other
+// sealed MemoryStore, has been written to the NVStore. The write-ahead log is
+// truncated as each MemoryStore is persisted. Calling Flush on an empty
+// MemoryStore only waits for earlier flushes.
+func (k *KVService) Flush() error {
+	k.mu.Lock()
+	err := ErrorServiceClosed
+	if !k.closed {
+		err = k.seal()
+	}
+	k.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return k.flushImmutable()
 }
 
+// Get searches the MemoryStore's for the given key and falls back to the
+// NVStore if it wasn't found. Returns kv.ErrorNoSuchKey if none contains the
+// key or it has been deleted or has expired.
 func (k *KVService) Get(key string) (*kv.KVPair, error) {
-	// Search memory store first
-	pair, err := k.memStore.Get(key)
+	return k.get(k.Normalize(key), kv.LatestSeq)
+}
+
+// Iterator returns a kv.Iterator which merges the MemoryStore's with the
+// NVStore, returning the newest version of every live key in key order.
+func (k *KVService) Iterator() kv.Iterator {
+	return k.iterator(kv.LatestSeq)
+}
+
+// Normalize returns the form the given key is stored in.
+func (k *KVService) Normalize(key string) string {
+	return k.normalizer(key)
+}
+
+// PrefixEnd returns the exclusive end of a scan over every key which starts
+// with the given prefix, which must already be normalized. Keys sharing a
+// prefix are only ordered together if they're ordered bytewise, so
+// ErrorPrefixOrder is returned for any other Comparator.
+func (k *KVService) PrefixEnd(prefix string) (string, error) {
+	if _, ok := k.cmp.(kv.BytewiseComparator); !ok {
+		return "", ErrorPrefixOrder
+	}
+
+	return kv.PrefixEnd(prefix), nil
+}
+
+// Put adds the given key/value to the store.
+func (k *KVService) Put(key string, value []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.write(kv.LogKeyPut, kv.NewKVPair(k.Normalize(key), value)); err != nil {
+		return err
+	}
+
+	return k.checkFlush()
+}
+
+// PutWithTTL adds the given key/value to the store, which expires once the
+// given TTL has passed. Reads treat an expired key as deleted and compaction
+// eventually removes it. Returns ErrorInvalidTTL if the TTL isn't positive.
+func (k *KVService) PutWithTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrorInvalidTTL
+	}
+
+	// Expiry times past the range of a Unix time in nanoseconds are capped
+	// rather than wrapping around into the past
+	pair := kv.NewKVPair(k.Normalize(key), value)
+	now := time.Now().UnixNano()
+	pair.Expires = now + int64(ttl)
+	if pair.Expires < now {
+		pair.Expires = math.MaxInt64
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if err := k.write(kv.LogKeyPut, pair); err != nil {
+		return err
+	}
+
+	return k.checkFlush()
+}
+
+// Scan returns the newest version of every live key which isn't lower than
+// start and is lower than end, in key order. An empty end scans to the last
+// key. At most limit pairs are returned unless limit is zero.
+func (k *KVService) Scan(start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.scan(k.Iterator(), k.Normalize(start), k.Normalize(end), limit)
+}
+
+// ScanNormalized works like Scan but uses the given bounds as they are. They
+// must already be normalized, such as a key returned by an earlier scan or the
+// result of kv.PrefixEnd for a normalized prefix, which normalizing again may
+// change.
+func (k *KVService) ScanNormalized(start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.scan(k.Iterator(), start, end, limit)
+}
+
+// ScanReverse returns the same pairs as Scan in descending key order, starting
+// from the highest key lower than end. An empty end scans from the last key.
+func (k *KVService) ScanReverse(start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.scanReverse(k.Iterator(), k.Normalize(start), k.Normalize(end), limit)
+}
+
+// ScanReverseNormalized works like ScanReverse but uses the given bounds as
+// they are, see ScanNormalized.
+func (k *KVService) ScanReverseNormalized(start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.scanReverse(k.Iterator(), start, end, limit)
+}
+
+// RangeNormalized calls fn with the same pairs, in the same order, as
+// ScanNormalized or, if reverse is true, ScanReverseNormalized, stopping early
+// if fn returns false. Pairs are read as they're visited rather than collected
+// up front.
+func (k *KVService) RangeNormalized(start string, end string, reverse bool, fn func(pair kv.KVPair) bool) error {
+	return k.walk(k.Iterator(), start, end, reverse, fn)
+}
+
+// ScanPrefix returns the newest version of every live key which starts with
+// the given prefix, in key order. At most limit pairs are returned unless
+// limit is zero. Returns ErrorPrefixOrder unless keys are ordered bytewise.
+func (k *KVService) ScanPrefix(prefix string, limit int) ([]kv.KVPair, error) {
+	prefix = k.Normalize(prefix)
+	end, err := k.PrefixEnd(prefix)
 	if err != nil {
+		return nil, err
+	}
+
+	return k.scan(k.Iterator(), prefix, end, limit)
+}
+
+// Snapshot returns a Snapshot pinned to the most recent write. Versions which
+// are visible to it are kept until it's released.
+func (k *KVService) Snapshot() *Snapshot {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	k.nvStore.Snapshots().Acquire(k.seq)
+	return &Snapshot{
+		seq:     k.seq,
+		service: k,
+	}
+}
+
+// Write applies every operation in the given batch, in order, as a single
+// write. The batch is recorded as one entry in the write-ahead log so it's
+// either recovered in full or not at all. Writing an empty batch is a no-op.
+func (k *KVService) Write(batch *WriteBatch) error {
+	pairs := make([]kv.KVPair, len(batch.pairs))
+	for i, pair := range batch.pairs {
+		pair.Key = k.Normalize(pair.Key)
+		pairs[i] = pair
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.writeBatch(pairs)
+}
+
+// checkFlush seals the active MemoryStore if it has grown past the threshold
+// and starts flushing it in the background. The caller must hold the lock.
+func (k *KVService) checkFlush() error {
+	if k.memStore.Size() < k.threshold {
+		return nil
+	}
+
+	if err := k.seal(); err != nil {
+		return err
+	}
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+		if err := k.flushImmutable(); err != nil {
+			k.mu.Lock()
+			if k.err == nil {
+				k.err = err
+			}
+			k.mu.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+// flushImmutable writes every sealed MemoryStore to the NVStore, oldest first,
+// removing each one and truncating the write-ahead log once it's persisted.
+// The lock is only held while a MemoryStore is removed, so reads and writes
+// carry on while the NVStore is written.
+func (k *KVService) flushImmutable() error {
+	k.flushMu.Lock()
+	defer k.flushMu.Unlock()
+
+	for {
+		k.mu.RLock()
+		if len(k.immutable) == 0 {
+			k.mu.RUnlock()
+			return nil
+		}
+		sealed := k.immutable[0]
+		k.mu.RUnlock()
+
+		if _, err := k.nvStore.New(sealed.store); err != nil {
+			return err
+		}
+
+		k.mu.Lock()
+		k.immutable = k.immutable[1:]
+		k.flushes++
+		err := k.wal.TruncateFront(sealed.last + 1)
+		k.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// get returns the newest version of the given key visible at the given
+// sequence number. Only the active MemoryStore is searched under the lock,
+// since sealed MemoryStore's are never modified and the NVStore has its own.
+func (k *KVService) get(key string, seq uint64) (*kv.KVPair, error) {
+	k.mu.RLock()
+	pair, err := version(k.memStore, key, seq)
+	sealed := make([]kv.MemoryStore, 0, len(k.immutable))
+	for i := len(k.immutable) - 1; i >= 0; i-- {
+		sealed = append(sealed, k.immutable[i].store)
+	}
+	k.mu.RUnlock()
+
+	for _, store := range sealed {
 		if !errors.Is(err, kv.ErrorNoSuchKey) {
-			return nil, err
+			break
+		}
+		pair, err = version(store, key, seq)
+	}
+
+	// A tombstone means the key was deleted
+	if err == nil {
+		if pair.Tombstone || pair.Expired(time.Now()) {
+			return nil, kv.ErrorNoSuchKey
 		}
-	} else {
 		return pair, nil
+	} else if !errors.Is(err, kv.ErrorNoSuchKey) {
+		return nil, err
 	}
 
-	return nil, kv.ErrorNoSuchKey
 	// Next try the non-volatile store
-	// pair, err = k.nvStore.Get(key)
-	// if err != nil {
-	// 	return nil, err
-	// }
+	if seq == kv.LatestSeq {
+		return k.nvStore.Get(key)
+	}
+
+	iterator := k.nvStore.Iterator(seq)
+	defer iterator.Close()
+
+	if err := iterator.Seek(key); err != nil {
+		return nil, err
+	}
 
-	// return pair, nil
+	if !iterator.Valid() || iterator.Key() != key {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	result := iterator.Pair()
+	return &result, nil
 }
 
-func (k *KVService) Put(key string, value []byte) error {
-	return k.memStore.Put(kv.NewKVPair(key, value))
+// replay applies all entries in the write-ahead log to the MemoryStore. The
+// MemoryStore is flushed before returning if the entries fill it.
+func (k *KVService) replay() error {
+	first, err := k.wal.First()
+	if err != nil {
+		return err
+	}
+
+	last, err := k.wal.Last()
+	if err != nil {
+		return err
+	}
+
+	// An empty log has nothing to replay
+	if first == 0 {
+		return nil
+	}
+
+	for i := first; i <= last; i++ {
+		entry, err := k.wal.Read(i)
+		if err != nil {
+			return err
+		}
+
+		// Deletes are logged as tombstones so every action is applied alike
+		for _, pair := range entry.Meta {
+			if err := k.memStore.Put(pair); err != nil {
+				return err
+			}
+
+			if pair.Seq > k.seq {
+				k.seq = pair.Seq
+			}
+		}
+	}
+
+	if k.memStore.Size() < k.threshold {
+		return nil
+	}
+
+	return k.Flush()
 }
 
-func NewKVService(memStore kv.MemoryStore, nvStore kv.NVStore) KVService {
-	return KVService{
-		memStore: memStore,
-		nvStore:  nvStore,
+// memSeq returns the sequence number of the newest version of the given key
+// held by the MemoryStore's, including tombstones, and whether any of them
+// holds the key. The caller must hold the lock.
+func (k *KVService) memSeq(key string) (uint64, bool, error) {
+	pair, err := k.memStore.Lookup(key)
+	for i := len(k.immutable) - 1; i >= 0 && errors.Is(err, kv.ErrorNoSuchKey); i-- {
+		pair, err = k.immutable[i].store.Lookup(key)
 	}
+
+	if err != nil {
+		if errors.Is(err, kv.ErrorNoSuchKey) {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+
+	return pair.Seq, true, nil
+}
+
+// storedSeq returns the sequence number of the newest version of the given key
+// held by the NVStore, including tombstones, or zero if it doesn't hold the
+// key. The lock doesn't need to be held.
+func (k *KVService) storedSeq(key string) (uint64, error) {
+	pair, err := k.nvStore.Lookup(key)
+	if err != nil {
+		if errors.Is(err, kv.ErrorNoSuchKey) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	return pair.Seq, nil
+}
+
+// iterator returns a kv.Iterator which merges the MemoryStore's with the
+// NVStore, returning the newest version of every live key visible at the given
+// sequence number. Writes carry on while the iterator is in use, so the
+// sequence number is capped at the newest write made before it was created.
+func (k *KVService) iterator(seq uint64) kv.Iterator {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if seq > k.seq {
+		seq = k.seq
+	}
+
+	iterators := []kv.Iterator{k.memStore.Iterator()}
+	for i := len(k.immutable) - 1; i >= 0; i-- {
+		iterators = append(iterators, k.immutable[i].store.Iterator())
+	}
+
+	// Sealed stores are only removed once they're in the NVStore, so nothing
+	// is missed if one is flushed after this point
+	iterators = append(iterators, k.nvStore.Iterator(seq))
+
+	return kv.NewMergeIterator(iterators, seq, k.cmp)
+}
+
+// scan reads pairs from the given iterator for KVService.Scan and closes it.
+// The bounds must already be normalized.
+func (k *KVService) scan(iterator kv.Iterator, start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.collect(iterator, start, end, false, limit)
+}
+
+// scanReverse reads pairs from the given iterator for KVService.ScanReverse
+// and closes it. The bounds must already be normalized.
+func (k *KVService) scanReverse(iterator kv.Iterator, start string, end string, limit int) ([]kv.KVPair, error) {
+	return k.collect(iterator, start, end, true, limit)
+}
+
+// collect returns at most limit pairs visited by walk, or every pair if limit
+// isn't positive.
+func (k *KVService) collect(iterator kv.Iterator, start string, end string, reverse bool, limit int) ([]kv.KVPair, error) {
+	pairs := []kv.KVPair{}
+	err := k.walk(iterator, start, end, reverse, func(pair kv.KVPair) bool {
+		pairs = append(pairs, pair)
+		return limit <= 0 || len(pairs) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pairs, nil
+}
+
+// walk calls fn with each pair of the given iterator between the given bounds,
+// in descending key order if reverse is true, until fn returns false. The
+// iterator is closed once it's done. The bounds must already be normalized.
+func (k *KVService) walk(iterator kv.Iterator, start string, end string, reverse bool, fn func(pair kv.KVPair) bool) error {
+	defer iterator.Close()
+
+	if !reverse {
+		if err := iterator.Seek(start); err != nil {
+			return err
+		}
+
+		for iterator.Valid() && (end == "" || k.cmp.Compare(iterator.Key(), end) < 0) {
+			if !fn(iterator.Pair()) {
+				return nil
+			}
+
+			if err := iterator.Next(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Move to the highest key lower than end
+	if end == "" {
+		if err := iterator.SeekToLast(); err != nil {
+			return err
+		}
+	} else {
+		if err := iterator.Seek(end); err != nil {
+			return err
+		}
+
+		var err error
+		if iterator.Valid() {
+			err = iterator.Prev()
+		} else {
+			err = iterator.SeekToLast()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for iterator.Valid() && (start == "" || k.cmp.Compare(iterator.Key(), start) >= 0) {
+		if !fn(iterator.Pair()) {
+			return nil
+		}
+
+		if err := iterator.Prev(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// seal moves the active MemoryStore to the list of sealed MemoryStore's and
+// replaces it with a new one. Sealing an empty MemoryStore is a no-op. The
+// caller must hold the lock.
+func (k *KVService) seal() error {
+	if k.memStore.Size() == 0 {
+		return nil
+	}
+
+	// Every log entry up to this point is covered by the active MemoryStore
+	last, err := k.wal.Last()
+	if err != nil {
+		return err
+	}
+
+	k.immutable = append(k.immutable, sealedStore{last: last, store: k.memStore})
+	k.memStore = k.storeFactory()
+
+	return nil
+}
+
+// write gives each pair the next sequence number, appends them to the
+// write-ahead log as a single entry and then applies them to the MemoryStore.
+// Keys must already be normalized. The caller must hold the lock.
+func (k *KVService) write(action kv.LogAction, pairs ...kv.KVPair) error {
+	if k.closed {
+		return ErrorServiceClosed
+	}
+	if k.err != nil {
+		return k.err
+	}
+
+	sequenced := make([]kv.KVPair, len(pairs))
+	for i, pair := range pairs {
+		pair.Seq = k.seq + uint64(i) + 1
+		sequenced[i] = pair
+	}
+
+	if err := k.writeLog(action, sequenced); err != nil {
+		return err
+	}
+
+	k.seq += uint64(len(sequenced))
+	for _, pair := range sequenced {
+		if err := k.memStore.Put(pair); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeBatch applies the pairs of a batch, whose keys must already be
+// normalized, as a single write. The caller must hold the lock.
+func (k *KVService) writeBatch(pairs []kv.KVPair) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	if err := k.write(kv.LogKeyBatch, pairs...); err != nil {
+		return err
+	}
+
+	return k.checkFlush()
+}
+
+// writeLog appends a new entry for the given pairs to the write-ahead log.
+func (k *KVService) writeLog(action kv.LogAction, pairs []kv.KVPair) error {
+	index, err := k.wal.Last()
+	if err != nil {
+		return err
+	}
+
+	return k.wal.Write(index+1, kv.NewLogEntry(action, pairs))
+}
+
+// NewKVService returns a new KVService which uses the given factory to create
+// MemoryStore's and flushes them into the given NVStore once they hold
+// threshold number of pairs. Any entries found in the given write-ahead log
+// are replayed into the initial MemoryStore, and sequence numbers carry on
+// from the highest one found in either. Keys are normalized by the given
+// KeyNormalizer and ordered by the given Comparator, which default to
+// kv.IdentityNormalizer and bytewise respectively if they're nil. The
+// write-ahead log is closed along with the KVService.
+func NewKVService(storeFactory kv.MemoryStoreFactory, nvStore kv.NVStore, wal kv.Log, threshold int, normalizer kv.KeyNormalizer, cmp kv.Comparator) (*KVService, error) {
+	if normalizer == nil {
+		normalizer = kv.IdentityNormalizer
+	}
+
+	service := &KVService{
+		cmp:          kv.DefaultComparator(cmp),
+		memStore:     storeFactory(),
+		normalizer:   normalizer,
+		nvStore:      nvStore,
+		seq:          nvStore.Seq(),
+		storeFactory: storeFactory,
+		threshold:    threshold,
+		wal:          wal,
+	}
+
+	if err := service.replay(); err != nil {
+		return nil, err
+	}
+
+	return service, nil
+}
+
+// version returns the newest version of the given key in the given
+// MemoryStore which is visible at the given sequence number, including
+// tombstones.
+func version(store kv.MemoryStore, key string, seq uint64) (*kv.KVPair, error) {
+	if seq == kv.LatestSeq {
+		return store.Lookup(key)
+	}
+
+	iterator := store.Iterator()
+	defer iterator.Close()
+
+	if err := iterator.Seek(key); err != nil {
+		return nil, err
+	}
+
+	for iterator.Valid() && iterator.Key() == key {
+		if pair := iterator.Pair(); pair.Seq <= seq {
+			return &pair, nil
+		}
+
+		if err := iterator.Next(); err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, kv.ErrorNoSuchKey
 }
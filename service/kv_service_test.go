@@ -0,0 +1,922 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/btree"
+	"github.com/jmgilman/kv/encoders"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/jmgilman/kv/sstable"
+	"github.com/jmgilman/kv/wal"
+	"github.com/matryer/is"
+	"github.com/spf13/afero"
+)
+
+func NewMockKVService(threshold int) (*KVService, *[]kv.MemoryStore) {
+	wal := mock.NewMockLog()
+	return NewMockKVServiceWithLog(threshold, &wal)
+}
+
+// NewMockKVServiceWithLog returns a KVService backed by a mock NVStore which
+// records every flushed MemoryStore. Keys are lowercased.
+func NewMockKVServiceWithLog(threshold int, wal kv.Log) (*KVService, *[]kv.MemoryStore) {
+	factory := func() kv.MemoryStore {
+		return &btree.Tree{}
+	}
+
+	var flushed []kv.MemoryStore
+	nvStore := mock.NewMockNVStore()
+	putFn := nvStore.PutFn
+	nvStore.PutFn = func(store kv.MemoryStore) (kv.SegmentID, error) {
+		flushed = append(flushed, store)
+		return putFn(store)
+	}
+
+	service, err := NewKVService(factory, &nvStore, wal, threshold, kv.LowercaseNormalizer, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	return service, &flushed
+}
+
+// StripSeqs returns a copy of the given pairs without their sequence numbers,
+// which makes them comparable with pairs created by kv.NewKVPair.
+func StripSeqs(pairs []kv.KVPair) []kv.KVPair {
+	result := make([]kv.KVPair, len(pairs))
+	for i, pair := range pairs {
+		pair.Seq = 0
+		result[i] = pair
+	}
+
+	return result
+}
+
+// OpenTestKVService opens a KVService backed by SSTable segments and on-disk
+// logs stored in the given directory. Keys are lowercased.
+func OpenTestKVService(root string, threshold int) (*KVService, func(), error) {
+	return OpenTestKVServiceWithKeys(root, threshold, kv.LowercaseNormalizer, nil)
+}
+
+// OpenTestKVServiceWithKeys works like OpenTestKVService but normalizes and
+// orders keys with the given KeyNormalizer and Comparator.
+func OpenTestKVServiceWithKeys(root string, threshold int, normalizer kv.KeyNormalizer, cmp kv.Comparator) (*KVService, func(), error) {
+	factory := func() kv.MemoryStore {
+		return btree.NewTree(cmp)
+	}
+	encoder := encoders.NewByteEncoder()
+	fs := afero.NewOsFs()
+
+	backend, err := sstable.OpenSegmentBackend(path.Join(root, "segments"), encoder, sstable.NoneCompressor{}, 64, 10, factory, cmp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest, err := wal.Open(fs, path.Join(root, "manifest"), encoder, 1024)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nvStore, err := kv.OpenSegmentStore(&backend, manifest, nil, cmp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	writeLog, err := wal.Open(fs, path.Join(root, "wal"), encoder, 1024)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	service, err := NewKVService(factory, nvStore, writeLog, threshold, normalizer, cmp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeFn := func() {
+		service.Close()
+		manifest.Close()
+	}
+
+	return service, closeFn, nil
+}
+
+func NewSequentialPairs(size int) []kv.KVPair {
+	var pairs []kv.KVPair
+	for i := 0; i < size; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		pairs = append(pairs, kv.NewKVPair(key, []byte(key)))
+	}
+
+	return pairs
+}
+
+func TestKVServiceFlush(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	// Flushing an empty store does nothing
+	err := service.Flush()
+	is.NoErr(err)
+	is.Equal(len(*flushed), 0)
+
+	// Store is flushed once it reaches the threshold
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		err := service.Put(pair.Key, pair.Value)
+		is.NoErr(err)
+	}
+	service.wg.Wait()
+	is.Equal(len(*flushed), 1)
+	is.Equal((*flushed)[0].Size(), size)
+
+	// A fresh store was swapped in
+	is.Equal(service.memStore.Size(), 0)
+
+	// Log was truncated
+	first, err := service.wal.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(0))
+}
+
+func TestKVServiceGet(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	// Fill the first store and put a single pair in the second
+	pairs := NewSequentialPairs(size + 1)
+	for _, pair := range pairs {
+		err := service.Put(pair.Key, pair.Value)
+		is.NoErr(err)
+	}
+	service.wg.Wait()
+	is.Equal(len(*flushed), 1)
+	is.Equal(service.memStore.Size(), 1)
+
+	// All pairs are found in either store
+	for _, pair := range pairs {
+		result, err := service.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	// Newer values in memory take precedence
+	err := service.Put(pairs[0].Key, []byte("updated"))
+	is.NoErr(err)
+
+	result, err := service.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(result.Value, []byte("updated"))
+
+	// Nonexistent key
+	_, err = service.Get("1")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestKVServiceDelete(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	// Flush all pairs into the non-volatile store
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		err := service.Put(pair.Key, pair.Value)
+		is.NoErr(err)
+	}
+	service.wg.Wait()
+	is.Equal(len(*flushed), 1)
+
+	// Deleting a flushed key hides it
+	err := service.Delete(pairs[0].Key)
+	is.NoErr(err)
+
+	_, err = service.Get(pairs[0].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Deletion is still respected once the tombstone is flushed
+	err = service.Flush()
+	is.NoErr(err)
+	is.Equal(len(*flushed), 2)
+
+	_, err = service.Get(pairs[0].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestKVServiceIterator(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	// Spread pairs across two flushed stores and the memory store
+	pairs := NewSequentialPairs(size * 2)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Put(pairs[0].Key, []byte("updated")))
+	is.NoErr(service.Delete(pairs[size].Key))
+	service.wg.Wait()
+	is.Equal(len(*flushed), 2)
+
+	// Newest version of every live key in order
+	expected := append([]kv.KVPair{}, pairs[:size]...)
+	expected = append(expected, pairs[size+1:]...)
+	expected[0] = kv.NewKVPair(pairs[0].Key, []byte("updated"))
+
+	result, err := helper.ReadIterator(service.Iterator(), "")
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), expected)
+
+	// Seeking skips deleted keys
+	iterator := service.Iterator()
+	is.NoErr(iterator.Seek(pairs[size].Key))
+	is.Equal(iterator.Key(), pairs[size+1].Key)
+	is.NoErr(iterator.Close())
+
+	// Writes made while an iterator is open aren't seen by it
+	iterator = service.Iterator()
+	is.NoErr(service.Put(pairs[1].Key, []byte("new")))
+	is.NoErr(service.Put("key9999", []byte("new")))
+
+	result, err = helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), expected)
+}
+
+func TestKVServiceScan(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, _ := NewMockKVService(size)
+
+	// Spread pairs across a flushed store and the memory store
+	pairs := NewSequentialPairs(size * 2)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Delete(pairs[5].Key))
+
+	// Start is inclusive and end is exclusive
+	result, err := service.Scan(pairs[3].Key, pairs[8].Key, 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), []kv.KVPair{pairs[3], pairs[4], pairs[6], pairs[7]})
+
+	// Limit
+	result, err = service.Scan(pairs[3].Key, "", 2)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[3:5])
+
+	// No end scans to the last key
+	result, err = service.Scan(pairs[15].Key, "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[15:])
+
+	// Keys are normalized
+	result, err = service.Scan("KEY0019", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[19:])
+
+	// Empty range
+	result, err = service.Scan(pairs[8].Key, pairs[3].Key, 0)
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestKVServiceRangeNormalized(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, _ := NewMockKVService(size)
+
+	pairs := NewSequentialPairs(size * 2)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+
+	// Pairs are visited in the same order as a scan
+	var visited []kv.KVPair
+	err := service.RangeNormalized(pairs[3].Key, pairs[15].Key, false, func(pair kv.KVPair) bool {
+		visited = append(visited, pair)
+		return true
+	})
+	is.NoErr(err)
+	is.Equal(StripSeqs(visited), pairs[3:15])
+
+	visited = nil
+	err = service.RangeNormalized(pairs[3].Key, pairs[15].Key, true, func(pair kv.KVPair) bool {
+		visited = append(visited, pair)
+		return true
+	})
+	is.NoErr(err)
+	is.Equal(len(visited), 12)
+	is.Equal(visited[0].Key, pairs[14].Key)
+
+	// Returning false stops the range
+	visited = nil
+	err = service.RangeNormalized("", "", false, func(pair kv.KVPair) bool {
+		visited = append(visited, pair)
+		return len(visited) < 2
+	})
+	is.NoErr(err)
+	is.Equal(StripSeqs(visited), pairs[:2])
+}
+
+func TestKVServiceScanReverse(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, _ := NewMockKVService(size)
+
+	// Spread pairs across a flushed store and the memory store
+	pairs := NewSequentialPairs(size * 2)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Delete(pairs[5].Key))
+
+	// Start is inclusive and end is exclusive
+	result, err := service.ScanReverse(pairs[3].Key, pairs[8].Key, 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), []kv.KVPair{pairs[7], pairs[6], pairs[4], pairs[3]})
+
+	// Latest N keys
+	result, err = service.ScanReverse("", "", 3)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), []kv.KVPair{pairs[19], pairs[18], pairs[17]})
+
+	// End past the last key
+	result, err = service.ScanReverse(pairs[18].Key, "z", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), []kv.KVPair{pairs[19], pairs[18]})
+
+	// Empty range
+	result, err = service.ScanReverse(pairs[8].Key, pairs[3].Key, 0)
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestKVServiceScanPrefix(t *testing.T) {
+	is := is.New(t)
+	service, _ := NewMockKVService(5)
+
+	keys := []string{"user:099", "user:100", "user:150", "user:200", "users", "uses"}
+	for _, key := range keys {
+		is.NoErr(service.Put(key, []byte(key)))
+	}
+
+	result, err := service.ScanPrefix("user:1", 0)
+	is.NoErr(err)
+	is.Equal(len(result), 2)
+	is.Equal(result[0].Key, "user:100")
+	is.Equal(result[1].Key, "user:150")
+
+	result, err = service.ScanPrefix("user", 0)
+	is.NoErr(err)
+	is.Equal(len(result), 5)
+
+	result, err = service.ScanPrefix("user", 3)
+	is.NoErr(err)
+	is.Equal(len(result), 3)
+
+	// Everything matches an empty prefix
+	result, err = service.ScanPrefix("", 0)
+	is.NoErr(err)
+	is.Equal(len(result), len(keys))
+}
+
+func TestKVServiceReplay(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	wal := mock.NewMockLog()
+	service, _ := NewMockKVServiceWithLog(size*2, &wal)
+
+	// Write some pairs and delete the first one
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		err := service.Put(pair.Key, pair.Value)
+		is.NoErr(err)
+	}
+	err := service.Delete(pairs[0].Key)
+	is.NoErr(err)
+
+	// Every write was logged
+	last, err := wal.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size+1))
+
+	// A new service recovers the writes from the log
+	service, flushed := NewMockKVServiceWithLog(size*2, &wal)
+	is.Equal(len(*flushed), 0)
+	for _, pair := range pairs[1:] {
+		result, err := service.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	_, err = service.Get(pairs[0].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestKVServicePersistence(t *testing.T) {
+	size := 25
+	is := is.New(t)
+	root := t.TempDir()
+
+	service, closeFn, err := OpenTestKVService(root, 10)
+	is.NoErr(err)
+
+	// Write enough pairs to flush a few segments and delete one of them
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		err := service.Put(pair.Key, pair.Value)
+		is.NoErr(err)
+	}
+	is.NoErr(service.Delete(pairs[size-1].Key))
+	closeFn()
+
+	// Everything is recovered from segments and the log
+	service, closeFn, err = OpenTestKVService(root, 10)
+	is.NoErr(err)
+	defer closeFn()
+
+	for _, pair := range pairs[:size-1] {
+		result, err := service.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	_, err = service.Get(pairs[size-1].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Scans merge the recovered segments in both directions
+	result, err := service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[:size-1])
+
+	result, err = service.ScanReverse("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), helper.ReversePairs(pairs[:size-1]))
+}
+
+func TestKVServiceSnapshot(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs[:5] {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+
+	snapshot := service.Snapshot()
+	defer snapshot.Release()
+	is.Equal(snapshot.Seq(), uint64(5))
+
+	// Later writes, including ones flushed to the NVStore, aren't visible
+	is.NoErr(service.Put(pairs[0].Key, []byte("updated")))
+	is.NoErr(service.Delete(pairs[1].Key))
+	for _, pair := range pairs[5:] {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	service.wg.Wait()
+	is.Equal(len(*flushed), 1)
+
+	pair, err := snapshot.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(pair.Value, pairs[0].Value)
+
+	pair, err = snapshot.Get(pairs[1].Key)
+	is.NoErr(err)
+	is.Equal(pair.Value, pairs[1].Value)
+
+	_, err = snapshot.Get(pairs[5].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	result, err := snapshot.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[:5])
+
+	result, err = snapshot.ScanReverse("", "", 2)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), []kv.KVPair{pairs[4], pairs[3]})
+
+	result, err = snapshot.ScanPrefix("KEY000", 0)
+	is.NoErr(err)
+	is.Equal(len(result), 5)
+
+	// The service sees the latest writes
+	pair, err = service.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("updated"))
+
+	_, err = service.Get(pairs[1].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestKVServiceSnapshotPersistence(t *testing.T) {
+	size := 25
+	is := is.New(t)
+	root := t.TempDir()
+
+	service, closeFn, err := OpenTestKVService(root, 10)
+	is.NoErr(err)
+
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	closeFn()
+
+	// Sequence numbers carry on from the segments and the log
+	service, closeFn, err = OpenTestKVService(root, 10)
+	is.NoErr(err)
+	defer closeFn()
+
+	snapshot := service.Snapshot()
+	defer snapshot.Release()
+	is.Equal(snapshot.Seq(), uint64(size))
+
+	// Overwrite every key and flush the new versions next to the old ones
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, []byte("updated")))
+	}
+	is.NoErr(service.Flush())
+
+	result, err := snapshot.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs)
+
+	result, err = service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(len(result), size)
+	for _, pair := range result {
+		is.Equal(pair.Value, []byte("updated"))
+		is.True(pair.Seq > snapshot.Seq())
+	}
+}
+
+func TestKVServicePutWithTTL(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, _ := NewMockKVService(size)
+
+	// Older versions stay hidden once a newer one expires
+	is.NoErr(service.Put("expiring", []byte("old")))
+	is.NoErr(service.PutWithTTL("expiring", []byte("new"), time.Millisecond))
+	is.NoErr(service.PutWithTTL("live", []byte("live"), time.Hour))
+
+	result, err := service.Get("live")
+	is.NoErr(err)
+	is.Equal(result.Value, []byte("live"))
+	is.True(result.Expires > time.Now().UnixNano())
+
+	time.Sleep(5 * time.Millisecond)
+	_, err = service.Get("expiring")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	pairs, err := service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(len(pairs), 1)
+	is.Equal(pairs[0].Key, "live")
+
+	// Expired pairs stay hidden once flushed
+	is.NoErr(service.Flush())
+	_, err = service.Get("expiring")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	snapshot := service.Snapshot()
+	defer snapshot.Release()
+
+	_, err = snapshot.Get("expiring")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	result, err = service.Get("live")
+	is.NoErr(err)
+	is.Equal(result.Value, []byte("live"))
+
+	// TTLs must be positive
+	err = service.PutWithTTL("key", []byte("value"), 0)
+	is.True(errors.Is(err, ErrorInvalidTTL))
+
+	// Expiry times which don't fit are capped
+	is.NoErr(service.PutWithTTL("forever", []byte("forever"), time.Duration(math.MaxInt64)))
+	result, err = service.Get("forever")
+	is.NoErr(err)
+	is.Equal(result.Expires, int64(math.MaxInt64))
+}
+
+func TestKVServiceTTLPersistence(t *testing.T) {
+	is := is.New(t)
+	root := t.TempDir()
+
+	service, closeFn, err := OpenTestKVService(root, 2)
+	is.NoErr(err)
+
+	// One pair is flushed to a segment and the other is only in the log
+	is.NoErr(service.PutWithTTL("a", []byte("a"), time.Hour))
+	is.NoErr(service.Put("b", []byte("b")))
+	is.NoErr(service.PutWithTTL("c", []byte("c"), time.Hour))
+	closeFn()
+
+	service, closeFn, err = OpenTestKVService(root, 2)
+	is.NoErr(err)
+	defer closeFn()
+
+	for _, key := range []string{"a", "c"} {
+		result, err := service.Get(key)
+		is.NoErr(err)
+		is.True(result.Expires > time.Now().UnixNano())
+	}
+}
+
+func TestKVServiceNormalizer(t *testing.T) {
+	is := is.New(t)
+
+	// Keys are case sensitive and binary safe without normalization
+	service, closeFn, err := OpenTestKVServiceWithKeys(t.TempDir(), 2, nil, nil)
+	is.NoErr(err)
+	defer closeFn()
+
+	is.NoErr(service.Put("Key", []byte("upper")))
+	is.NoErr(service.Put("key", []byte("lower")))
+	is.NoErr(service.Put("\x00\xff", []byte("binary")))
+	is.NoErr(service.Flush())
+
+	pair, err := service.Get("Key")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("upper"))
+
+	pair, err = service.Get("\x00\xff")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("binary"))
+
+	_, err = service.Get("KEY")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Lowercased keys are case insensitive
+	service, closeFn, err = OpenTestKVServiceWithKeys(t.TempDir(), 2, kv.LowercaseNormalizer, nil)
+	is.NoErr(err)
+	defer closeFn()
+
+	is.NoErr(service.Put("Key", []byte("value")))
+	pair, err = service.Get("KEY")
+	is.NoErr(err)
+	is.Equal(pair.Key, "key")
+
+	// Canonically equivalent keys are the same key in NFC
+	service, closeFn, err = OpenTestKVServiceWithKeys(t.TempDir(), 2, kv.NFCNormalizer, nil)
+	is.NoErr(err)
+	defer closeFn()
+
+	is.NoErr(service.Put("caf\u00e9", []byte("composed")))
+	is.NoErr(service.Put("cafe\u0301", []byte("decomposed")))
+	pair, err = service.Get("caf\u00e9")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("decomposed"))
+
+	result, err := service.ScanPrefix("caf", 0)
+	is.NoErr(err)
+	is.Equal(len(result), 1)
+}
+
+func TestKVServiceComparator(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	root := t.TempDir()
+
+	service, closeFn, err := OpenTestKVServiceWithKeys(root, size/2, nil, mock.ReverseComparator{})
+	is.NoErr(err)
+
+	// Pairs are spread across segments, sealed stores and the active store
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Flush())
+	is.NoErr(service.Put(pairs[size-1].Key, []byte("updated")))
+	closeFn()
+
+	service, closeFn, err = OpenTestKVServiceWithKeys(root, size/2, nil, mock.ReverseComparator{})
+	is.NoErr(err)
+	defer closeFn()
+
+	// Scans follow the order of the comparator
+	result, err := service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(len(result), size)
+	for i, pair := range result {
+		is.Equal(pair.Key, pairs[size-i-1].Key)
+	}
+	is.Equal(result[0].Value, []byte("updated"))
+
+	result, err = service.Scan(pairs[7].Key, pairs[4].Key, 0)
+	is.NoErr(err)
+	is.Equal(len(result), 3)
+	is.Equal(result[0].Key, pairs[7].Key)
+
+	result, err = service.ScanReverse(pairs[7].Key, pairs[4].Key, 0)
+	is.NoErr(err)
+	is.Equal(len(result), 3)
+	is.Equal(result[0].Key, pairs[5].Key)
+
+	// Keys sharing a prefix aren't ordered together
+	_, err = service.ScanPrefix("key", 0)
+	is.Equal(err, ErrorPrefixOrder)
+
+	for _, pair := range pairs[:size-1] {
+		result, err := service.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+}
+
+func TestKVServiceImmutable(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, flushed := NewMockKVService(size)
+
+	// Hold up flushes until released
+	nvStore := service.nvStore.(*mock.MockNVStore)
+	putFn := nvStore.PutFn
+	release := make(chan struct{})
+	nvStore.PutFn = func(store kv.MemoryStore) (kv.SegmentID, error) {
+		<-release
+		return putFn(store)
+	}
+
+	// Filling the store seals it without waiting for the flush
+	pairs := NewSequentialPairs(size * 2)
+	for _, pair := range pairs[:size] {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.Equal(len(service.immutable), 1)
+	is.Equal(service.memStore.Size(), 0)
+
+	// Writes carry on while the sealed store is being flushed
+	for _, pair := range pairs[size:] {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.Equal(len(service.immutable), 2)
+	is.NoErr(service.Delete(pairs[0].Key))
+
+	// Sealed stores are readable until they're flushed
+	for _, pair := range pairs[1:] {
+		result, err := service.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	_, err := service.Get(pairs[0].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	result, err := service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[1:])
+
+	// Sealed stores are flushed in order and the log is truncated after each
+	close(release)
+	is.NoErr(service.Close())
+	is.Equal(len(*flushed), 2)
+	is.Equal((*flushed)[0].Min().Key, pairs[0].Key)
+	is.Equal(len(service.immutable), 0)
+
+	first, err := service.wal.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(size*2+1))
+
+	result, err = service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(StripSeqs(result), pairs[1:])
+}
+
+func TestKVServiceFlushError(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	service, _ := NewMockKVService(size)
+
+	nvStore := service.nvStore.(*mock.MockNVStore)
+	nvStore.PutFn = func(store kv.MemoryStore) (kv.SegmentID, error) {
+		return kv.SegmentID{}, errors.New("disk full")
+	}
+
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+
+	// The error is reported and further writes are refused
+	is.True(service.Close() != nil)
+	is.True(service.Err() != nil)
+	is.True(service.Put("key", []byte("value")) != nil)
+
+	// Unflushed pairs are kept in memory and in the log
+	result, err := service.Get(pairs[0].Key)
+	is.NoErr(err)
+	is.Equal(result.Value, pairs[0].Value)
+
+	first, err := service.wal.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(1))
+}
+
+func TestKVServiceClose(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	wal := mock.NewMockLog()
+	service, flushed := NewMockKVServiceWithLog(size, &wal)
+
+	// Writing past the threshold starts a flush which Close waits for
+	pairs := NewSequentialPairs(size + 1)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Close())
+	is.Equal(len(*flushed), 1)
+
+	// The write-ahead log was closed
+	is.True(wal.Close() != nil)
+
+	// Writes are refused while reads keep working
+	is.Equal(service.Put("key", []byte("value")), ErrorServiceClosed)
+	is.Equal(service.Delete(pairs[0].Key), ErrorServiceClosed)
+	is.Equal(service.Flush(), ErrorServiceClosed)
+
+	txn := service.Begin()
+	is.NoErr(txn.Put("key", []byte("value")))
+	is.Equal(txn.Commit(), ErrorServiceClosed)
+
+	result, err := service.Get(pairs[size].Key)
+	is.NoErr(err)
+	is.Equal(result.Value, pairs[size].Value)
+
+	// Closing twice reports it
+	is.Equal(service.Close(), ErrorServiceClosed)
+}
+
+func TestKVServiceConcurrent(t *testing.T) {
+	workers := 8
+	size := 50
+	is := is.New(t)
+	root := t.TempDir()
+
+	service, closeFn, err := OpenTestKVService(root, 16)
+	is.NoErr(err)
+	defer closeFn()
+
+	// Every worker writes its own keys while reading back its earlier writes
+	// and scanning everything written so far
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < size; i++ {
+				key := fmt.Sprintf("w%02d-%04d", w, i)
+				if err := service.Put(key, []byte(key)); err != nil {
+					errs <- err
+					return
+				}
+
+				result, err := service.Get(key)
+				if err != nil {
+					errs <- fmt.Errorf("get %s: %w", key, err)
+					return
+				}
+				if string(result.Value) != key {
+					errs <- fmt.Errorf("get %s: got %s", key, result.Value)
+					return
+				}
+
+				pairs, err := service.ScanPrefix(fmt.Sprintf("w%02d-", w), 0)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(pairs) != i+1 {
+					errs <- fmt.Errorf("scan w%02d: got %d pairs, want %d", w, len(pairs), i+1)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		is.NoErr(err)
+	}
+
+	// Nothing was lost once every flush has finished
+	is.NoErr(service.Close())
+	result, err := service.Scan("", "", 0)
+	is.NoErr(err)
+	is.Equal(len(result), workers*size)
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"github.com/jmgilman/kv"
+)
+
+// Snapshot provides a read-only view of a KVService as it was when the
+// Snapshot was taken. Writes made after that point aren't visible through it.
+// Release must be called once the Snapshot is no longer needed so that the
+// versions it pins can be compacted away.
+type Snapshot struct {
+	seq     uint64
+	service *KVService
+}
+
+// Get returns the version of the given key which was current when the
+// Snapshot was taken. Returns kv.ErrorNoSuchKey if the key didn't exist or had
+// been deleted at that point, or if that version has since expired.
+func (s *Snapshot) Get(key string) (*kv.KVPair, error) {
+	return s.service.get(s.service.Normalize(key), s.seq)
+}
+
+// Iterator returns a kv.Iterator over every live key as of the Snapshot.
+func (s *Snapshot) Iterator() kv.Iterator {
+	return s.service.iterator(s.seq)
+}
+
+// Release unpins the Snapshot. It must not be used afterwards.
+func (s *Snapshot) Release() {
+	s.service.nvStore.Snapshots().Release(s.seq)
+}
+
+// Scan works like KVService.Scan as of the Snapshot.
+func (s *Snapshot) Scan(start string, end string, limit int) ([]kv.KVPair, error) {
+	return s.service.scan(s.Iterator(), s.service.Normalize(start), s.service.Normalize(end), limit)
+}
+
+// ScanPrefix works like KVService.ScanPrefix as of the Snapshot.
+func (s *Snapshot) ScanPrefix(prefix string, limit int) ([]kv.KVPair, error) {
+	prefix = s.service.Normalize(prefix)
+	end, err := s.service.PrefixEnd(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.service.scan(s.Iterator(), prefix, end, limit)
+}
+
+// ScanReverse works like KVService.ScanReverse as of the Snapshot.
+func (s *Snapshot) ScanReverse(start string, end string, limit int) ([]kv.KVPair, error) {
+	return s.service.scanReverse(s.Iterator(), s.service.Normalize(start), s.service.Normalize(end), limit)
+}
+
+// Seq returns the sequence number the Snapshot is pinned to.
+func (s *Snapshot) Seq() uint64 {
+	return s.seq
+}
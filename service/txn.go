@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+
+	"github.com/jmgilman/kv"
+)
+
+var ErrorTxnClosed = errors.New("transaction already committed or rolled back")
+var ErrorTxnConflict = errors.New("transaction conflicts with a newer write")
+
+// Txn is an optimistic read-modify-write transaction against a KVService. Reads
+// are made from a Snapshot taken when the Txn began, along with any writes the
+// Txn has buffered itself, and writes are buffered in a WriteBatch until
+// Commit. Commit fails with ErrorTxnConflict if any key the Txn read has been
+// written since it began.
+//
+// A Txn must be finished with either Commit or Rollback, after which it can't
+// be used again.
+type Txn struct {
+	batch    WriteBatch
+	closed   bool
+	reads    map[string]struct{}
+	service  *KVService
+	snapshot *Snapshot
+	writes   map[string]kv.KVPair
+}
+
+// Commit checks that no key read by the Txn has been written since it began
+// and then applies every buffered write as a single batch. Returns
+// ErrorTxnConflict, without writing anything, if a conflict is found. The Txn
+// is closed either way. Only the MemoryStore's are checked while writes are
+// held up; the NVStore is searched beforehand and again if a flush happened
+// in between.
+func (t *Txn) Commit() error {
+	if t.closed {
+		return ErrorTxnClosed
+	}
+	defer t.close()
+
+	for {
+		// The NVStore is searched without holding up writers, which is only
+		// valid for as long as no MemoryStore is flushed into it
+		t.service.mu.RLock()
+		flushes := t.service.flushes
+		t.service.mu.RUnlock()
+
+		stored := make(map[string]uint64, len(t.reads))
+		for key := range t.reads {
+			seq, err := t.service.storedSeq(key)
+			if err != nil {
+				return err
+			}
+			stored[key] = seq
+		}
+
+		// Nothing can be written between checking for conflicts and writing
+		t.service.mu.Lock()
+		if t.service.flushes != flushes {
+			t.service.mu.Unlock()
+			continue
+		}
+
+		err := t.commit(stored)
+		t.service.mu.Unlock()
+		return err
+	}
+}
+
+// Delete buffers the deletion of the given key.
+func (t *Txn) Delete(key string) error {
+	if t.closed {
+		return ErrorTxnClosed
+	}
+
+	pair := kv.DeleteKVPair(t.service.Normalize(key))
+	t.batch.Delete(pair.Key)
+	t.writes[pair.Key] = pair
+	return nil
+}
+
+// Get returns the value the Txn has buffered for the given key or, if it
+// hasn't written the key, the version seen by its Snapshot. Keys read from the
+// Snapshot are checked for conflicts on Commit. Returns kv.ErrorNoSuchKey if
+// the key doesn't exist or has been deleted.
+func (t *Txn) Get(key string) (*kv.KVPair, error) {
+	if t.closed {
+		return nil, ErrorTxnClosed
+	}
+
+	key = t.service.Normalize(key)
+	if pair, ok := t.writes[key]; ok {
+		if pair.Tombstone {
+			return nil, kv.ErrorNoSuchKey
+		}
+
+		return &pair, nil
+	}
+
+	// Keys which don't exist are recorded too so that creating them conflicts
+	t.reads[key] = struct{}{}
+	return t.service.get(key, t.snapshot.Seq())
+}
+
+// Put buffers the given key/value.
+func (t *Txn) Put(key string, value []byte) error {
+	if t.closed {
+		return ErrorTxnClosed
+	}
+
+	pair := kv.NewKVPair(t.service.Normalize(key), value)
+	t.batch.Put(pair.Key, pair.Value)
+	t.writes[pair.Key] = pair
+	return nil
+}
+
+// Rollback discards every buffered write and closes the Txn.
+func (t *Txn) Rollback() error {
+	if t.closed {
+		return ErrorTxnClosed
+	}
+
+	t.close()
+	return nil
+}
+
+// commit checks the MemoryStore's for conflicts, falling back to the given
+// sequence numbers found in the NVStore, and then writes the batch. The caller
+// must hold the lock of the KVService.
+func (t *Txn) commit(stored map[string]uint64) error {
+	for key := range t.reads {
+		seq, ok, err := t.service.memSeq(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			seq = stored[key]
+		}
+
+		if seq > t.snapshot.Seq() {
+			return ErrorTxnConflict
+		}
+	}
+
+	// Keys were normalized as they were buffered
+	return t.service.writeBatch(t.batch.pairs)
+}
+
+// close releases the Snapshot of the Txn and marks it as closed.
+func (t *Txn) close() {
+	t.snapshot.Release()
+	t.closed = true
+}
@@ -0,0 +1,239 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/btree"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+func TestTxnCommit(t *testing.T) {
+	is := is.New(t)
+	service, _ := NewMockKVService(10)
+	is.NoErr(service.Put("counter", []byte("1")))
+
+	txn := service.Begin()
+	pair, err := txn.Get("counter")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("1"))
+
+	// Buffered writes are visible to the txn but not the service
+	is.NoErr(txn.Put("COUNTER", []byte("2")))
+	is.NoErr(txn.Put("other", []byte("other")))
+	is.NoErr(txn.Delete("other"))
+
+	pair, err = txn.Get("counter")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("2"))
+
+	_, err = txn.Get("other")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	pair, err = service.Get("counter")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("1"))
+
+	// Commit applies every write
+	is.NoErr(txn.Commit())
+	pair, err = service.Get("counter")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("2"))
+
+	_, err = service.Get("other")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// The txn can't be used again
+	is.Equal(txn.Commit(), ErrorTxnClosed)
+	_, err = txn.Get("counter")
+	is.Equal(err, ErrorTxnClosed)
+	is.Equal(txn.Put("counter", nil), ErrorTxnClosed)
+}
+
+func TestTxnConflict(t *testing.T) {
+	is := is.New(t)
+	service, _ := NewMockKVService(3)
+	is.NoErr(service.Put("a", []byte("a")))
+	is.NoErr(service.Put("b", []byte("b")))
+
+	// A key read by the txn is overwritten and flushed
+	txn := service.Begin()
+	_, err := txn.Get("a")
+	is.NoErr(err)
+	is.NoErr(txn.Put("b", []byte("txn")))
+	is.NoErr(service.Put("a", []byte("changed")))
+
+	is.Equal(txn.Commit(), ErrorTxnConflict)
+	pair, err := service.Get("b")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("b"))
+
+	// Deleting a key read by the txn conflicts
+	txn = service.Begin()
+	_, err = txn.Get("b")
+	is.NoErr(err)
+	is.NoErr(service.Delete("b"))
+	is.Equal(txn.Commit(), ErrorTxnConflict)
+
+	// Creating a key the txn found missing conflicts
+	txn = service.Begin()
+	_, err = txn.Get("c")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+	is.NoErr(service.Put("c", []byte("c")))
+	is.Equal(txn.Commit(), ErrorTxnConflict)
+
+	// Writes to keys the txn didn't read don't conflict
+	txn = service.Begin()
+	_, err = txn.Get("a")
+	is.NoErr(err)
+	is.NoErr(txn.Put("d", []byte("txn")))
+	is.NoErr(service.Put("d", []byte("d")))
+	is.NoErr(txn.Commit())
+
+	pair, err = service.Get("d")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("txn"))
+}
+
+func TestTxnCommitConcurrent(t *testing.T) {
+	size := 100
+	is := is.New(t)
+	service, _ := NewMockKVService(size * 2)
+
+	pairs := NewSequentialPairs(size)
+	for _, pair := range pairs {
+		is.NoErr(service.Put(pair.Key, pair.Value))
+	}
+	is.NoErr(service.Flush())
+
+	txn := service.Begin()
+	for _, pair := range pairs {
+		_, err := txn.Get(pair.Key)
+		is.NoErr(err)
+	}
+	is.NoErr(txn.Put("txn", []byte("txn")))
+
+	// The NVStore blocks while the txn checks its reads for conflicts
+	started := make(chan struct{})
+	release := make(chan struct{})
+	nvStore := service.nvStore.(*mock.MockNVStore)
+	lookupFn := nvStore.LookupFn
+	nvStore.LookupFn = func(key string) (*kv.KVPair, error) {
+		if key == pairs[0].Key {
+			close(started)
+			<-release
+		}
+		return lookupFn(key)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- txn.Commit()
+	}()
+	<-started
+
+	// Writes aren't held up by the commit
+	written := make(chan error)
+	go func() {
+		written <- service.Put("other", []byte("other"))
+	}()
+
+	select {
+	case err := <-written:
+		is.NoErr(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("put was blocked by a commit")
+	}
+
+	close(release)
+	is.NoErr(<-done)
+
+	pair, err := service.Get("txn")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("txn"))
+}
+
+func TestTxnCommitFlush(t *testing.T) {
+	is := is.New(t)
+	service, _ := NewMockKVService(10)
+
+	txn := service.Begin()
+	_, err := txn.Get("a")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+	is.NoErr(service.Put("a", []byte("a")))
+
+	// The write is flushed after the txn missed it in the NVStore
+	flushed := false
+	nvStore := service.nvStore.(*mock.MockNVStore)
+	lookupFn := nvStore.LookupFn
+	nvStore.LookupFn = func(key string) (*kv.KVPair, error) {
+		pair, err := lookupFn(key)
+		if !flushed {
+			flushed = true
+			if err := service.Flush(); err != nil {
+				return nil, fmt.Errorf("flush: %w", err)
+			}
+		}
+		return pair, err
+	}
+
+	is.Equal(txn.Commit(), ErrorTxnConflict)
+	is.True(flushed)
+}
+
+func TestTxnNormalizer(t *testing.T) {
+	is := is.New(t)
+
+	// Normalizing a key twice gives a different key
+	factory := func() kv.MemoryStore {
+		return &btree.Tree{}
+	}
+	normalizer := func(key string) string {
+		return key + "!"
+	}
+	nvStore := mock.NewMockNVStore()
+	wal := mock.NewMockLog()
+	service, err := NewKVService(factory, &nvStore, &wal, 10, normalizer, nil)
+	is.NoErr(err)
+
+	is.NoErr(service.Put("a", []byte("a")))
+	batch := NewWriteBatch()
+	batch.Put("b", []byte("b"))
+	is.NoErr(service.Write(&batch))
+
+	txn := service.Begin()
+	pair, err := txn.Get("a")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("a"))
+	is.NoErr(txn.Put("c", []byte("c")))
+	is.NoErr(txn.Commit())
+
+	result, err := helper.ReadIterator(service.Iterator(), "")
+	is.NoErr(err)
+	var keys []string
+	for _, pair := range result {
+		keys = append(keys, pair.Key)
+	}
+	is.Equal(keys, []string{"a!", "b!", "c!"})
+}
+
+func TestTxnRollback(t *testing.T) {
+	is := is.New(t)
+	service, _ := NewMockKVService(10)
+
+	txn := service.Begin()
+	is.NoErr(txn.Put("a", []byte("a")))
+	is.NoErr(txn.Rollback())
+	is.Equal(txn.Rollback(), ErrorTxnClosed)
+
+	_, err := service.Get("a")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// The snapshot was released
+	is.Equal(service.nvStore.Snapshots().Oldest(), kv.LatestSeq)
+}
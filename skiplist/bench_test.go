@@ -0,0 +1,88 @@
+package skiplist_test
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/btree"
+	"github.com/jmgilman/kv/skiplist"
+)
+
+const benchSize = 10000
+
+// factories are the MemoryStore implementations which are benchmarked against
+// each other.
+var factories = []struct {
+	name    string
+	factory kv.MemoryStoreFactory
+}{
+	{"btree", func() kv.MemoryStore { return &btree.Tree{} }},
+	{"skiplist", func() kv.MemoryStore { return skiplist.NewList(nil) }},
+}
+
+// NewBenchPairs returns size pairs with unique keys in random order.
+func NewBenchPairs(size int) []kv.KVPair {
+	pairs := make([]kv.KVPair, size)
+	for i, j := range rand.New(rand.NewSource(1)).Perm(size) {
+		key := fmt.Sprintf("key%08d", j)
+		pairs[i] = kv.NewKVPair(key, []byte(key))
+	}
+
+	return pairs
+}
+
+// NewBenchStore returns a store created by the given factory which holds the
+// given pairs.
+func NewBenchStore(factory kv.MemoryStoreFactory, pairs []kv.KVPair) kv.MemoryStore {
+	store := factory()
+	for _, pair := range pairs {
+		store.Put(pair)
+	}
+
+	return store
+}
+
+func BenchmarkPut(b *testing.B) {
+	pairs := NewBenchPairs(benchSize)
+	for _, f := range factories {
+		b.Run(f.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				NewBenchStore(f.factory, pairs)
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	pairs := NewBenchPairs(benchSize)
+	for _, f := range factories {
+		b.Run(f.name, func(b *testing.B) {
+			store := NewBenchStore(f.factory, pairs)
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				if _, err := store.Get(pairs[n%len(pairs)].Key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIterator(b *testing.B) {
+	pairs := NewBenchPairs(benchSize)
+	for _, f := range factories {
+		b.Run(f.name, func(b *testing.B) {
+			store := NewBenchStore(f.factory, pairs)
+			b.ResetTimer()
+
+			for n := 0; n < b.N; n++ {
+				iterator := store.Iterator()
+				for iterator.Seek(""); iterator.Valid(); iterator.Next() {
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package skiplist
+
+import "github.com/jmgilman/kv"
+
+// iterator implements kv.Iterator over a List. Nodes only link forwards, so
+// moving backwards searches the list again for the node before the current
+// one.
+type iterator struct {
+	list *List
+	node *node
+}
+
+func (i *iterator) Close() error {
+	i.node = nil
+	return nil
+}
+
+func (i *iterator) Key() string {
+	return i.node.key
+}
+
+func (i *iterator) Next() error {
+	if i.Valid() {
+		i.node = i.node.getNext(0)
+	}
+
+	return nil
+}
+
+func (i *iterator) Pair() kv.KVPair {
+	return *i.node.load()
+}
+
+func (i *iterator) Prev() error {
+	if i.Valid() {
+		i.node = i.list.findLess(i.node.key, i.node.seq)
+	}
+
+	return nil
+}
+
+func (i *iterator) Seek(key string) error {
+	if key == "" {
+		i.node = i.list.head.getNext(0)
+		return nil
+	}
+
+	i.node = i.list.findGreaterOrEqual(key, kv.LatestSeq, nil)
+	return nil
+}
+
+func (i *iterator) SeekToLast() error {
+	i.node = i.list.findLast()
+	return nil
+}
+
+func (i *iterator) Valid() bool {
+	return i.node != nil
+}
+
+func (i *iterator) Value() []byte {
+	return i.node.load().Value
+}
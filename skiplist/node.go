@@ -0,0 +1,61 @@
+package skiplist
+
+import (
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/jmgilman/kv"
+)
+
+// node represents a single version of a key in a List. The key and sequence
+// number of a node never change, but its KVPair may be replaced by one with
+// the same sequence number, so it's loaded and stored atomically along with
+// the links to the following nodes on each level.
+type node struct {
+	key  string
+	next []unsafe.Pointer
+	pair unsafe.Pointer
+	seq  uint64
+}
+
+// getNext returns the node following this one on the given level.
+func (n *node) getNext(level int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[level]))
+}
+
+// less returns true if the node comes before the given key and sequence
+// number. Nodes are ordered by key, using the given Comparator, and then from
+// the newest to the oldest sequence number.
+func (n *node) less(key string, seq uint64, cmp kv.Comparator) bool {
+	if c := cmp.Compare(n.key, key); c != 0 {
+		return c < 0
+	}
+
+	return n.seq > seq
+}
+
+// load returns the KVPair held by the node.
+func (n *node) load() *kv.KVPair {
+	return (*kv.KVPair)(atomic.LoadPointer(&n.pair))
+}
+
+// setNext links the given node after this one on the given level.
+func (n *node) setNext(level int, next *node) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+// store replaces the KVPair held by the node.
+func (n *node) store(pair *kv.KVPair) {
+	atomic.StorePointer(&n.pair, unsafe.Pointer(pair))
+}
+
+// newNode returns a new node holding the given KVPair which is linked on the
+// given number of levels.
+func newNode(pair kv.KVPair, height int) *node {
+	return &node{
+		key:  pair.Key,
+		next: make([]unsafe.Pointer, height),
+		pair: unsafe.Pointer(&pair),
+		seq:  pair.Seq,
+	}
+}
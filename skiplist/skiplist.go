@@ -0,0 +1,252 @@
+package skiplist
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmgilman/kv"
+)
+
+const (
+	// branching is the inverse of the chance that a node is linked on the next
+	// level up.
+	branching = 4
+
+	// maxHeight is the highest level a node can be linked on.
+	maxHeight = 12
+)
+
+// List implements a MemoryStore using a skip list. Every version of a key is
+// kept in its own node, ordered from newest to oldest, and nodes are only ever
+// linked in, never unlinked.
+//
+// Writers are serialized by a mutex, but readers never lock. A node is fully
+// built before it's atomically linked into the list, so any number of readers,
+// including iterators, can run alongside a single writer.
+type List struct {
+	cmp    kv.Comparator
+	head   *node
+	height int32
+	mu     sync.Mutex
+	rand   *rand.Rand
+	size   int64
+}
+
+// Delete adds a tombstone for the given key.
+func (l *List) Delete(key string) error {
+	return l.Put(kv.DeleteKVPair(key))
+}
+
+// Get returns the newest version of the given key or kv.ErrorNoSuchKey if the
+// key was not found, has been deleted or has expired.
+func (l *List) Get(key string) (*kv.KVPair, error) {
+	pair, err := l.Lookup(key)
+	if err != nil {
+		return nil, err
+	} else if pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	return pair, nil
+}
+
+// Iterator returns a kv.Iterator over every KVPair in the list, including
+// tombstones. It's safe to write to the list while the iterator is in use.
+func (l *List) Iterator() kv.Iterator {
+	return &iterator{list: l}
+}
+
+// Lookup returns the newest version of the given key, including tombstones,
+// or kv.ErrorNoSuchKey if the key was not found.
+func (l *List) Lookup(key string) (*kv.KVPair, error) {
+	n := l.findGreaterOrEqual(key, kv.LatestSeq, nil)
+	if n == nil || n.key != key {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	return n.load(), nil
+}
+
+// Max returns the newest version of the highest key in the list.
+func (l *List) Max() *kv.KVPair {
+	last := l.findLast()
+	if last == nil {
+		return nil
+	}
+
+	return l.findGreaterOrEqual(last.key, kv.LatestSeq, nil).load()
+}
+
+// Min returns the newest version of the lowest key in the list.
+func (l *List) Min() *kv.KVPair {
+	first := l.head.getNext(0)
+	if first == nil {
+		return nil
+	}
+
+	return first.load()
+}
+
+// Pairs returns the contents of the list as an ordered slice of KVPair's.
+// Versions of the same key are ordered from newest to oldest.
+func (l *List) Pairs() []*kv.KVPair {
+	var pairs []*kv.KVPair
+	for n := l.head.getNext(0); n != nil; n = n.getNext(0) {
+		pairs = append(pairs, n.load())
+	}
+
+	return pairs
+}
+
+// Put adds the given KVPair as a version of its key, replacing any version
+// with the same sequence number.
+func (l *List) Put(pair kv.KVPair) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var prev [maxHeight]*node
+	n := l.findGreaterOrEqual(pair.Key, pair.Seq, prev[:])
+	if n != nil && n.key == pair.Key && n.seq == pair.Seq {
+		n.store(&pair)
+		return nil
+	}
+
+	height := l.randomHeight()
+	if current := int(atomic.LoadInt32(&l.height)); height > current {
+		for i := current; i < height; i++ {
+			prev[i] = l.head
+		}
+		atomic.StoreInt32(&l.height, int32(height))
+	}
+
+	// Link from the bottom up so the node is reachable on level 0 first
+	n = newNode(pair, height)
+	for i := 0; i < height; i++ {
+		n.setNext(i, prev[i].getNext(i))
+		prev[i].setNext(i, n)
+	}
+	atomic.AddInt64(&l.size, 1)
+
+	return nil
+}
+
+// Range searches the list and, if possible, returns the newest versions of
+// the two keys which the given key sits between in left to right order (low
+// to high).
+//
+// If the given key is less than the smallest key or greater than the largest
+// key an ErrorOutOfRange error is returned. If the key is equal to the highest
+// or lowest key in the list, nil will be returned in the respective position.
+func (l *List) Range(key string) (*kv.KVPair, *kv.KVPair, error) {
+	min := l.Min()
+	max := l.Max()
+	if min == nil || l.cmp.Compare(key, min.Key) < 0 || l.cmp.Compare(key, max.Key) > 0 {
+		return nil, nil, kv.ErrorOutOfRange
+	}
+
+	var left, right *kv.KVPair
+	if key != min.Key {
+		prev := l.findLess(key, kv.LatestSeq)
+		left = l.findGreaterOrEqual(prev.key, kv.LatestSeq, nil).load()
+	}
+
+	if key != max.Key {
+		right = l.findGreater(key).load()
+	}
+
+	return left, right, nil
+}
+
+// Size returns the number of KVPair's in the list, counting each version of a
+// key.
+func (l *List) Size() int {
+	return int(atomic.LoadInt64(&l.size))
+}
+
+// findGreater returns the first node whose key is higher than the given key,
+// or nil if there's none.
+func (l *List) findGreater(key string) *node {
+	n := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		for next := n.getNext(level); next != nil && l.cmp.Compare(next.key, key) <= 0; next = n.getNext(level) {
+			n = next
+		}
+	}
+
+	return n.getNext(0)
+}
+
+// findGreaterOrEqual returns the first node which doesn't come before the
+// given key and sequence number, or nil if there's none. If prev isn't nil,
+// the last node before that point on each level is stored in it.
+func (l *List) findGreaterOrEqual(key string, seq uint64, prev []*node) *node {
+	n := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		for next := n.getNext(level); next != nil && next.less(key, seq, l.cmp); next = n.getNext(level) {
+			n = next
+		}
+
+		if prev != nil {
+			prev[level] = n
+		}
+	}
+
+	return n.getNext(0)
+}
+
+// findLast returns the last node in the list, or nil if it's empty.
+func (l *List) findLast() *node {
+	n := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		for next := n.getNext(level); next != nil; next = n.getNext(level) {
+			n = next
+		}
+	}
+
+	if n == l.head {
+		return nil
+	}
+
+	return n
+}
+
+// findLess returns the last node which comes before the given key and
+// sequence number, or nil if there's none.
+func (l *List) findLess(key string, seq uint64) *node {
+	n := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		for next := n.getNext(level); next != nil && next.less(key, seq, l.cmp); next = n.getNext(level) {
+			n = next
+		}
+	}
+
+	if n == l.head {
+		return nil
+	}
+
+	return n
+}
+
+// randomHeight returns the number of levels to link a new node on. Each level
+// is used with 1/branching the chance of the one below it.
+func (l *List) randomHeight() int {
+	height := 1
+	for height < maxHeight && l.rand.Intn(branching) == 0 {
+		height++
+	}
+
+	return height
+}
+
+// NewList returns a new, empty List which orders keys by the given
+// Comparator, or bytewise if it's nil.
+func NewList(cmp kv.Comparator) *List {
+	return &List{
+		cmp:    kv.DefaultComparator(cmp),
+		head:   newNode(kv.KVPair{}, maxHeight),
+		height: 1,
+		rand:   rand.New(rand.NewSource(0xdeadbeef)),
+	}
+}
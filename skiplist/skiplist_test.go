@@ -0,0 +1,331 @@
+package skiplist
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+func NewFixedList() *List {
+	list := NewList(nil)
+
+	list.Put(kv.NewKVPair("m", []byte("m")))
+	list.Put(kv.NewKVPair("i", []byte("i")))
+	list.Put(kv.NewKVPair("q", []byte("q")))
+	list.Put(kv.NewKVPair("t", []byte("t")))
+	list.Put(kv.NewKVPair("b", []byte("b")))
+	list.Put(kv.NewKVPair("y", []byte("y")))
+
+	return list
+}
+
+func NewRandomList(size int) (*List, []kv.KVPair) {
+	pairs := helper.NewRandomSortedPairs(size)
+	list := NewList(nil)
+	for _, pair := range helper.ReversePairs(pairs) {
+		list.Put(pair)
+	}
+
+	return list, pairs
+}
+
+func TestListDelete(t *testing.T) {
+	is := is.New(t)
+	list, pairs := NewRandomList(10)
+
+	// Delete the first pair
+	pair := pairs[0]
+	err := list.Delete(pair.Key)
+	is.NoErr(err)
+
+	// No longer found in list
+	_, err = list.Get(pair.Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestListGet(t *testing.T) {
+	is := is.New(t)
+	list, pairs := NewRandomList(10)
+
+	// Get all keys
+	for _, pair := range pairs {
+		result, err := list.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	// Nonexistent key
+	_, err := list.Get("1")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Expired key
+	pair := kv.NewKVPair(pairs[0].Key, pairs[0].Value)
+	pair.Expires = time.Now().Add(-time.Second).UnixNano()
+	is.NoErr(list.Put(pair))
+	_, err = list.Get(pair.Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestListLookup(t *testing.T) {
+	is := is.New(t)
+	list, pairs := NewRandomList(10)
+
+	// Deleted keys are returned as tombstones
+	pair := pairs[0]
+	is.NoErr(list.Delete(pair.Key))
+
+	result, err := list.Lookup(pair.Key)
+	is.NoErr(err)
+	is.True(result.Tombstone)
+
+	// Nonexistent key
+	_, err = list.Lookup("1")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestListMinMax(t *testing.T) {
+	is := is.New(t)
+	list, pairs := NewRandomList(10)
+
+	is.Equal(list.Min().Key, pairs[0].Key)
+	is.Equal(list.Max().Key, pairs[len(pairs)-1].Key)
+
+	// The newest version of the highest key
+	pair := kv.NewKVPair(pairs[len(pairs)-1].Key, []byte("newer"))
+	pair.Seq = 1
+	is.NoErr(list.Put(pair))
+	is.Equal(list.Max().Value, []byte("newer"))
+
+	// Empty list
+	empty := NewList(nil)
+	is.Equal(empty.Min(), nil)
+	is.Equal(empty.Max(), nil)
+}
+
+func TestListRange(t *testing.T) {
+	list := NewFixedList()
+	is := is.New(t)
+
+	// Key is below minimum
+	_, _, err := list.Range("a")
+	is.True(errors.Is(err, kv.ErrorOutOfRange))
+
+	// Key is minimum
+	l, r, err := list.Range("b")
+	is.NoErr(err)
+	is.Equal(l, nil)
+	is.Equal(r.Key, "i")
+
+	// Key in range
+	l, r, err = list.Range("j")
+	is.NoErr(err)
+	is.Equal(l.Key, "i")
+	is.Equal(r.Key, "m")
+
+	// Key in range
+	l, r, err = list.Range("s")
+	is.NoErr(err)
+	is.Equal(l.Key, "q")
+	is.Equal(r.Key, "t")
+
+	// Key is max
+	l, r, err = list.Range("y")
+	is.NoErr(err)
+	is.Equal(l.Key, "t")
+	is.Equal(r, nil)
+
+	// Key is above max
+	_, _, err = list.Range("z")
+	is.True(errors.Is(err, kv.ErrorOutOfRange))
+
+	// Empty list
+	_, _, err = NewList(nil).Range("a")
+	is.True(errors.Is(err, kv.ErrorOutOfRange))
+}
+
+func TestListPairs(t *testing.T) {
+	is := is.New(t)
+	list, pairs := NewRandomList(10)
+
+	result := list.Pairs()
+	is.Equal(len(result), len(pairs))
+	for i, pair := range pairs {
+		is.Equal(*result[i], pair)
+	}
+}
+
+func TestListPut(t *testing.T) {
+	is := is.New(t)
+	list := NewList(nil)
+
+	// Versions are kept from newest to oldest
+	for seq := uint64(1); seq <= 6; seq++ {
+		key := fmt.Sprintf("key%d", seq%2)
+		pair := kv.NewKVPair(key, []byte(fmt.Sprint(seq)))
+		pair.Seq = seq
+		is.NoErr(list.Put(pair))
+	}
+	is.Equal(list.Size(), 6)
+
+	var seqs []uint64
+	for _, pair := range list.Pairs() {
+		seqs = append(seqs, pair.Seq)
+	}
+	is.Equal(seqs, []uint64{6, 4, 2, 5, 3, 1})
+
+	// A version with the same sequence number is replaced
+	pair := kv.NewKVPair("key1", []byte("replaced"))
+	pair.Seq = 5
+	is.NoErr(list.Put(pair))
+	is.Equal(list.Size(), 6)
+
+	result, err := list.Get("key1")
+	is.NoErr(err)
+	is.Equal(result.Value, []byte("replaced"))
+}
+
+func TestListIterator(t *testing.T) {
+	is := is.New(t)
+	list := NewFixedList()
+	list.Delete("q")
+
+	// Every pair in order, including tombstones
+	iterator := list.Iterator()
+	result, err := helper.ReadIterator(iterator, "")
+	is.NoErr(err)
+	is.Equal(len(result), list.Size())
+	for i, pair := range list.Pairs() {
+		is.Equal(result[i], *pair)
+	}
+	is.True(result[3].Tombstone)
+
+	// Seek to an existing key
+	is.NoErr(iterator.Seek("m"))
+	is.Equal(iterator.Key(), "m")
+	is.Equal(iterator.Value(), []byte("m"))
+
+	// Seek between keys
+	is.NoErr(iterator.Seek("c"))
+	is.Equal(iterator.Key(), "i")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "m")
+
+	// Seek past the end
+	is.NoErr(iterator.Seek("z"))
+	is.True(!iterator.Valid())
+
+	// Every pair in reverse order
+	reverse, err := helper.ReadIteratorReverse(iterator)
+	is.NoErr(err)
+	is.Equal(reverse, helper.ReversePairs(result))
+
+	// Empty list
+	result, err = helper.ReadIterator(NewList(nil).Iterator(), "")
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
+
+func TestListComparator(t *testing.T) {
+	is := is.New(t)
+	list := NewList(mock.ReverseComparator{})
+	for _, key := range []string{"c", "a", "e", "b", "d"} {
+		list.Put(kv.NewKVPair(key, []byte(key)))
+	}
+
+	// Versions of a key stay ordered from newest to oldest
+	pair := kv.NewKVPair("c", []byte("c2"))
+	pair.Seq = 1
+	list.Put(pair)
+
+	// Pairs are ordered by the comparator
+	var keys []string
+	for _, pair := range list.Pairs() {
+		keys = append(keys, pair.Key)
+	}
+	is.Equal(keys, []string{"e", "d", "c", "c", "b", "a"})
+	is.Equal(list.Min().Key, "e")
+	is.Equal(list.Max().Key, "a")
+
+	result, err := list.Get("c")
+	is.NoErr(err)
+	is.Equal(result.Value, []byte("c2"))
+
+	l, r, err := list.Range("c")
+	is.NoErr(err)
+	is.Equal(l.Key, "d")
+	is.Equal(r.Key, "b")
+
+	_, _, err = list.Range("0")
+	is.True(errors.Is(err, kv.ErrorOutOfRange))
+
+	// Iterators seek and move in the same order
+	iterator := list.Iterator()
+	is.NoErr(iterator.Seek("cc"))
+	is.Equal(iterator.Key(), "c")
+	is.NoErr(iterator.Prev())
+	is.Equal(iterator.Key(), "d")
+}
+
+func TestListConcurrent(t *testing.T) {
+	size := 1000
+	readers := 4
+	is := is.New(t)
+	list := NewList(nil)
+
+	// Readers walk the list while a single writer fills it
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, readers)
+	for r := 0; r < readers; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// Whatever is visible must always be in order
+				pairs, err := helper.ReadIterator(list.Iterator(), "")
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				for i := 1; i < len(pairs); i++ {
+					if pairs[i-1].Key >= pairs[i].Key {
+						errs <- fmt.Errorf("%s before %s", pairs[i-1].Key, pairs[i].Key)
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < size; i++ {
+		key := fmt.Sprintf("key%04d", (i*7)%size)
+		is.NoErr(list.Put(kv.NewKVPair(key, []byte(key))))
+
+		if _, err := list.Get(key); err != nil {
+			is.NoErr(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		is.NoErr(err)
+	}
+	is.Equal(list.Size(), size)
+}
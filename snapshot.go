@@ -0,0 +1,60 @@
+package kv
+
+import (
+	"math"
+	"sync"
+)
+
+// LatestSeq is the highest possible sequence number. Reading at LatestSeq
+// always sees the newest version of every key.
+const LatestSeq uint64 = math.MaxUint64
+
+// SnapshotList tracks the sequence numbers which open snapshots are pinned to
+// so that compaction knows which versions of a key must be kept. The same
+// sequence number may be acquired more than once and is held until it has
+// been released as many times.
+//
+// A SnapshotList is safe for concurrent use.
+type SnapshotList struct {
+	mu   sync.Mutex
+	seqs map[uint64]int
+}
+
+// Acquire pins the given sequence number.
+func (s *SnapshotList) Acquire(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seqs == nil {
+		s.seqs = map[uint64]int{}
+	}
+	s.seqs[seq]++
+}
+
+// Oldest returns the lowest pinned sequence number, or LatestSeq if nothing is
+// pinned.
+func (s *SnapshotList) Oldest() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldest := LatestSeq
+	for seq := range s.seqs {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+
+	return oldest
+}
+
+// Release unpins the given sequence number.
+func (s *SnapshotList) Release(seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.seqs[seq] <= 1 {
+		delete(s.seqs, seq)
+		return
+	}
+	s.seqs[seq]--
+}
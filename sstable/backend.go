@@ -1,46 +1,99 @@
 package sstable
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/jmgilman/kv"
 	"github.com/spf13/afero"
 )
 
+// tempSuffix is appended to the path of a segment file while it's written.
+const tempSuffix = ".tmp"
+
 // SegmentBackend implements kv.SegmentBackend by providing persistent storage
 // for Segment's using SSTable's stored on the local filesystem.
 type SegmentBackend struct {
+	bitsPerKey   int
+	blockSize    int
+	cmp          kv.Comparator
+	compressor   Compressor
 	encoder      kv.Encoder
 	fs           afero.Fs
-	indexFactor  int
 	storeFactory kv.MemoryStoreFactory
 	root         string
 }
 
-// Get returns the segment with the given SegmentID.
-func (s *SegmentBackend) Get(id kv.SegmentID) (Segment, error) {
+// Delete removes the segment file with the given SegmentID. Returns
+// kv.ErrorSegmentNotFound if the segment file doesn't exist.
+func (s *SegmentBackend) Delete(id kv.SegmentID) error {
+	filePath := path.Join(s.root, s.getFileName(id))
+	if err := s.fs.Remove(filePath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return kv.ErrorSegmentNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Get returns the segment with the given SegmentID after validating its
+// footer. Returns kv.ErrorSegmentNotFound if the segment file doesn't exist,
+// ErrorUnknownFormat if it was written in an unknown format version and
+// ErrorEncoderMismatch if it was written with a different encoder.
+func (s *SegmentBackend) Get(id kv.SegmentID) (kv.Segment, error) {
 	// Open segment file
 	filePath := path.Join(s.root, s.getFileName(id))
 	file, err := s.fs.Open(filePath)
 	if err != nil {
-		return Segment{}, err
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, kv.ErrorSegmentNotFound
+		}
+		return nil, err
 	}
 
 	// Create new segment
 	stat, err := file.Stat()
 	if err != nil {
-		return Segment{}, err
+		return nil, err
+	}
+	segment := NewSegment(file, s.encoder, s.storeFactory(), int(stat.Size()), s.cmp)
+	segment.id = id
+
+	// Load and validate footer and index table
+	if err := segment.LoadIndex(); err != nil {
+		file.Close()
+		return nil, err
 	}
-	segment := NewSegment(file, s.encoder, s.storeFactory(), int(stat.Size()))
 
-	// Load index table
-	err = segment.LoadIndex()
+	return &segment, nil
+}
+
+// clean removes temporary segment files left behind by writes which were
+// interrupted by a crash.
+func (s *SegmentBackend) clean() error {
+	if err := s.fs.MkdirAll(s.root, 0755); err != nil {
+		return err
+	}
+
+	infos, err := afero.ReadDir(s.fs, s.root)
 	if err != nil {
-		return Segment{}, err
+		return err
 	}
 
-	return segment, nil
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), tempSuffix) {
+			if err := s.fs.Remove(path.Join(s.root, info.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 // getFileName returns the format in which Segment's are stored by id on the
@@ -57,10 +110,12 @@ func (s *SegmentBackend) New(id kv.SegmentID, store kv.MemoryStore) error {
 		return err
 	}
 
-	// Write contents of MemoryStore
+	// Write contents of MemoryStore, which is discarded by Close if a write
+	// fails
 	for _, pair := range store.Pairs() {
 		_, err := writer.Write(*pair)
 		if err != nil {
+			writer.Close()
 			return err
 		}
 	}
@@ -70,23 +125,87 @@ func (s *SegmentBackend) New(id kv.SegmentID, store kv.MemoryStore) error {
 }
 
 // NewWriter creates a new segment and returns it wrapped in a SegmentWriter.
+// The segment is written to a temporary file which is only moved into place
+// once the writer is closed, and which is removed if the segment can't be
+// completed.
 func (s *SegmentBackend) NewWriter(id kv.SegmentID) (kv.SegmentWriter, error) {
 	// Create new file
+	if err := s.fs.MkdirAll(s.root, 0755); err != nil {
+		return nil, err
+	}
+
 	filePath := path.Join(s.root, s.getFileName(id))
-	file, err := s.fs.Create(filePath)
+	file, err := s.fs.Create(filePath + tempSuffix)
 	if err != nil {
-		return &SegmentWriter{}, err
+		return nil, err
 	}
 
-	writer := NewSegmentWriter(id, file, s.encoder, s.storeFactory(), s.indexFactor)
+	atomic := &atomicFile{File: file, fs: s.fs, path: filePath}
+	writer := NewBlockWriter(id, atomic, s.encoder, s.compressor, s.blockSize, s.bitsPerKey)
 	return &writer, nil
 }
 
-func NewSegmentBackend(root string, encoder kv.Encoder, indexFactor int, storeFactory kv.MemoryStoreFactory) SegmentBackend {
+// atomicFile wraps a file being written to a temporary path and renames it to
+// its final path when closed so that it only appears once it's complete. The
+// temporary file is removed if it can't be moved into place.
+type atomicFile struct {
+	afero.File
+	fs   afero.Fs
+	path string
+}
+
+func (a *atomicFile) Close() error {
+	if err := a.File.Sync(); err != nil {
+		a.abort()
+		return err
+	}
+
+	if err := a.File.Close(); err != nil {
+		a.fs.Remove(a.File.Name())
+		return err
+	}
+
+	if err := a.fs.Rename(a.File.Name(), a.path); err != nil {
+		a.fs.Remove(a.File.Name())
+		return err
+	}
+
+	return nil
+}
+
+// abort closes and removes the temporary file without moving it into place.
+func (a *atomicFile) abort() error {
+	a.File.Close()
+	return a.fs.Remove(a.File.Name())
+}
+
+// OpenSegmentBackend works like NewSegmentBackend but also creates the given
+// directory and removes any temporary segment files left in it by writes which
+// were interrupted by a crash. It must be called before anything else uses
+// the directory.
+func OpenSegmentBackend(root string, encoder kv.Encoder, compressor Compressor, blockSize int, bitsPerKey int, storeFactory kv.MemoryStoreFactory, cmp kv.Comparator) (SegmentBackend, error) {
+	backend := NewSegmentBackend(root, encoder, compressor, blockSize, bitsPerKey, storeFactory, cmp)
+	if err := backend.clean(); err != nil {
+		return SegmentBackend{}, err
+	}
+
+	return backend, nil
+}
+
+// NewSegmentBackend returns a new SegmentBackend which stores segments in the
+// given directory. New segments are written in FormatV4 using blocks of
+// roughly blockSize bytes compressed by the given Compressor and bitsPerKey
+// bits for each key in their Bloom filter. Segments compressed with any codec
+// can be read. Keys are ordered by the given Comparator, or bytewise if it's
+// nil, which must match the order of the MemoryStore's the factory creates.
+func NewSegmentBackend(root string, encoder kv.Encoder, compressor Compressor, blockSize int, bitsPerKey int, storeFactory kv.MemoryStoreFactory, cmp kv.Comparator) SegmentBackend {
 	return SegmentBackend{
+		bitsPerKey:   bitsPerKey,
+		blockSize:    blockSize,
+		cmp:          cmp,
+		compressor:   compressor,
 		encoder:      encoder,
 		fs:           afero.NewOsFs(),
-		indexFactor:  indexFactor,
 		storeFactory: storeFactory,
 		root:         root,
 	}
@@ -1,36 +1,159 @@
 package sstable
 
 import (
+	"errors"
 	"fmt"
+	"os"
 	"testing"
 
 	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/encoders"
 	"github.com/jmgilman/kv/mock"
 	"github.com/jmgilman/kv/mock/helper"
 	"github.com/matryer/is"
 	"github.com/spf13/afero"
 )
 
-func NewMockSegmentBackend(indexFactor int) SegmentBackend {
+func NewMockSegmentBackend(blockSize int) SegmentBackend {
 	factory := func() kv.MemoryStore {
 		return &mock.MockMemoryStore{}
 	}
 	return SegmentBackend{
+		blockSize:    blockSize,
+		compressor:   NoneCompressor{},
 		encoder:      &mock.MockEncoder{},
-		indexFactor:  indexFactor,
 		fs:           afero.NewMemMapFs(),
 		root:         "test",
 		storeFactory: factory,
 	}
 }
 
+// failingFs is an afero.Fs whose files fail to be written or synced.
+type failingFs struct {
+	afero.Fs
+	failSync  bool
+	failWrite bool
+	open      *int
+}
+
+func (f failingFs) Create(name string) (afero.File, error) {
+	file, err := f.Fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+
+	*f.open++
+	return &failingFile{File: file, fs: f}, nil
+}
+
+type failingFile struct {
+	afero.File
+	closed bool
+	fs     failingFs
+}
+
+func (f *failingFile) Close() error {
+	if !f.closed {
+		f.closed = true
+		*f.fs.open--
+	}
+	return f.File.Close()
+}
+
+func (f *failingFile) Sync() error {
+	if f.fs.failSync {
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if f.fs.failWrite {
+		return 0, errors.New("disk full")
+	}
+	return f.File.Write(p)
+}
+
+func TestSegmentBackendClean(t *testing.T) {
+	is := is.New(t)
+	backend := NewMockSegmentBackend(32)
+
+	// Leftovers of an interrupted write sit next to a complete segment
+	store := helper.NewRandomMemoryStore(10)
+	id := kv.NewSegmentID()
+	is.NoErr(backend.New(id, &store))
+
+	leftover := fmt.Sprintf("test/segment-%s.dat.tmp", kv.NewSegmentID().String())
+	is.NoErr(afero.WriteFile(backend.fs, leftover, []byte("partial"), 0644))
+
+	// Only the leftovers are removed
+	is.NoErr(backend.clean())
+	_, err := backend.fs.Stat(leftover)
+	is.True(errors.Is(err, os.ErrNotExist))
+
+	_, err = backend.Get(id)
+	is.NoErr(err)
+
+	// A missing directory is created
+	backend.root = "missing"
+	is.NoErr(backend.clean())
+	_, err = backend.fs.Stat("missing")
+	is.NoErr(err)
+}
+
+func TestSegmentBackendWriteError(t *testing.T) {
+	for _, name := range []string{"write", "sync"} {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			open := 0
+			backend := NewMockSegmentBackend(32)
+			backend.fs = failingFs{Fs: backend.fs, failSync: name == "sync", failWrite: name == "write", open: &open}
+
+			// The segment is discarded along with its temporary file
+			store := helper.NewRandomMemoryStore(10)
+			id := kv.NewSegmentID()
+			is.True(backend.New(id, &store) != nil)
+			is.Equal(open, 0)
+
+			infos, err := afero.ReadDir(backend.fs, "test")
+			is.NoErr(err)
+			is.Equal(len(infos), 0)
+
+			_, err = backend.Get(id)
+			is.True(errors.Is(err, kv.ErrorSegmentNotFound))
+		})
+	}
+}
+
+func TestSegmentBackendDelete(t *testing.T) {
+	size := 10
+	blockSize := 32
+	is := is.New(t)
+	backend := NewMockSegmentBackend(blockSize)
+
+	// Create segment
+	store := helper.NewRandomMemoryStore(size)
+	id := kv.NewSegmentID()
+	is.NoErr(backend.New(id, &store))
+
+	// Segment file is removed
+	is.NoErr(backend.Delete(id))
+	_, err := backend.Get(id)
+	is.True(errors.Is(err, kv.ErrorSegmentNotFound))
+
+	// Nonexistent segment
+	err = backend.Delete(id)
+	is.True(errors.Is(err, kv.ErrorSegmentNotFound))
+}
+
 func TestSegmentBackendGet(t *testing.T) {
 	size := 10
+	blockSize := 32
 	factor := 3
 	is := is.New(t)
 	id := kv.NewSegmentID()
 	filePath := fmt.Sprintf("test/segment-%s.dat", id.String())
-	backend := NewMockSegmentBackend(factor)
+	backend := NewMockSegmentBackend(blockSize)
 
 	// Create test file
 	file, err := backend.fs.Create(filePath)
@@ -46,6 +169,10 @@ func TestSegmentBackendGet(t *testing.T) {
 	backend.encoder = &encoder
 	_, err = backend.Get(id)
 	is.NoErr(err)
+
+	// Nonexistent segment
+	_, err = backend.Get(kv.NewSegmentID())
+	is.True(errors.Is(err, kv.ErrorSegmentNotFound))
 }
 
 func TestSegmentBackendgetFileName(t *testing.T) {
@@ -59,9 +186,9 @@ func TestSegmentBackendgetFileName(t *testing.T) {
 
 func TestSegmentBackendNew(t *testing.T) {
 	size := 10
-	factor := 3
+	blockSize := 32
 	is := is.New(t)
-	backend := NewMockSegmentBackend(factor)
+	backend := NewMockSegmentBackend(blockSize)
 
 	// Create random memory store
 	store := helper.NewRandomMemoryStore(size)
@@ -73,23 +200,25 @@ func TestSegmentBackendNew(t *testing.T) {
 
 	// Verify correct file exists
 	filePath := fmt.Sprintf("test/segment-%s.dat", id.String())
-	s, err := backend.fs.Stat(filePath)
+	_, err = backend.fs.Stat(filePath)
 	is.NoErr(err)
 
-	// Verify file size
-	entrySize := 4
-	dataSize := size * entrySize
-	tableSize := ((size / factor) + 2) * entrySize
-	is.Equal(s.Size(), int64(dataSize+tableSize+4))
+	// Verify contents
+	segment, err := backend.Get(id)
+	is.NoErr(err)
+	for _, pair := range store.Pairs() {
+		_, err := segment.Lookup(pair.Key)
+		is.NoErr(err)
+	}
 }
 
 func TestSegmentBackendNewWriter(t *testing.T) {
 	size := 10
-	factor := 3
+	blockSize := 32
 	is := is.New(t)
 	id := kv.NewSegmentID()
 	filePath := fmt.Sprintf("test/segment-%s.dat", id.String())
-	backend := NewMockSegmentBackend(factor)
+	backend := NewMockSegmentBackend(blockSize)
 
 	// Create file and write test data
 	pairs := helper.NewRandomSortedPairs(size)
@@ -98,16 +227,118 @@ func TestSegmentBackendNewWriter(t *testing.T) {
 
 	_, err = result.WriteAll(pairs)
 	is.NoErr(err)
+
+	// File doesn't exist until the writer is closed
+	_, err = backend.fs.Stat(filePath)
+	is.True(errors.Is(err, os.ErrNotExist))
+
 	err = result.Close()
 	is.NoErr(err)
 
 	// Verify correct file exists
-	s, err := backend.fs.Stat(filePath)
+	_, err = backend.fs.Stat(filePath)
+	is.NoErr(err)
+
+	// Segment is written in blocks
+	segment, err := backend.Get(id)
+	is.NoErr(err)
+	is.Equal(segment.(*Segment).footer.Version, FormatV4)
+	is.True(len(segment.(*Segment).blocks) > 1)
+}
+
+func TestSegmentBackendCursor(t *testing.T) {
+	size := 10
+	blockSize := 32
+	is := is.New(t)
+	backend := NewMockSegmentBackend(blockSize)
+
+	// Write and reopen a segment
+	store := helper.NewRandomMemoryStore(size)
+	id := kv.NewSegmentID()
+	is.NoErr(backend.New(id, &store))
+
+	segment, err := backend.Get(id)
+	is.NoErr(err)
+
+	// Cursor returns only the stored pairs and not the index table
+	cursor, err := segment.Cursor()
+	is.NoErr(err)
+
+	result, err := cursor.ReadToEnd()
+	is.NoErr(err)
+	is.Equal(len(result), size)
+	for i, pair := range store.Pairs() {
+		is.Equal(result[i].Key, pair.Key)
+	}
+
+	// Size is the size of the whole segment file
+	s, err := backend.fs.Stat(fmt.Sprintf("test/segment-%s.dat", id.String()))
 	is.NoErr(err)
+	is.Equal(int64(segment.Size()), s.Size())
+}
+
+func TestSegmentBackendFilter(t *testing.T) {
+	size := 100
+	blockSize := 32
+	is := is.New(t)
+	backend := NewMockSegmentBackend(blockSize)
+	backend.bitsPerKey = 10
+
+	// Write and reopen a segment
+	store := helper.NewRandomMemoryStore(size)
+	id := kv.NewSegmentID()
+	is.NoErr(backend.New(id, &store))
+
+	result, err := backend.Get(id)
+	is.NoErr(err)
+	segment := result.(*Segment)
+	is.True(segment.filter != nil)
+
+	// Every stored key is found
+	for _, pair := range store.Pairs() {
+		found, err := segment.Lookup(pair.Key)
+		is.NoErr(err)
+		is.Equal(found.Key, pair.Key)
+	}
+
+	// Keys ruled out by the filter are never read from the data
+	segment.data = nil
+	for i := 0; i < size; i++ {
+		key := fmt.Sprintf("missing%d", i)
+		if !segment.filter.mayContain(key) {
+			_, err := segment.Get(key)
+			is.True(errors.Is(err, kv.ErrorNoSuchKey))
+		}
+	}
+}
+
+func TestSegmentBackendCodecs(t *testing.T) {
+	size := 50
+	blockSize := 256
+	is := is.New(t)
+	backend := NewMockSegmentBackend(blockSize)
+	backend.encoder = encoders.NewByteEncoder()
 
-	// Verify file size
-	entrySize := 4
-	dataSize := size * entrySize
-	tableSize := ((size / factor) + 2) * entrySize
-	is.Equal(s.Size(), int64(dataSize+tableSize+4))
+	// Write a segment with each codec to the same backend
+	var ids []kv.SegmentID
+	for _, compressor := range NewTestCompressors() {
+		backend.compressor = compressor
+		store := mock.NewMockMemoryStore(NewJSONPairs(size))
+		id := kv.NewSegmentID()
+		is.NoErr(backend.New(id, &store))
+
+		ids = append(ids, id)
+	}
+
+	// Every segment is readable regardless of the backend's compressor
+	for _, id := range ids {
+		segment, err := backend.Get(id)
+		is.NoErr(err)
+
+		for _, pair := range NewJSONPairs(size) {
+			result, err := segment.Get(pair.Key)
+			is.NoErr(err)
+			is.Equal(result.Value, pair.Value)
+		}
+	}
 }
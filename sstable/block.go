@@ -0,0 +1,332 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+
+	"github.com/jmgilman/kv"
+)
+
+var ErrorInvalidBlock = errors.New("invalid block")
+
+// restartInterval is the number of entries between restart points in a block.
+const restartInterval = 16
+
+// A block groups consecutive KVPair's of a segment. Each entry only stores the
+// part of its key which differs from the key before it:
+//
+//	[uvarint shared][uvarint unshared][uvarint value size][uvarint seq]
+//	[uvarint expires][byte tombstone][unshared key bytes][value bytes]
+//
+// The seq field is only present in blocks written in FormatV3 or later and the
+// expires field in blocks written in FormatV4 or later.
+//
+// Every restartInterval entries the full key is stored and the offset of that
+// entry is recorded as a restart point. The block ends with the offset of each
+// restart point followed by the number of restart points, all as uint32's,
+// which allows the block to be binary searched.
+
+// blockBuilder builds a single block from KVPair's added in key order.
+type blockBuilder struct {
+	buf      []byte
+	count    int
+	lastKey  string
+	restarts []uint32
+}
+
+// add appends the given pair to the block and returns the number of bytes it
+// took up.
+func (b *blockBuilder) add(pair kv.KVPair) int {
+	start := len(b.buf)
+
+	shared := 0
+	if b.count%restartInterval == 0 {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+	} else {
+		shared = sharedPrefix(b.lastKey, pair.Key)
+	}
+
+	var tombstone byte
+	if pair.Tombstone {
+		tombstone = 1
+	}
+
+	header := make([]byte, binary.MaxVarintLen64*5+1)
+	n := binary.PutUvarint(header, uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(pair.Key)-shared))
+	n += binary.PutUvarint(header[n:], uint64(len(pair.Value)))
+	n += binary.PutUvarint(header[n:], pair.Seq)
+	n += binary.PutUvarint(header[n:], uint64(pair.Expires))
+	header[n] = tombstone
+
+	b.buf = append(b.buf, header[:n+1]...)
+	b.buf = append(b.buf, pair.Key[shared:]...)
+	b.buf = append(b.buf, pair.Value...)
+
+	b.count++
+	b.lastKey = pair.Key
+
+	return len(b.buf) - start
+}
+
+// empty returns true if no pairs have been added to the block.
+func (b *blockBuilder) empty() bool {
+	return b.count == 0
+}
+
+// finish returns the encoded block and resets the builder.
+func (b *blockBuilder) finish() []byte {
+	data := make([]byte, len(b.buf)+len(b.restarts)*4+4)
+	n := copy(data, b.buf)
+	for _, restart := range b.restarts {
+		binary.BigEndian.PutUint32(data[n:], restart)
+		n += 4
+	}
+	binary.BigEndian.PutUint32(data[n:], uint32(len(b.restarts)))
+
+	*b = blockBuilder{}
+	return data
+}
+
+// size returns the current size of the block, excluding restart points.
+func (b *blockBuilder) size() int {
+	return len(b.buf)
+}
+
+// block provides read access to an encoded block. Entries only hold sequence
+// numbers if sequenced is set and expiry times if expiring is set.
+type block struct {
+	data      []byte
+	expiring  bool
+	restarts  []uint32
+	sequenced bool
+}
+
+// entries decodes every pair stored in the block.
+func (b *block) entries() ([]kv.KVPair, error) {
+	var pairs []kv.KVPair
+	var key string
+	offset := 0
+	for offset < len(b.data) {
+		pair, next, err := b.decode(offset, key)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, pair)
+		key = pair.Key
+		offset = next
+	}
+
+	return pairs, nil
+}
+
+// decode decodes the entry at the given offset using the key of the entry
+// before it. Returns the pair and the offset of the next entry.
+func (b *block) decode(offset int, prevKey string) (kv.KVPair, int, error) {
+	var header [5]uint64
+	fields := 3
+	if b.expiring {
+		fields = 5
+	} else if b.sequenced {
+		fields = 4
+	}
+
+	for i := range header[:fields] {
+		value, n := binary.Uvarint(b.data[offset:])
+		if n <= 0 {
+			return kv.KVPair{}, 0, ErrorInvalidBlock
+		}
+
+		header[i] = value
+		offset += n
+	}
+	shared, unshared, valueSize, seq, expires := int(header[0]), int(header[1]), int(header[2]), header[3], int64(header[4])
+
+	if shared > len(prevKey) || offset+1+unshared+valueSize > len(b.data) {
+		return kv.KVPair{}, 0, ErrorInvalidBlock
+	}
+
+	tombstone := b.data[offset] == 1
+	offset++
+
+	key := prevKey[:shared] + string(b.data[offset:offset+unshared])
+	offset += unshared
+
+	value := make([]byte, valueSize)
+	copy(value, b.data[offset:offset+valueSize])
+	offset += valueSize
+
+	return kv.KVPair{Expires: expires, Key: key, Seq: seq, Tombstone: tombstone, Value: value}, offset, nil
+}
+
+// search binary searches the restart points of the block for the last one
+// whose key is lower than the given key, or the first one if there's none, and
+// then scans forward from it so that the newest version of the key is found
+// first. Returns kv.ErrorNoSuchKey if the key isn't in the block.
+func (b *block) search(key string, cmp kv.Comparator) (*kv.KVPair, error) {
+	var err error
+	i := sort.Search(len(b.restarts), func(i int) bool {
+		var pair kv.KVPair
+		if err != nil {
+			return true
+		}
+
+		pair, _, err = b.decode(int(b.restarts[i]), "")
+		return cmp.Compare(pair.Key, key) >= 0
+	})
+	if err != nil {
+		return nil, err
+	} else if i == 0 {
+		i = 1
+	}
+
+	offset := int(b.restarts[i-1])
+	var prevKey string
+	for offset < len(b.data) {
+		pair, next, err := b.decode(offset, prevKey)
+		if err != nil {
+			return nil, err
+		}
+
+		if c := cmp.Compare(pair.Key, key); c == 0 {
+			return &pair, nil
+		} else if c > 0 {
+			break
+		}
+
+		prevKey = pair.Key
+		offset = next
+	}
+
+	return nil, kv.ErrorNoSuchKey
+}
+
+// decodeBlock parses an encoded block written in the given format version.
+func decodeBlock(data []byte, version uint32) (*block, error) {
+	if len(data) < 4 {
+		return nil, ErrorInvalidBlock
+	}
+
+	count := int(binary.BigEndian.Uint32(data[len(data)-4:]))
+	end := len(data) - 4 - count*4
+	if count == 0 || end < 0 {
+		return nil, ErrorInvalidBlock
+	}
+
+	restarts := make([]uint32, count)
+	for i := range restarts {
+		restarts[i] = binary.BigEndian.Uint32(data[end+i*4:])
+		if int(restarts[i]) >= end {
+			return nil, ErrorInvalidBlock
+		}
+	}
+
+	return &block{
+		data:      data[:end],
+		expiring:  version >= FormatV4,
+		restarts:  restarts,
+		sequenced: version >= FormatV3,
+	}, nil
+}
+
+// blockHandle locates a block within a segment's data.
+type blockHandle struct {
+	lastKey string
+	offset  int
+	size    int
+}
+
+// encode returns the handle's offset and size as an index table value.
+func (b blockHandle) encode() []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf[0:4], uint32(b.offset))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(b.size))
+	return buf
+}
+
+// decodeBlockHandle decodes a blockHandle from an index table entry.
+func decodeBlockHandle(pair kv.KVPair) (blockHandle, error) {
+	if len(pair.Value) != 8 {
+		return blockHandle{}, ErrorInvalidBlock
+	}
+
+	return blockHandle{
+		lastKey: pair.Key,
+		offset:  int(binary.BigEndian.Uint32(pair.Value[0:4])),
+		size:    int(binary.BigEndian.Uint32(pair.Value[4:8])),
+	}, nil
+}
+
+// blockCursor implements kv.Cursor over every pair in a block formatted
+// segment, reading one block at a time.
+type blockCursor struct {
+	block   int
+	done    bool
+	pairs   []kv.KVPair
+	segment *Segment
+}
+
+func (b *blockCursor) Done() bool {
+	return b.done
+}
+
+func (b *blockCursor) Next() (kv.KVPair, error) {
+	for len(b.pairs) == 0 {
+		if b.block >= len(b.segment.blocks) {
+			b.done = true
+			return kv.KVPair{}, io.EOF
+		}
+
+		block, err := b.segment.readBlock(b.segment.blocks[b.block])
+		if err != nil {
+			return kv.KVPair{}, err
+		}
+
+		b.pairs, err = block.entries()
+		if err != nil {
+			return kv.KVPair{}, err
+		}
+		b.block++
+	}
+
+	pair := b.pairs[0]
+	b.pairs = b.pairs[1:]
+	return pair, nil
+}
+
+func (b *blockCursor) ReadToEnd() ([]kv.KVPair, error) {
+	var pairs []kv.KVPair
+	for {
+		pair, err := b.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, nil
+}
+
+func (b *blockCursor) Reset() error {
+	b.block = 0
+	b.done = false
+	b.pairs = nil
+	return nil
+}
+
+// sharedPrefix returns the length of the prefix shared by two keys.
+func sharedPrefix(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+
+	return n
+}
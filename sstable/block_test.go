@@ -0,0 +1,150 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/matryer/is"
+)
+
+func NewTestBlock(size int) ([]kv.KVPair, []byte) {
+	var pairs []kv.KVPair
+	builder := blockBuilder{}
+	for i := 0; i < size; i++ {
+		pair := kv.NewKVPair(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i)))
+		if i%10 == 0 {
+			pair = kv.DeleteKVPair(pair.Key)
+		}
+
+		builder.add(pair)
+		pairs = append(pairs, pair)
+	}
+
+	return pairs, builder.finish()
+}
+
+func TestBlockBuilder(t *testing.T) {
+	size := 100
+	is := is.New(t)
+
+	pairs, data := NewTestBlock(size)
+	block, err := decodeBlock(data, FormatV4)
+	is.NoErr(err)
+
+	// A restart point is recorded every restartInterval entries
+	is.Equal(len(block.restarts), (size+restartInterval-1)/restartInterval)
+
+	// Shared prefixes are only stored once
+	var keySize int
+	for _, pair := range pairs {
+		keySize += len(pair.Key)
+	}
+	is.True(len(block.data) < keySize+size*len("value00"))
+
+	// All entries are decoded
+	entries, err := block.entries()
+	is.NoErr(err)
+	is.Equal(len(entries), size)
+	for i := range pairs {
+		is.Equal(entries[i].Key, pairs[i].Key)
+		is.Equal(entries[i].Tombstone, pairs[i].Tombstone)
+		is.Equal(entries[i].Value, pairs[i].Value)
+	}
+
+	// Builder is reset after finishing
+	builder := blockBuilder{}
+	builder.add(pairs[0])
+	builder.finish()
+	is.True(builder.empty())
+}
+
+func TestBlockSearch(t *testing.T) {
+	size := 100
+	is := is.New(t)
+
+	pairs, data := NewTestBlock(size)
+	block, err := decodeBlock(data, FormatV4)
+	is.NoErr(err)
+
+	// Every key is found
+	for _, pair := range pairs {
+		result, err := block.search(pair.Key, kv.BytewiseComparator{})
+		is.NoErr(err)
+		is.Equal(result.Key, pair.Key)
+		is.Equal(result.Tombstone, pair.Tombstone)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	// Missing keys before, between and after entries
+	for _, key := range []string{"a", "key0010a", "key9999"} {
+		_, err := block.search(key, kv.BytewiseComparator{})
+		is.Equal(err, kv.ErrorNoSuchKey)
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	is := is.New(t)
+
+	_, err := decodeBlock([]byte{0, 0}, FormatV3)
+	is.Equal(err, ErrorInvalidBlock)
+
+	// No restart points
+	_, err = decodeBlock([]byte{0, 0, 0, 0}, FormatV3)
+	is.Equal(err, ErrorInvalidBlock)
+
+	// Restart point past the end of the entries
+	_, err = decodeBlock([]byte{1, 0, 0, 0, 9, 0, 0, 0, 1}, FormatV3)
+	is.Equal(err, ErrorInvalidBlock)
+}
+
+func TestBlockSearchVersions(t *testing.T) {
+	is := is.New(t)
+
+	// Versions of the same key straddle a restart point
+	builder := blockBuilder{}
+	builder.add(kv.NewKVPair("a", []byte("a")))
+	for seq := restartInterval + 5; seq > 0; seq-- {
+		pair := kv.NewKVPair("b", []byte(fmt.Sprint(seq)))
+		pair.Seq = uint64(seq)
+		builder.add(pair)
+	}
+
+	block, err := decodeBlock(builder.finish(), FormatV4)
+	is.NoErr(err)
+	is.True(len(block.restarts) > 1)
+
+	// The newest version is found
+	result, err := block.search("b", kv.BytewiseComparator{})
+	is.NoErr(err)
+	is.Equal(result.Seq, uint64(restartInterval+5))
+
+	// Sequence numbers are decoded
+	entries, err := block.entries()
+	is.NoErr(err)
+	is.Equal(entries[len(entries)-1].Seq, uint64(1))
+}
+
+func TestBlockExpires(t *testing.T) {
+	is := is.New(t)
+
+	builder := blockBuilder{}
+	expiring := kv.NewKVPair("a", []byte("a"))
+	expiring.Expires = 1000
+	expiring.Seq = 2
+	builder.add(expiring)
+	builder.add(kv.NewKVPair("b", []byte("b")))
+
+	// Expiry times are decoded
+	block, err := decodeBlock(builder.finish(), FormatV4)
+	is.NoErr(err)
+
+	entries, err := block.entries()
+	is.NoErr(err)
+	is.Equal(entries[0], expiring)
+	is.Equal(entries[1].Expires, int64(0))
+
+	result, err := block.search("a", kv.BytewiseComparator{})
+	is.NoErr(err)
+	is.Equal(result.Expires, int64(1000))
+}
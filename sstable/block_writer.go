@@ -0,0 +1,177 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/jmgilman/kv"
+)
+
+// BlockWriter implements kv.SegmentWriter for writing FormatV4 SSTable
+// segments to an underlying stream. Written KVPair's are grouped into blocks
+// of roughly blockSize bytes with prefix compressed keys, each of which is
+// compressed by the given Compressor, and the index table holds the last key
+// of each block along with its position.
+type BlockWriter struct {
+	bitsPerKey int
+	block      blockBuilder
+	blockSize  int
+	compressor Compressor
+	encoder    kv.Encoder
+	err        error
+	footer     Footer
+	hashes     []uint64
+	id         kv.SegmentID
+	index      []blockHandle
+	offset     int
+	writer     io.WriteCloser
+}
+
+// Close writes the last block, the index table and the Bloom filter of written
+// keys to the underlying stream, followed by the segment footer, before
+// calling Close() on the underlying stream. If anything fails, including an
+// earlier write, the segment is discarded instead and the error is returned.
+func (b *BlockWriter) Close() error {
+	if err := b.finish(); err != nil {
+		b.discard()
+		return err
+	}
+
+	return b.writer.Close()
+}
+
+// finish writes everything which follows the last block for Close.
+func (b *BlockWriter) finish() error {
+	if b.err != nil {
+		return b.err
+	}
+
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	// Encode the index table
+	buf := bytes.NewBuffer([]byte{})
+	for _, handle := range b.index {
+		encoded, err := b.encoder.EncodePair(kv.KVPair{Key: handle.lastKey, Value: handle.encode()})
+		if err != nil {
+			return err
+		}
+
+		buf.Write(encoded)
+	}
+
+	// Build the Bloom filter, if enabled
+	var filter []byte
+	if b.bitsPerKey > 0 && len(b.hashes) > 0 {
+		filter = newBloomFilter(b.hashes, b.bitsPerKey).bytes()
+	}
+
+	// Write both after the data
+	b.footer.Codec = b.compressor.Codec()
+	b.footer.Created = time.Now()
+	b.footer.EncoderID = b.encoder.ID()
+	b.footer.Version = FormatV4
+	return writeFooter(b.writer, buf.Bytes(), filter, b.footer)
+}
+
+// Write adds a KVPair to the current block, writing the block to the
+// underlying stream once it reaches the configured block size. Returns the
+// number of bytes the KVPair took up in the block. Once a block fails to be
+// written every later write returns the same error.
+func (b *BlockWriter) Write(pair kv.KVPair) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+
+	n := b.block.add(pair)
+	b.footer.add(pair)
+	if b.bitsPerKey > 0 {
+		b.hashes = append(b.hashes, bloomHash(pair.Key))
+	}
+
+	if b.block.size() >= b.blockSize {
+		if err := b.flush(); err != nil {
+			b.err = err
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// WriteAll takes a slice of KVPair's and calls Write() on each of them.
+func (b *BlockWriter) WriteAll(pairs []kv.KVPair) (int, error) {
+	var total int
+	for _, pair := range pairs {
+		n, err := b.Write(pair)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+	}
+
+	return total, nil
+}
+
+// discard closes the underlying stream without completing the segment. A
+// temporary segment file is removed rather than moved into place.
+func (b *BlockWriter) discard() {
+	if file, ok := b.writer.(*atomicFile); ok {
+		file.abort()
+		return
+	}
+
+	b.writer.Close()
+}
+
+// flush compresses the current block and writes it and its CRC32C checksum to
+// the underlying stream before recording it in the index table.
+func (b *BlockWriter) flush() error {
+	if b.block.empty() {
+		return nil
+	}
+
+	lastKey := b.block.lastKey
+	data, err := b.compressor.Compress(b.block.finish())
+	if err != nil {
+		return err
+	}
+
+	// Each block is followed by its checksum
+	checksum := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksum, crc32.Checksum(data, crcTable))
+	data = append(data, checksum...)
+
+	if _, err := b.writer.Write(data); err != nil {
+		return err
+	}
+
+	b.index = append(b.index, blockHandle{
+		lastKey: lastKey,
+		offset:  b.offset,
+		size:    len(data),
+	})
+	b.offset += len(data)
+
+	return nil
+}
+
+// NewBlockWriter returns a new BlockWriter. Blocks are written once they hold
+// at least blockSize bytes and bitsPerKey bits are used for each key in the
+// Bloom filter, which isn't written if bitsPerKey is zero. The encoder is used
+// to encode the index table and the compressor to compress each block.
+func NewBlockWriter(id kv.SegmentID, writer io.WriteCloser, encoder kv.Encoder, compressor Compressor, blockSize int, bitsPerKey int) BlockWriter {
+	return BlockWriter{
+		bitsPerKey: bitsPerKey,
+		blockSize:  blockSize,
+		compressor: compressor,
+		encoder:    encoder,
+		id:         id,
+		writer:     writer,
+	}
+}
@@ -0,0 +1,236 @@
+package sstable
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/encoders"
+	"github.com/jmgilman/kv/mock"
+	"github.com/matryer/is"
+	"github.com/spf13/afero"
+)
+
+// NewBlockSegment writes the given pairs with a BlockWriter and opens the
+// result as a Segment.
+func NewBlockSegment(pairs []kv.KVPair, blockSize int) (*Segment, error) {
+	data, err := WriteBlockSegment(pairs, blockSize, NoneCompressor{})
+	if err != nil {
+		return nil, err
+	}
+
+	return OpenBlockSegment(data)
+}
+
+// OpenBlockSegment opens the given segment data as a Segment.
+func OpenBlockSegment(data []byte) (*Segment, error) {
+	segment := NewSegment(bytes.NewReader(data), encoders.NewByteEncoder(), &mock.MockMemoryStore{}, len(data), nil)
+	return &segment, segment.LoadIndex()
+}
+
+// WriteBlockSegment writes the given pairs with a BlockWriter using the given
+// compressor and returns the written segment data.
+func WriteBlockSegment(pairs []kv.KVPair, blockSize int, compressor Compressor) ([]byte, error) {
+	fs := afero.NewMemMapFs()
+	file, err := fs.Create("test.dat")
+	if err != nil {
+		return nil, err
+	}
+
+	writer := NewBlockWriter(kv.NewSegmentID(), file, encoders.NewByteEncoder(), compressor, blockSize, 10)
+	if _, err := writer.WriteAll(pairs); err != nil {
+		return nil, err
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return afero.ReadFile(fs, "test.dat")
+}
+
+func NewSequentialPairs(size int) []kv.KVPair {
+	var pairs []kv.KVPair
+	for i := 0; i < size; i++ {
+		pairs = append(pairs, kv.NewKVPair(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", i))))
+	}
+
+	return pairs
+}
+
+func TestBlockWriter(t *testing.T) {
+	size := 200
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	pairs[5] = kv.DeleteKVPair(pairs[5].Key)
+	segment, err := NewBlockSegment(pairs, 128)
+	is.NoErr(err)
+
+	// One index entry per block
+	is.Equal(segment.footer.Version, FormatV4)
+	is.True(len(segment.blocks) > 1)
+	for i := 1; i < len(segment.blocks); i++ {
+		is.True(segment.blocks[i-1].lastKey < segment.blocks[i].lastKey)
+	}
+
+	// Range of the segment
+	is.Equal(segment.Min().Key, pairs[0].Key)
+	is.Equal(segment.Max().Key, pairs[size-1].Key)
+
+	// Every key is found
+	for _, pair := range pairs {
+		result, err := segment.Lookup(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Key, pair.Key)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	// Deleted and missing keys
+	_, err = segment.Get(pairs[5].Key)
+	is.Equal(err, kv.ErrorNoSuchKey)
+	_, err = segment.Get("key9999")
+	is.Equal(err, kv.ErrorNoSuchKey)
+
+	// Cursor returns every pair in order
+	cursor, err := segment.Cursor()
+	is.NoErr(err)
+	result, err := cursor.ReadToEnd()
+	is.NoErr(err)
+	is.Equal(len(result), size)
+	for i := range pairs {
+		is.Equal(result[i].Key, pairs[i].Key)
+	}
+	is.True(cursor.Done())
+
+	is.NoErr(cursor.Reset())
+	first, err := cursor.Next()
+	is.NoErr(err)
+	is.Equal(first.Key, pairs[0].Key)
+}
+
+func TestBlockWriterEmpty(t *testing.T) {
+	is := is.New(t)
+
+	segment, err := NewBlockSegment(nil, 128)
+	is.NoErr(err)
+	is.Equal(len(segment.blocks), 0)
+	is.True(segment.Min() == nil)
+	is.True(segment.Max() == nil)
+
+	_, err = segment.Get("key")
+	is.Equal(err, kv.ErrorNoSuchKey)
+}
+
+func TestBlockWriterCorrupted(t *testing.T) {
+	size := 200
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	data, err := WriteBlockSegment(pairs, 128, NoneCompressor{})
+	is.NoErr(err)
+
+	segment, err := OpenBlockSegment(data)
+	is.NoErr(err)
+	is.NoErr(segment.Verify())
+	handle := segment.blocks[1]
+
+	// Flip a bit in the second block
+	corrupted := append([]byte{}, data...)
+	corrupted[handle.offset+1] ^= 1
+	segment, err = OpenBlockSegment(corrupted)
+	is.NoErr(err)
+
+	var corruptedErr kv.ErrorCorrupted
+	_, err = segment.Get(handle.lastKey)
+	is.True(errors.As(err, &corruptedErr))
+	is.Equal(corruptedErr.Offset, handle.offset)
+
+	err = segment.Verify()
+	is.True(errors.As(err, &corruptedErr))
+	is.Equal(corruptedErr.Offset, handle.offset)
+
+	// Keys in other blocks are still readable
+	_, err = segment.Get(pairs[0].Key)
+	is.NoErr(err)
+
+	// Flip a bit in the index table
+	corrupted = append([]byte{}, data...)
+	corrupted[segment.dataSize+1] ^= 1
+	_, err = OpenBlockSegment(corrupted)
+	is.True(errors.As(err, &corruptedErr))
+	is.Equal(corruptedErr.Offset, segment.dataSize)
+}
+
+func TestBlockWriterVersions(t *testing.T) {
+	size := 20
+	versions := 5
+	is := is.New(t)
+
+	// Small blocks split the versions of a key across blocks
+	var pairs []kv.KVPair
+	for i := 0; i < size; i++ {
+		for v := versions; v > 0; v-- {
+			pair := kv.NewKVPair(fmt.Sprintf("key%04d", i), []byte(fmt.Sprintf("value%d", v)))
+			pair.Seq = uint64(i*versions + v)
+			pairs = append(pairs, pair)
+		}
+	}
+
+	segment, err := NewBlockSegment(pairs, 32)
+	is.NoErr(err)
+	is.Equal(segment.Seq(), uint64(size*versions))
+
+	// The newest version of each key is returned
+	for i := 0; i < size; i++ {
+		pair, err := segment.Get(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(pair.Seq, uint64(i*versions+versions))
+	}
+
+	// Every version is read back in order
+	cursor, err := segment.Cursor()
+	is.NoErr(err)
+	result, err := cursor.ReadToEnd()
+	is.NoErr(err)
+	is.Equal(result, pairs)
+}
+
+func TestBlockWriterComparator(t *testing.T) {
+	size := 200
+	is := is.New(t)
+
+	// Pairs are written in the order of the comparator
+	pairs := NewSequentialPairs(size)
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+
+	data, err := WriteBlockSegment(pairs, 128, NoneCompressor{})
+	is.NoErr(err)
+
+	segment := NewSegment(bytes.NewReader(data), encoders.NewByteEncoder(), &mock.MockMemoryStore{}, len(data), mock.ReverseComparator{})
+	is.NoErr(segment.LoadIndex())
+	is.True(len(segment.blocks) > 1)
+	is.Equal(segment.Min().Key, "key0199")
+	is.Equal(segment.Max().Key, "key0000")
+
+	// Every key is found
+	for _, pair := range pairs {
+		result, err := segment.Get(pair.Key)
+		is.NoErr(err)
+		is.Equal(result.Value, pair.Value)
+	}
+
+	_, err = segment.Get("key9999")
+	is.Equal(err, kv.ErrorNoSuchKey)
+
+	// Iterators seek in the same order
+	iterator := segment.Iterator()
+	is.NoErr(iterator.Seek("key0100a"))
+	is.Equal(iterator.Key(), "key0100")
+	is.NoErr(iterator.Next())
+	is.Equal(iterator.Key(), "key0099")
+}
@@ -0,0 +1,107 @@
+package sstable
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+var ErrorInvalidFilter = errors.New("invalid bloom filter")
+
+// maxFilterHashes limits the number of hash functions a bloomFilter uses.
+const maxFilterHashes = 30
+
+// bloomFilter is a probabilistic set of keys which can be used to rule out a
+// key being stored in a segment without reading the segment. It never returns
+// a false negative but returns a false positive at a rate which depends on the
+// number of bits used per key.
+//
+// It's encoded as the bit array followed by a single byte holding the number
+// of hash functions used.
+type bloomFilter struct {
+	bits   []byte
+	hashes uint8
+}
+
+// add adds the key with the given hash to the filter.
+func (b *bloomFilter) add(hash uint64) {
+	size := uint64(len(b.bits) * 8)
+	h1, h2 := splitHash(hash)
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		bit := (h1 + i*h2) % size
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// bytes returns the encoded filter.
+func (b *bloomFilter) bytes() []byte {
+	return append(append([]byte{}, b.bits...), b.hashes)
+}
+
+// mayContain returns false if the given key is definitely not in the filter.
+func (b *bloomFilter) mayContain(key string) bool {
+	size := uint64(len(b.bits) * 8)
+	h1, h2 := splitHash(bloomHash(key))
+	for i := uint64(0); i < uint64(b.hashes); i++ {
+		bit := (h1 + i*h2) % size
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bloomHash returns the hash of a key used to add it to a bloomFilter.
+func bloomHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// splitHash derives the two hashes used for double hashing from a key's hash.
+func splitHash(hash uint64) (uint64, uint64) {
+	h1 := hash & 0xffffffff
+	h2 := (hash >> 32) | 1
+	return h1, h2
+}
+
+// decodeBloomFilter decodes a filter previously encoded with bytes().
+func decodeBloomFilter(data []byte) (*bloomFilter, error) {
+	if len(data) < 2 || data[len(data)-1] == 0 || data[len(data)-1] > maxFilterHashes {
+		return nil, ErrorInvalidFilter
+	}
+
+	return &bloomFilter{
+		bits:   data[:len(data)-1],
+		hashes: data[len(data)-1],
+	}, nil
+}
+
+// newBloomFilter returns a filter holding the keys with the given hashes using
+// roughly bitsPerKey bits for each of them. Ten bits per key gives a false
+// positive rate of about one percent.
+func newBloomFilter(hashes []uint64, bitsPerKey int) *bloomFilter {
+	// The optimal number of hash functions is ln(2) * bits per key
+	k := bitsPerKey * 69 / 100
+	if k < 1 {
+		k = 1
+	} else if k > maxFilterHashes {
+		k = maxFilterHashes
+	}
+
+	// Use a minimum size to keep the false positive rate low for small sets
+	bits := len(hashes) * bitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+
+	filter := &bloomFilter{
+		bits:   make([]byte, (bits+7)/8),
+		hashes: uint8(k),
+	}
+	for _, hash := range hashes {
+		filter.add(hash)
+	}
+
+	return filter
+}
@@ -0,0 +1,45 @@
+package sstable
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matryer/is"
+)
+
+func TestBloomFilter(t *testing.T) {
+	size := 1000
+	is := is.New(t)
+
+	var hashes []uint64
+	for i := 0; i < size; i++ {
+		hashes = append(hashes, bloomHash(fmt.Sprintf("key%d", i)))
+	}
+	filter := newBloomFilter(hashes, 10)
+
+	// No false negatives
+	for i := 0; i < size; i++ {
+		is.True(filter.mayContain(fmt.Sprintf("key%d", i)))
+	}
+
+	// False positive rate is roughly one percent
+	var positives int
+	for i := 0; i < size; i++ {
+		if filter.mayContain(fmt.Sprintf("missing%d", i)) {
+			positives++
+		}
+	}
+	is.True(positives < size/20)
+
+	// Filter survives encoding
+	decoded, err := decodeBloomFilter(filter.bytes())
+	is.NoErr(err)
+	is.Equal(decoded.bits, filter.bits)
+	is.Equal(decoded.hashes, filter.hashes)
+
+	// Invalid filters are rejected
+	_, err = decodeBloomFilter([]byte{0})
+	is.Equal(err, ErrorInvalidFilter)
+	_, err = decodeBloomFilter([]byte{0, 0})
+	is.Equal(err, ErrorInvalidFilter)
+}
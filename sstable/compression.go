@@ -0,0 +1,166 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+var ErrorUnknownCodec = errors.New("unknown compression codec")
+
+// Codec identifies the compression used for the blocks of a segment. It's
+// stored in the segment footer so that segments written with different
+// codecs can be read side by side.
+type Codec uint32
+
+const (
+	CodecNone Codec = iota
+	CodecFlate
+	CodecZlib
+	CodecGzip
+)
+
+// Compressor compresses the data blocks of a segment.
+type Compressor interface {
+	// Codec returns the codec recorded in segments written by this Compressor.
+	Codec() Codec
+
+	// Compress returns the compressed form of the given data.
+	Compress(data []byte) ([]byte, error)
+
+	// Decompress returns the original form of the given compressed data.
+	Decompress(data []byte) ([]byte, error)
+}
+
+// NoneCompressor implements Compressor by leaving data as it is.
+type NoneCompressor struct{}
+
+func (n NoneCompressor) Codec() Codec {
+	return CodecNone
+}
+
+func (n NoneCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (n NoneCompressor) Decompress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// FlateCompressor implements Compressor using raw DEFLATE at the given level.
+type FlateCompressor struct {
+	Level int
+}
+
+func (f FlateCompressor) Codec() Codec {
+	return CodecFlate
+}
+
+func (f FlateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, f.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishCompress(&buf, w, data)
+}
+
+func (f FlateCompressor) Decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// ZlibCompressor implements Compressor using zlib at the given level.
+type ZlibCompressor struct {
+	Level int
+}
+
+func (z ZlibCompressor) Codec() Codec {
+	return CodecZlib
+}
+
+func (z ZlibCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, z.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishCompress(&buf, w, data)
+}
+
+func (z ZlibCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// GzipCompressor implements Compressor using gzip at the given level.
+type GzipCompressor struct {
+	Level int
+}
+
+func (g GzipCompressor) Codec() Codec {
+	return CodecGzip
+}
+
+func (g GzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, g.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return finishCompress(&buf, w, data)
+}
+
+func (g GzipCompressor) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// finishCompress writes data to the given compressing writer, closes it and
+// returns the contents of the buffer it writes to.
+func finishCompress(buf *bytes.Buffer, w io.WriteCloser, data []byte) ([]byte, error) {
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// NewCompressor returns a Compressor for the given codec using the default
+// compression level. Returns ErrorUnknownCodec if the codec isn't known.
+func NewCompressor(codec Codec) (Compressor, error) {
+	switch codec {
+	case CodecNone:
+		return NoneCompressor{}, nil
+	case CodecFlate:
+		return FlateCompressor{Level: flate.DefaultCompression}, nil
+	case CodecZlib:
+		return ZlibCompressor{Level: zlib.DefaultCompression}, nil
+	case CodecGzip:
+		return GzipCompressor{Level: gzip.DefaultCompression}, nil
+	}
+
+	return nil, ErrorUnknownCodec
+}
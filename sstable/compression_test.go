@@ -0,0 +1,82 @@
+package sstable
+
+import (
+	"compress/flate"
+	"fmt"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/matryer/is"
+)
+
+func NewTestCompressors() []Compressor {
+	return []Compressor{
+		NoneCompressor{},
+		FlateCompressor{Level: flate.BestSpeed},
+		ZlibCompressor{Level: flate.DefaultCompression},
+		GzipCompressor{Level: flate.BestCompression},
+	}
+}
+
+func NewJSONPairs(size int) []kv.KVPair {
+	var pairs []kv.KVPair
+	for i := 0; i < size; i++ {
+		value := fmt.Sprintf(`{"id": %d, "name": "user%d", "active": true}`, i, i)
+		pairs = append(pairs, kv.NewKVPair(fmt.Sprintf("key%04d", i), []byte(value)))
+	}
+
+	return pairs
+}
+
+func TestCompressor(t *testing.T) {
+	is := is.New(t)
+	data := []byte(`{"id": 1, "name": "user1", "active": true}`)
+
+	for _, compressor := range NewTestCompressors() {
+		compressed, err := compressor.Compress(data)
+		is.NoErr(err)
+
+		result, err := compressor.Decompress(compressed)
+		is.NoErr(err)
+		is.Equal(result, data)
+
+		// A compressor for the codec can decompress the data
+		other, err := NewCompressor(compressor.Codec())
+		is.NoErr(err)
+		result, err = other.Decompress(compressed)
+		is.NoErr(err)
+		is.Equal(result, data)
+	}
+
+	_, err := NewCompressor(Codec(99))
+	is.Equal(err, ErrorUnknownCodec)
+}
+
+func TestBlockWriterCompression(t *testing.T) {
+	size := 200
+	is := is.New(t)
+	pairs := NewJSONPairs(size)
+
+	uncompressed, err := WriteBlockSegment(pairs, 1024, NoneCompressor{})
+	is.NoErr(err)
+
+	for _, compressor := range NewTestCompressors() {
+		data, err := WriteBlockSegment(pairs, 1024, compressor)
+		is.NoErr(err)
+
+		// Compressed segments are smaller
+		if compressor.Codec() != CodecNone {
+			is.True(len(data) < len(uncompressed))
+		}
+
+		// Blocks are decompressed transparently
+		segment, err := OpenBlockSegment(data)
+		is.NoErr(err)
+		is.NoErr(segment.Verify())
+		for _, pair := range pairs {
+			result, err := segment.Get(pair.Key)
+			is.NoErr(err)
+			is.Equal(result.Value, pair.Value)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"github.com/jmgilman/kv"
+)
+
+var ErrorInvalidSegment = errors.New("not a segment file")
+
+// footerMagic marks the end of every segment file.
+const footerMagic uint64 = 0x6b762d7365676d74
+
+// footerTailSize is the size of the fixed part at the very end of a segment,
+// which holds the size of the footer body as a uint32 followed by the magic
+// number as a uint64.
+const footerTailSize = 12
+
+// footerFixedSize is the size of the fixed fields at the start of the footer
+// body.
+const footerFixedSize = 56
+
+// Footer holds the metadata stored at the end of every segment. It's encoded
+// as:
+//
+//	[uint32 version][uint32 encoder ID][uint32 codec][uint32 index size]
+//	[uint32 filter size][uint32 index checksum][uint64 entries]
+//	[uint64 tombstones][int64 created][uint32 min size][uint32 max size]
+//	[min key][max key][uint64 max seq][uint32 checksum][uint32 body size]
+//	[uint64 magic]
+//
+// The max seq field holds the highest sequence number in the segment and is
+// missing from footers written before it was added, in which case it's read as
+// zero. The index checksum covers the index table and Bloom filter while the final
+// checksum covers the rest of the footer.
+type Footer struct {
+	Codec         Codec
+	Created       time.Time
+	EncoderID     uint32
+	Entries       int
+	FilterSize    int
+	IndexChecksum uint32
+	IndexSize     int
+	Max           string
+	MaxSeq        uint64
+	Min           string
+	Tombstones    int
+	Version       uint32
+}
+
+// add records a pair written to the segment.
+func (f *Footer) add(pair kv.KVPair) {
+	if f.Entries == 0 {
+		f.Min = pair.Key
+	}
+	f.Max = pair.Key
+
+	if pair.Seq > f.MaxSeq {
+		f.MaxSeq = pair.Seq
+	}
+
+	f.Entries++
+	if pair.Tombstone {
+		f.Tombstones++
+	}
+}
+
+// blockFormat returns true if the segment stores its KVPair's in blocks.
+func (f *Footer) blockFormat() bool {
+	return f.Version >= FormatV2
+}
+
+// encode returns the encoded footer.
+func (f *Footer) encode() []byte {
+	body := make([]byte, footerFixedSize, f.size())
+	binary.BigEndian.PutUint32(body[0:4], f.Version)
+	binary.BigEndian.PutUint32(body[4:8], f.EncoderID)
+	binary.BigEndian.PutUint32(body[8:12], uint32(f.Codec))
+	binary.BigEndian.PutUint32(body[12:16], uint32(f.IndexSize))
+	binary.BigEndian.PutUint32(body[16:20], uint32(f.FilterSize))
+	binary.BigEndian.PutUint32(body[20:24], f.IndexChecksum)
+	binary.BigEndian.PutUint64(body[24:32], uint64(f.Entries))
+	binary.BigEndian.PutUint64(body[32:40], uint64(f.Tombstones))
+	binary.BigEndian.PutUint64(body[40:48], uint64(f.Created.UnixNano()))
+	binary.BigEndian.PutUint32(body[48:52], uint32(len(f.Min)))
+	binary.BigEndian.PutUint32(body[52:56], uint32(len(f.Max)))
+	body = append(body, f.Min...)
+	body = append(body, f.Max...)
+
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, f.MaxSeq)
+	body = append(body, seq...)
+
+	tail := make([]byte, 4+footerTailSize)
+	binary.BigEndian.PutUint32(tail[0:4], crc32.Checksum(body, crcTable))
+	binary.BigEndian.PutUint32(tail[4:8], uint32(len(body)))
+	binary.BigEndian.PutUint64(tail[8:16], footerMagic)
+
+	return append(body, tail...)
+}
+
+// size returns the size of the encoded footer.
+func (f *Footer) size() int {
+	return footerFixedSize + len(f.Min) + len(f.Max) + 8 + 4 + footerTailSize
+}
+
+// decodeFooterTail decodes the fixed part at the end of a segment and returns
+// the size of the footer body. Returns ErrorInvalidSegment if the magic number
+// doesn't match.
+func decodeFooterTail(tail []byte) (int, error) {
+	if len(tail) != footerTailSize || binary.BigEndian.Uint64(tail[4:12]) != footerMagic {
+		return 0, ErrorInvalidSegment
+	}
+
+	return int(binary.BigEndian.Uint32(tail[0:4])), nil
+}
+
+// decodeFooter decodes a footer body followed by its checksum. Returns false if
+// the checksum doesn't match or the body is malformed.
+func decodeFooter(data []byte) (Footer, bool) {
+	if len(data) < footerFixedSize+4 {
+		return Footer{}, false
+	}
+
+	body := data[:len(data)-4]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return Footer{}, false
+	}
+
+	minSize := int(binary.BigEndian.Uint32(body[48:52]))
+	maxSize := int(binary.BigEndian.Uint32(body[52:56]))
+	keysEnd := footerFixedSize + minSize + maxSize
+
+	// Older footers end with the max key
+	var maxSeq uint64
+	if keysEnd+8 == len(body) {
+		maxSeq = binary.BigEndian.Uint64(body[keysEnd:])
+	} else if keysEnd != len(body) {
+		return Footer{}, false
+	}
+
+	return Footer{
+		Version:       binary.BigEndian.Uint32(body[0:4]),
+		EncoderID:     binary.BigEndian.Uint32(body[4:8]),
+		Codec:         Codec(binary.BigEndian.Uint32(body[8:12])),
+		IndexSize:     int(binary.BigEndian.Uint32(body[12:16])),
+		FilterSize:    int(binary.BigEndian.Uint32(body[16:20])),
+		IndexChecksum: binary.BigEndian.Uint32(body[20:24]),
+		Entries:       int(binary.BigEndian.Uint64(body[24:32])),
+		Tombstones:    int(binary.BigEndian.Uint64(body[32:40])),
+		Created:       time.Unix(0, int64(binary.BigEndian.Uint64(body[40:48]))),
+		Min:           string(body[footerFixedSize : footerFixedSize+minSize]),
+		Max:           string(body[footerFixedSize+minSize : keysEnd]),
+		MaxSeq:        maxSeq,
+	}, true
+}
+
+// writeFooter writes the given index table and Bloom filter to the given stream
+// followed by the footer, after recording their sizes and checksum in it.
+func writeFooter(w io.Writer, index []byte, filter []byte, footer Footer) error {
+	if _, err := w.Write(index); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(filter); err != nil {
+		return err
+	}
+
+	footer.IndexSize = len(index)
+	footer.FilterSize = len(filter)
+	footer.IndexChecksum = crc32.Update(crc32.Checksum(index, crcTable), crcTable, filter)
+
+	_, err := w.Write(footer.encode())
+	return err
+}
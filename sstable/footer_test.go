@@ -0,0 +1,147 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/encoders"
+	"github.com/jmgilman/kv/mock"
+	"github.com/matryer/is"
+)
+
+// NewFooterSegment returns the data of a segment holding only the given footer.
+func NewFooterSegment(footer Footer) ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	err := writeFooter(buf, []byte{}, nil, footer)
+	return buf.Bytes(), err
+}
+
+func TestFooterEncode(t *testing.T) {
+	is := is.New(t)
+
+	footer := Footer{
+		Codec:         CodecFlate,
+		Created:       time.Unix(0, 1234),
+		EncoderID:     encoders.ByteEncoderID,
+		IndexChecksum: 5,
+		IndexSize:     10,
+		FilterSize:    20,
+		Version:       FormatV2,
+	}
+	footer.add(kv.KVPair{Key: "a", Seq: 3})
+	footer.add(kv.KVPair{Key: "b", Seq: 7, Tombstone: true})
+	footer.add(kv.KVPair{Key: "c", Seq: 5})
+
+	data := footer.encode()
+	is.Equal(len(data), footer.size())
+
+	bodySize, err := decodeFooterTail(data[len(data)-footerTailSize:])
+	is.NoErr(err)
+
+	result, ok := decodeFooter(data[len(data)-footerTailSize-bodySize-4 : len(data)-footerTailSize])
+	is.True(ok)
+	is.Equal(result.Entries, 3)
+	is.Equal(result.Tombstones, 1)
+	is.Equal(result.Min, "a")
+	is.Equal(result.Max, "c")
+	is.Equal(result.MaxSeq, uint64(7))
+	is.True(result.Created.Equal(footer.Created))
+	is.Equal(result.Codec, footer.Codec)
+	is.Equal(result.EncoderID, footer.EncoderID)
+	is.Equal(result.IndexChecksum, footer.IndexChecksum)
+	is.Equal(result.IndexSize, footer.IndexSize)
+	is.Equal(result.FilterSize, footer.FilterSize)
+	is.Equal(result.Version, footer.Version)
+}
+
+func TestFooterMetadata(t *testing.T) {
+	size := 50
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	pairs[3] = kv.DeleteKVPair(pairs[3].Key)
+	pairs[7] = kv.DeleteKVPair(pairs[7].Key)
+
+	start := time.Now()
+	segment, err := NewBlockSegment(pairs, 128)
+	is.NoErr(err)
+
+	footer := segment.Footer()
+	is.Equal(footer.Entries, size)
+	is.Equal(footer.Tombstones, 2)
+	is.Equal(footer.Min, pairs[0].Key)
+	is.Equal(footer.Max, pairs[size-1].Key)
+	is.Equal(footer.EncoderID, encoders.ByteEncoderID)
+	is.Equal(footer.Version, FormatV4)
+	is.True(!segment.Created().Before(start.Truncate(time.Second)))
+}
+
+func TestFooterWithoutSeq(t *testing.T) {
+	is := is.New(t)
+
+	footer := Footer{Max: "b", MaxSeq: 9, Min: "a", Version: FormatV2}
+	data := footer.encode()
+
+	// Footers written before the max seq was added end with the max key
+	body := append([]byte{}, data[:len(data)-footerTailSize-4-8]...)
+	body = append(body, make([]byte, 4)...)
+	binary.BigEndian.PutUint32(body[len(body)-4:], crc32.Checksum(body[:len(body)-4], crcTable))
+
+	result, ok := decodeFooter(body)
+	is.True(ok)
+	is.Equal(result.Max, "b")
+	is.Equal(result.MaxSeq, uint64(0))
+}
+
+func TestFooterInvalid(t *testing.T) {
+	is := is.New(t)
+
+	// Too short to hold a footer
+	data := []byte("garbage")
+	segment := NewSegment(bytes.NewReader(data), encoders.NewByteEncoder(), &mock.MockMemoryStore{}, len(data), nil)
+	is.Equal(segment.LoadIndex(), ErrorInvalidSegment)
+
+	// Bad magic number
+	data = bytes.Repeat([]byte("garbage"), 10)
+	segment = NewSegment(bytes.NewReader(data), encoders.NewByteEncoder(), &mock.MockMemoryStore{}, len(data), nil)
+	is.Equal(segment.LoadIndex(), ErrorInvalidSegment)
+}
+
+func TestFooterUnknownVersion(t *testing.T) {
+	is := is.New(t)
+
+	data, err := NewFooterSegment(Footer{EncoderID: encoders.ByteEncoderID, Version: 99})
+	is.NoErr(err)
+
+	_, err = OpenBlockSegment(data)
+	is.True(errors.Is(err, ErrorUnknownFormat))
+}
+
+func TestFooterEncoderMismatch(t *testing.T) {
+	is := is.New(t)
+
+	data, err := NewFooterSegment(Footer{EncoderID: mock.MockEncoderID, Version: FormatV2})
+	is.NoErr(err)
+
+	_, err = OpenBlockSegment(data)
+	is.True(errors.Is(err, ErrorEncoderMismatch))
+}
+
+func TestFooterCorrupted(t *testing.T) {
+	is := is.New(t)
+
+	data, err := WriteBlockSegment(NewSequentialPairs(10), 128, NoneCompressor{})
+	is.NoErr(err)
+
+	// Flip a bit in the max seq stored in the footer
+	data[len(data)-footerTailSize-5] ^= 1
+
+	var corruptedErr kv.ErrorCorrupted
+	_, err = OpenBlockSegment(data)
+	is.True(errors.As(err, &corruptedErr))
+}
@@ -0,0 +1,220 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/jmgilman/kv"
+)
+
+// segmentIterator implements kv.Iterator over a Segment. The segment is read
+// one chunk at a time, where a chunk is either a block of a block formatted
+// segment or the KVPair's between two entries in the sparse index of a FormatV1
+// segment. Only the current chunk is held in memory and moving past either
+// end of it reads the next or previous chunk.
+type segmentIterator struct {
+	chunk   int
+	closed  bool
+	keys    []string
+	offsets []int
+	pairs   []kv.KVPair
+	pos     int
+	segment *Segment
+}
+
+func (i *segmentIterator) Close() error {
+	if i.closed {
+		return nil
+	}
+	i.closed = true
+	i.pairs = nil
+
+	return i.segment.release()
+}
+
+func (i *segmentIterator) Key() string {
+	return i.pairs[i.pos].Key
+}
+
+func (i *segmentIterator) Next() error {
+	if !i.Valid() {
+		return nil
+	}
+
+	i.pos++
+	if i.pos < len(i.pairs) {
+		return nil
+	}
+
+	return i.forward(i.chunk + 1)
+}
+
+func (i *segmentIterator) Pair() kv.KVPair {
+	return i.pairs[i.pos]
+}
+
+func (i *segmentIterator) Prev() error {
+	if !i.Valid() {
+		return nil
+	}
+
+	i.pos--
+	if i.pos >= 0 {
+		return nil
+	}
+
+	return i.backward(i.chunk - 1)
+}
+
+// Seek reads the first chunk which may hold the given key and moves to the
+// first KVPair in it whose key isn't lower, moving on to the next chunk if
+// there's none.
+func (i *segmentIterator) Seek(key string) error {
+	chunk := i.find(key)
+	if err := i.load(chunk); err != nil {
+		return err
+	}
+
+	i.pos = sort.Search(len(i.pairs), func(j int) bool {
+		return key == "" || i.segment.cmp.Compare(i.pairs[j].Key, key) >= 0
+	})
+	if i.pos < len(i.pairs) {
+		return nil
+	}
+
+	return i.forward(chunk + 1)
+}
+
+func (i *segmentIterator) SeekToLast() error {
+	return i.backward(i.count() - 1)
+}
+
+func (i *segmentIterator) Valid() bool {
+	return i.pos >= 0 && i.pos < len(i.pairs)
+}
+
+func (i *segmentIterator) Value() []byte {
+	return i.pairs[i.pos].Value
+}
+
+// backward reads chunks starting from the given one and moving backwards until
+// it finds one which isn't empty, and moves to its last KVPair.
+func (i *segmentIterator) backward(chunk int) error {
+	for ; chunk >= 0; chunk-- {
+		if err := i.load(chunk); err != nil {
+			return err
+		}
+
+		if len(i.pairs) > 0 {
+			i.pos = len(i.pairs) - 1
+			return nil
+		}
+	}
+
+	i.pairs = nil
+	return nil
+}
+
+// count returns the number of chunks in the segment.
+func (i *segmentIterator) count() int {
+	if i.segment.footer.blockFormat() {
+		return len(i.segment.blocks)
+	}
+
+	return len(i.offsets) - 1
+}
+
+// find returns the first chunk which may hold the given key. An empty key is
+// always in the first chunk.
+func (i *segmentIterator) find(key string) int {
+	if key == "" {
+		return 0
+	}
+
+	if i.segment.footer.blockFormat() {
+		return sort.Search(len(i.segment.blocks), func(j int) bool {
+			return i.segment.cmp.Compare(i.segment.blocks[j].lastKey, key) >= 0
+		})
+	}
+
+	// The last chunk whose first key isn't greater than the given key
+	chunk := sort.Search(len(i.keys), func(j int) bool {
+		return i.segment.cmp.Compare(i.keys[j], key) > 0
+	}) - 1
+	if chunk < 0 {
+		return 0
+	}
+
+	return chunk
+}
+
+// forward reads chunks starting from the given one and moving forwards until
+// it finds one which isn't empty, and moves to its first KVPair.
+func (i *segmentIterator) forward(chunk int) error {
+	for ; chunk < i.count(); chunk++ {
+		if err := i.load(chunk); err != nil {
+			return err
+		}
+
+		if len(i.pairs) > 0 {
+			i.pos = 0
+			return nil
+		}
+	}
+
+	i.pairs = nil
+	return nil
+}
+
+// load reads every KVPair in the given chunk.
+func (i *segmentIterator) load(chunk int) error {
+	i.chunk = chunk
+	i.pairs = nil
+	i.pos = 0
+	if chunk < 0 || chunk >= i.count() {
+		return nil
+	}
+
+	if i.segment.footer.blockFormat() {
+		block, err := i.segment.readBlock(i.segment.blocks[chunk])
+		if err != nil {
+			return err
+		}
+
+		i.pairs, err = block.entries()
+		return err
+	}
+
+	section := i.segment.section(i.offsets[chunk], i.offsets[chunk+1])
+	pairs, err := kv.NewCursor(i.segment.encoder, section).ReadToEnd()
+	if err != nil {
+		return err
+	}
+
+	i.pairs = pairs
+	return nil
+}
+
+// newSegmentIterator returns a segmentIterator over the given segment. The
+// chunks of a FormatV1 segment are found from its index table, which holds
+// the first key of each chunk and its offset.
+func newSegmentIterator(segment *Segment) *segmentIterator {
+	iterator := &segmentIterator{segment: segment}
+	if segment.footer.blockFormat() {
+		return iterator
+	}
+
+	for _, pair := range segment.index.Pairs() {
+		offset := int(binary.BigEndian.Uint32(pair.Value))
+		if len(iterator.offsets) == 0 && offset > 0 {
+			iterator.keys = append(iterator.keys, "")
+			iterator.offsets = append(iterator.offsets, 0)
+		}
+
+		iterator.keys = append(iterator.keys, pair.Key)
+		iterator.offsets = append(iterator.offsets, offset)
+	}
+	iterator.offsets = append(iterator.offsets, segment.dataSize)
+
+	return iterator
+}
@@ -0,0 +1,95 @@
+package sstable
+
+import (
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock/helper"
+	"github.com/matryer/is"
+)
+
+func TestSegmentIterator(t *testing.T) {
+	size := 100
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	pairs[10] = kv.DeleteKVPair(pairs[10].Key)
+
+	v1, _ := NewMockSegment(pairs)
+	v2, err := NewBlockSegment(pairs, 128)
+	is.NoErr(err)
+
+	for _, segment := range []*Segment{&v1, v2} {
+		// Every pair in order, including tombstones
+		iterator := segment.Iterator()
+		result, err := helper.ReadIterator(iterator, "")
+		is.NoErr(err)
+		is.Equal(result, pairs)
+
+		// Seek to every key
+		for i, pair := range pairs {
+			is.NoErr(iterator.Seek(pair.Key))
+			is.True(iterator.Valid())
+			is.Equal(iterator.Pair(), pairs[i])
+		}
+
+		// Seek between keys
+		is.NoErr(iterator.Seek(pairs[41].Key + "a"))
+		is.Equal(iterator.Key(), pairs[42].Key)
+		is.NoErr(iterator.Next())
+		is.Equal(iterator.Key(), pairs[43].Key)
+
+		// Seek past the end
+		is.NoErr(iterator.Seek(pairs[size-1].Key + "a"))
+		is.True(!iterator.Valid())
+		is.NoErr(iterator.Close())
+	}
+}
+
+func TestSegmentIteratorReverse(t *testing.T) {
+	size := 100
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	pairs[10] = kv.DeleteKVPair(pairs[10].Key)
+
+	v1, _ := NewMockSegment(pairs)
+	v2, err := NewBlockSegment(pairs, 128)
+	is.NoErr(err)
+
+	for _, segment := range []*Segment{&v1, v2} {
+		// Every pair in reverse order, including tombstones
+		iterator := segment.Iterator()
+		result, err := helper.ReadIteratorReverse(iterator)
+		is.NoErr(err)
+		is.Equal(result, helper.ReversePairs(pairs))
+
+		// Step back from every key, crossing chunks
+		for i := 1; i < size; i++ {
+			is.NoErr(iterator.Seek(pairs[i].Key))
+			is.NoErr(iterator.Prev())
+			is.True(iterator.Valid())
+			is.Equal(iterator.Pair(), pairs[i-1])
+		}
+
+		// Step back from the first key
+		is.NoErr(iterator.Seek(""))
+		is.NoErr(iterator.Prev())
+		is.True(!iterator.Valid())
+	}
+}
+
+func TestSegmentIteratorEmpty(t *testing.T) {
+	is := is.New(t)
+
+	segment, err := NewBlockSegment(nil, 128)
+	is.NoErr(err)
+
+	result, err := helper.ReadIterator(segment.Iterator(), "")
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+
+	result, err = helper.ReadIteratorReverse(segment.Iterator())
+	is.NoErr(err)
+	is.Equal(len(result), 0)
+}
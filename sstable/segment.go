@@ -1,42 +1,135 @@
 package sstable
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/jmgilman/kv"
 )
 
+var ErrorEncoderMismatch = errors.New("segment was written with a different encoder")
+var ErrorUnknownFormat = errors.New("unknown segment format")
+var ErrorUnverifiable = errors.New("segment format has no checksums")
+
 // Segment implements kv.Segment using an SSTable. It uses a contingous body
 // of read-only, ordered, and encoded KVPair's in order to store the contents
 // of a MemoryStore into a more durable long-term format.  Internally, it uses
 // a MemoryStore in order to build a sparse index of its stored KVPair's to
 // reduce the amount of IO required to find a key.
+//
+// Segments written in FormatV2 or later instead store their KVPair's in blocks
+// and keep a sorted list of blocks as their index, which is binary searched to
+// find the only block which may hold a key.
+//
+// All reads of the underlying data are made through a sectionReader which
+// holds a lock while it reads, allowing a Segment to be searched and iterated
+// over concurrently.
+//
+// The underlying data is closed, if it's an io.Closer, once the Segment and
+// every Iterator opened from it have been closed. This allows iterators to
+// keep reading a Segment which has already been removed from its store.
+//
+// Keys must be ordered by the Comparator of the Segment.
 type Segment struct {
-	data    io.ReadSeeker
-	id      kv.SegmentID
-	encoder kv.Encoder
-	index   kv.MemoryStore
-	size    int
+	blocks     []blockHandle
+	cmp        kv.Comparator
+	compressor Compressor
+	data       io.ReadSeeker
+	dataSize   int
+	id         kv.SegmentID
+	encoder    kv.Encoder
+	filter     *bloomFilter
+	footer     Footer
+	index      kv.MemoryStore
+	mu         *sync.Mutex
+	refs       *refs
+	size       int
+}
+
+// refs counts the open references to the data of a Segment. The Segment holds
+// one until it's closed and each of its iterators holds one until it's closed.
+type refs struct {
+	closed bool
+	count  int
+}
+
+// Close releases the reference the segment holds to its data. Closing it more
+// than once has no effect.
+func (s *Segment) Close() error {
+	s.mu.Lock()
+	if s.refs.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.refs.closed = true
+	s.mu.Unlock()
+
+	return s.release()
+}
+
+// Cursor returns a kv.Cursor over every KVPair stored in the segment.
+func (s *Segment) Cursor() (kv.Cursor, error) {
+	if s.footer.blockFormat() {
+		return &blockCursor{segment: s}, nil
+	}
+
+	return kv.NewCursor(s.encoder, s.section(0, s.dataSize)), nil
+}
+
+// Created returns the time at which the segment was written.
+func (s *Segment) Created() time.Time {
+	return s.footer.Created
+}
+
+// Footer returns the metadata stored in the footer of the segment.
+func (s *Segment) Footer() Footer {
+	return s.footer
 }
 
-// Get searches the underlying SSTable for the given key by first checking
-// the internal index table to locate the approximate position and then reading
-// the contents of the SSTable at that position to find the key.
+// Get searches the underlying SSTable for the given key and returns
+// kv.ErrorNoSuchKey if it was not found, has been deleted or has expired.
 func (s *Segment) Get(key string) (*kv.KVPair, error) {
+	pair, err := s.Lookup(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if pair.Tombstone || pair.Expired(time.Now()) {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	return pair, nil
+}
+
+// Lookup searches the underlying SSTable for the given key by first checking
+// the Bloom filter to rule out keys which aren't stored, then the internal
+// index table to locate the approximate position and then reading the contents
+// of the SSTable at that position to find the key. Tombstones are returned as
+// they're stored.
+func (s *Segment) Lookup(key string) (*kv.KVPair, error) {
+	if s.filter != nil && !s.filter.mayContain(key) {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	if s.footer.blockFormat() {
+		return s.lookupBlock(key)
+	}
+
 	// Get range to search for the given key
 	start, end, err := s.searchIndex(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create a limited reader set to the range
-	s.data.Seek(int64(start), io.SeekStart)
-	reader := LimitReadSeeker(s.data, int64(end-start))
-
 	// Create a cursor to iterate over pairs in this range
-	cursor := kv.NewCursor(s.encoder, reader)
+	cursor := kv.NewCursor(s.encoder, s.section(start, end))
 
 	// Search the range for the given key
 	for {
@@ -50,11 +143,7 @@ func (s *Segment) Get(key string) (*kv.KVPair, error) {
 		}
 
 		if key == pair.Key {
-			if pair.Tombstone {
-				return nil, kv.ErrorNoSuchKey
-			} else {
-				return &pair, nil
-			}
+			return &pair, nil
 		}
 	}
 
@@ -66,31 +155,90 @@ func (s *Segment) ID() kv.SegmentID {
 	return s.id
 }
 
-// LoadIndex populates the internal index table of the segment by reading the
-// index table data from the internal data stream.
+// Iterator returns a kv.Iterator over every KVPair stored in the segment,
+// including tombstones.
+func (s *Segment) Iterator() kv.Iterator {
+	s.acquire()
+	return newSegmentIterator(s)
+}
+
+// LoadIndex reads the footer of the segment and uses it to populate the
+// internal index table and Bloom filter by reading them from the end of the
+// internal data stream. Returns ErrorInvalidSegment if the data isn't a
+// segment, ErrorUnknownFormat if the segment was written in an unknown format,
+// ErrorEncoderMismatch if it was written with a different encoder,
+// ErrorUnknownCodec if its blocks were compressed with an unknown codec and
+// kv.ErrorCorrupted if the footer, index table or Bloom filter fail their
+// checksum.
 func (s *Segment) LoadIndex() error {
-	// Get the size of the index table data
-	buf := make([]byte, 4)
+	// Check the magic number and get the size of the footer
+	if s.size < footerTailSize {
+		return ErrorInvalidSegment
+	}
 
-	_, err := s.data.Seek(-4, io.SeekEnd)
+	tail := make([]byte, footerTailSize)
+	if _, err := io.ReadFull(s.section(s.size-footerTailSize, s.size), tail); err != nil {
+		return err
+	}
+
+	bodySize, err := decodeFooterTail(tail)
 	if err != nil {
 		return err
 	}
 
-	_, err = s.data.Read(buf)
+	// Read the footer
+	footerStart := s.size - footerTailSize - bodySize - 4
+	if footerStart < 0 {
+		return kv.ErrorCorrupted{ID: s.id, Offset: s.size - footerTailSize}
+	}
+
+	buf := make([]byte, bodySize+4)
+	if _, err := io.ReadFull(s.section(footerStart, s.size-footerTailSize), buf); err != nil {
+		return err
+	}
+
+	footer, ok := decodeFooter(buf)
+	if !ok {
+		return kv.ErrorCorrupted{ID: s.id, Offset: footerStart}
+	}
+
+	if footer.Version < FormatV1 || footer.Version > FormatV4 {
+		return fmt.Errorf("%w: version %d", ErrorUnknownFormat, footer.Version)
+	}
+
+	if footer.EncoderID != s.encoder.ID() {
+		return fmt.Errorf("%w: encoder %d", ErrorEncoderMismatch, footer.EncoderID)
+	}
+
+	s.footer = footer
+	s.dataSize = footerStart - footer.IndexSize - footer.FilterSize
+	if s.dataSize < 0 {
+		return kv.ErrorCorrupted{ID: s.id, Offset: footerStart}
+	}
+
+	s.compressor, err = NewCompressor(footer.Codec)
 	if err != nil {
 		return err
 	}
-	indexSize := binary.BigEndian.Uint32(buf)
 
-	// Create the index table
-	_, err = s.data.Seek(int64(0-(int64(indexSize)+4)), io.SeekEnd)
+	// Read and check the index table and Bloom filter
+	data, err := s.readIndex()
 	if err != nil {
-		return nil
+		return err
 	}
 
-	reader := LimitReadSeeker(s.data, int64(indexSize))
-	cursor := kv.NewCursor(s.encoder, reader)
+	// Load the Bloom filter
+	s.filter = nil
+	if footer.FilterSize > 0 {
+		s.filter, err = decodeBloomFilter(data[footer.IndexSize:])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create the index table
+	s.blocks = nil
+	cursor := kv.NewCursor(s.encoder, bytes.NewReader(data[:footer.IndexSize]))
 	for {
 		pair, err := cursor.Next()
 		if err != nil {
@@ -101,22 +249,191 @@ func (s *Segment) LoadIndex() error {
 			}
 		}
 
-		s.index.Put(pair)
+		if s.footer.blockFormat() {
+			handle, err := decodeBlockHandle(pair)
+			if err != nil {
+				return err
+			}
+
+			s.blocks = append(s.blocks, handle)
+		} else {
+			s.index.Put(pair)
+		}
 	}
 
 	return nil
 }
 
+// readIndex reads the index table and Bloom filter which follow the segment
+// data and checks them against the checksum in the footer.
+func (s *Segment) readIndex() ([]byte, error) {
+	end := s.dataSize + s.footer.IndexSize + s.footer.FilterSize
+	data := make([]byte, end-s.dataSize)
+	if _, err := io.ReadFull(s.section(s.dataSize, end), data); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(data, crcTable) != s.footer.IndexChecksum {
+		return nil, kv.ErrorCorrupted{ID: s.id, Offset: s.dataSize}
+	}
+
+	return data, nil
+}
+
+// lookupBlock binary searches the blocks of a block formatted segment for the first
+// one whose last key isn't lower than the given key and then searches that
+// block for the key.
+func (s *Segment) lookupBlock(key string) (*kv.KVPair, error) {
+	i := sort.Search(len(s.blocks), func(i int) bool {
+		return s.cmp.Compare(s.blocks[i].lastKey, key) >= 0
+	})
+	if i == len(s.blocks) {
+		return nil, kv.ErrorNoSuchKey
+	}
+
+	block, err := s.readBlock(s.blocks[i])
+	if err != nil {
+		return nil, err
+	}
+
+	return block.search(key, s.cmp)
+}
+
 // Min returns the lowest key stored in this segment.
 func (s *Segment) Min() *kv.KVPair {
+	if s.footer.blockFormat() {
+		if s.footer.Entries == 0 {
+			return nil
+		}
+		return &kv.KVPair{Key: s.footer.Min}
+	}
+
 	return s.index.Min()
 }
 
 // Max returns the highest key stored in this segment.
 func (s *Segment) Max() *kv.KVPair {
+	if s.footer.blockFormat() {
+		if s.footer.Entries == 0 {
+			return nil
+		}
+		return &kv.KVPair{Key: s.footer.Max}
+	}
+
 	return s.index.Max()
 }
 
+// readBlock reads the given block from the segment data, checks it against
+// the checksum stored after it, decompresses it and decodes it. Returns
+// kv.ErrorCorrupted if the checksum doesn't match.
+func (s *Segment) readBlock(handle blockHandle) (*block, error) {
+	if handle.size < 4 || handle.offset+handle.size > s.dataSize {
+		return nil, kv.ErrorCorrupted{ID: s.id, Offset: handle.offset}
+	}
+
+	data := make([]byte, handle.size)
+	if _, err := io.ReadFull(s.section(handle.offset, handle.offset+handle.size), data); err != nil {
+		return nil, err
+	}
+
+	checksum := binary.BigEndian.Uint32(data[len(data)-4:])
+	data = data[:len(data)-4]
+	if crc32.Checksum(data, crcTable) != checksum {
+		return nil, kv.ErrorCorrupted{ID: s.id, Offset: handle.offset}
+	}
+
+	data, err := s.compressor.Decompress(data)
+	if err != nil {
+		return nil, kv.ErrorCorrupted{ID: s.id, Offset: handle.offset}
+	}
+
+	return decodeBlock(data, s.footer.Version)
+}
+
+// acquire adds a reference to the data of the segment.
+func (s *Segment) acquire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refs.count++
+}
+
+// release removes a reference to the data of the segment and closes it once
+// none remain.
+func (s *Segment) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.refs.count--
+	if s.refs.count > 0 {
+		return nil
+	}
+
+	if closer, ok := s.data.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// section returns a reader over the segment data between the given offsets.
+func (s *Segment) section(start int, end int) io.ReadSeeker {
+	return &sectionReader{
+		segment: s,
+		start:   int64(start),
+		end:     int64(end),
+		offset:  int64(start),
+	}
+}
+
+// Seq returns the highest sequence number stored in the segment, which is zero
+// for segments written before sequence numbers were recorded in the footer.
+func (s *Segment) Seq() uint64 {
+	return s.footer.MaxSeq
+}
+
+// Size returns the size of the segment in bytes.
+func (s *Segment) Size() int {
+	return s.size
+}
+
+// Verify reads every part of the segment and checks it against its checksum,
+// returning kv.ErrorCorrupted for the first part which fails. FormatV1
+// segments don't store checksums for their KVPair's, so they can't be
+// verified. They're still checked to decode, but ErrorUnverifiable is returned
+// if they do so that they're never mistaken for verified segments.
+func (s *Segment) Verify() error {
+	if _, err := s.readIndex(); err != nil {
+		return err
+	}
+
+	if s.footer.blockFormat() {
+		for _, handle := range s.blocks {
+			block, err := s.readBlock(handle)
+			if err != nil {
+				return err
+			}
+
+			if _, err := block.entries(); err != nil {
+				return kv.ErrorCorrupted{ID: s.id, Offset: handle.offset}
+			}
+		}
+
+		return nil
+	}
+
+	cursor, err := s.Cursor()
+	if err != nil {
+		return err
+	}
+
+	if _, err := cursor.ReadToEnd(); err != nil {
+		return err
+	}
+
+	return ErrorUnverifiable
+}
+
 // searchIndex searches the index table to find the range, in bytes, where the
 // key is expected to be found. Returns ErrorNoSuchKey if the key is outside
 // the range of the index table.
@@ -125,7 +442,7 @@ func (s *Segment) searchIndex(key string) (start int, end int, err error) {
 	max := s.index.Max()
 
 	// Return out of range is the key is outside the bounds of the table
-	if key < min.Key || key > max.Key {
+	if s.cmp.Compare(key, min.Key) < 0 || s.cmp.Compare(key, max.Key) > 0 {
 		return 0, 0, kv.ErrorNoSuchKey
 	}
 
@@ -136,7 +453,7 @@ func (s *Segment) searchIndex(key string) (start int, end int, err error) {
 
 	// Assume start is the beginning and end is the end of the data
 	start = 0
-	end = s.size
+	end = s.dataSize
 
 	// If left is not nil, start at its index position
 	if left != nil {
@@ -151,15 +468,76 @@ func (s *Segment) searchIndex(key string) (start int, end int, err error) {
 	return start, end, nil
 }
 
-func NewSegment(data io.ReadSeeker, encoder kv.Encoder, index kv.MemoryStore, size int) Segment {
+// NewSegment returns a Segment over the given data, which is size bytes long.
+// The index is used to hold the index table of a FormatV1 segment and keys are
+// ordered by the given Comparator, or bytewise if it's nil.
+func NewSegment(data io.ReadSeeker, encoder kv.Encoder, index kv.MemoryStore, size int, cmp kv.Comparator) Segment {
 	return Segment{
-		data:    data,
-		encoder: encoder,
-		index:   index,
-		size:    size,
+		cmp:        kv.DefaultComparator(cmp),
+		data:       data,
+		dataSize:   size,
+		encoder:    encoder,
+		index:      index,
+		compressor: NoneCompressor{},
+		footer:     Footer{Version: FormatV1},
+		mu:         &sync.Mutex{},
+		refs:       &refs{count: 1},
+		size:       size,
 	}
 }
 
+// sectionReader implements io.ReadSeeker over a section of a Segment's data.
+// It tracks its own offset and holds the Segment's lock for the duration of
+// each read so that multiple readers can share the underlying data.
+type sectionReader struct {
+	segment *Segment
+	start   int64
+	end     int64
+	offset  int64
+}
+
+func (r *sectionReader) Read(p []byte) (int, error) {
+	if r.offset >= r.end {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.end-r.offset {
+		p = p[0 : r.end-r.offset]
+	}
+
+	r.segment.mu.Lock()
+	defer r.segment.mu.Unlock()
+
+	if _, err := r.segment.data.Seek(r.offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.segment.data, p)
+	r.offset += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *sectionReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		offset += r.start
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.end
+	}
+
+	if offset < r.start {
+		return 0, errors.New("seek before start of section")
+	}
+
+	r.offset = offset
+	return offset - r.start, nil
+}
+
 // LimitedReadSeeker provides the same interface for io.LimitedReader for types
 // implementing io.ReadSeeker.
 type LimitedReadSeeker struct {
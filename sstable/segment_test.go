@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/dsnet/golib/memfile"
 	"github.com/jmgilman/kv"
@@ -27,7 +29,7 @@ func NewMockSegment(pairs []kv.KVPair) (Segment, mock.MockEncoder) {
 		}
 	}
 
-	return NewSegment(file, &encoder, &store, size), encoder
+	return NewSegment(file, &encoder, &store, size, nil), encoder
 }
 
 func NewMockSegmentFile(file afero.File, pairs []kv.KVPair, indexFactor int) (data mock.MockEncoder, index mock.MockEncoder, err error) {
@@ -35,7 +37,6 @@ func NewMockSegmentFile(file afero.File, pairs []kv.KVPair, indexFactor int) (da
 	indexEncoder := mock.MockEncoder{}
 	indexBuf := bytes.NewBuffer([]byte{})
 
-	var tableSize int
 	for i, pair := range pairs {
 		data, err := encoder.EncodePair(pair)
 		if err != nil {
@@ -61,17 +62,12 @@ func NewMockSegmentFile(file afero.File, pairs []kv.KVPair, indexFactor int) (da
 			if err != nil {
 				return mock.MockEncoder{}, mock.MockEncoder{}, err
 			}
-
-			tableSize += 1
 		}
 	}
 
-	_, err = file.Write(indexBuf.Bytes())
-	if err != nil {
-		return mock.MockEncoder{}, mock.MockEncoder{}, err
-	}
-
-	err = binary.Write(file, binary.BigEndian, uint32(tableSize*4))
+	// No Bloom filter is written
+	footer := Footer{EncoderID: mock.MockEncoderID, Version: FormatV1}
+	err = writeFooter(file, indexBuf.Bytes(), nil, footer)
 	if err != nil {
 		return mock.MockEncoder{}, mock.MockEncoder{}, err
 	}
@@ -101,6 +97,70 @@ func TestSegmentGet(t *testing.T) {
 	pairs[0].Tombstone = true
 	_, err = segment.Get(pairs[0].Key)
 	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+
+	// Test expired key
+	pairs[1].Expires = time.Now().Add(-time.Second).UnixNano()
+	_, err = segment.Get(pairs[1].Key)
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+func TestSegmentLookup(t *testing.T) {
+	size := 10
+	is := is.New(t)
+
+	segment, encoder := NewMockSegment(helper.NewRandomSortedPairs(size))
+	pairs := encoder.Pairs()
+
+	// Deleted keys are returned as tombstones
+	pairs[0].Tombstone = true
+	result, err := segment.Lookup(pairs[0].Key)
+	is.NoErr(err)
+	is.True(result.Tombstone)
+
+	// Test non-existent key
+	_, err = segment.Lookup("123")
+	is.True(errors.Is(err, kv.ErrorNoSuchKey))
+}
+
+// TrackedData wraps the data of a segment and records when it's closed.
+type TrackedData struct {
+	io.ReadSeeker
+	closed int
+}
+
+func (t *TrackedData) Close() error {
+	t.closed++
+	return nil
+}
+
+func TestSegmentClose(t *testing.T) {
+	size := 100
+	is := is.New(t)
+
+	pairs := NewSequentialPairs(size)
+	segment, err := NewBlockSegment(pairs, 128)
+	is.NoErr(err)
+	data := &TrackedData{ReadSeeker: segment.data}
+	segment.data = data
+
+	// Open iterators keep the data open
+	first := segment.Iterator()
+	second := segment.Iterator()
+	is.NoErr(segment.Close())
+	is.NoErr(segment.Close())
+	is.Equal(data.closed, 0)
+
+	result, err := helper.ReadIterator(first, "")
+	is.NoErr(err)
+	is.Equal(result, pairs)
+
+	is.NoErr(first.Close())
+	is.NoErr(first.Close())
+	is.Equal(data.closed, 0)
+
+	// Data is closed along with the last iterator
+	is.NoErr(second.Close())
+	is.Equal(data.closed, 1)
 }
 
 func TestSegmentIndex(t *testing.T) {
@@ -142,27 +202,25 @@ func TestSegmentLoadIndex(t *testing.T) {
 	size := 10
 	is := is.New(t)
 
-	// Each entry is the underlying buffer is 4 bytes (uint32) long
-	entrySize := 4
-
-	// Setup a test file
+	// Setup a test file holding only an index table
 	pairs := helper.NewRandomSortedPairs(size)
 	encoder := mock.MockEncoder{}
 	file := memfile.File{}
+	index := bytes.NewBuffer([]byte{})
 
 	for _, pair := range pairs {
 		data, err := encoder.EncodePair(pair)
 		is.NoErr(err)
 
-		_, err = file.Write(data)
+		_, err = index.Write(data)
 		is.NoErr(err)
 	}
 
-	tableSize := entrySize * size
-	binary.Write(&file, binary.BigEndian, uint32(tableSize))
+	footer := Footer{EncoderID: mock.MockEncoderID, Version: FormatV1}
+	is.NoErr(writeFooter(&file, index.Bytes(), nil, footer))
 
 	// Create a new segment
-	segment := NewSegment(&file, &encoder, &mock.MockMemoryStore{}, len(file.Bytes()))
+	segment := NewSegment(&file, &encoder, &mock.MockMemoryStore{}, len(file.Bytes()), nil)
 
 	// Load index table
 	err := segment.LoadIndex()
@@ -3,16 +3,50 @@ package sstable
 import (
 	"bytes"
 	"encoding/binary"
+	"hash/crc32"
 	"io"
+	"time"
 
 	"github.com/jmgilman/kv"
 )
 
-// SegmentWriter implements kv.SegmentWriter for writing SSTable formatted
+// Segment format versions, stored in the footer of a segment.
+const (
+	// FormatV1 stores a flat run of encoded KVPair's followed by a sparse index
+	// table pointing at individual KVPair's.
+	FormatV1 uint32 = 1
+
+	// FormatV2 stores KVPair's in prefix compressed blocks, which may be further
+	// compressed by a Compressor, followed by an index table with one entry for
+	// each block.
+	FormatV2 uint32 = 2
+
+	// FormatV3 is the same as FormatV2 except that each entry in a block also
+	// stores the sequence number of its KVPair, and the footer stores the
+	// highest sequence number in the segment.
+	FormatV3 uint32 = 3
+
+	// FormatV4 is the same as FormatV3 except that each entry in a block also
+	// stores the expiry time of its KVPair.
+	FormatV4 uint32 = 4
+)
+
+// crcTable is used to calculate the CRC32C checksums stored in segments.
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// SegmentWriter implements kv.SegmentWriter for writing FormatV1 SSTable
 // segments to an underlying stream.
+//
+// Deprecated: FormatV1 is a legacy format which stores no checksums for its
+// KVPair's, so its segments can't be verified. It's only kept so that existing
+// segments can be reproduced in tests; use BlockWriter instead.
 type SegmentWriter struct {
+	bitsPerKey   int
 	byteIndex    int
 	encoder      kv.Encoder
+	err          error
+	footer       Footer
+	hashes       []uint64
 	id           kv.SegmentID
 	index        int
 	indexFactor  int
@@ -23,28 +57,40 @@ type SegmentWriter struct {
 }
 
 // Close writes the last written KVPair to the index table and proceeds to
-// encode the index table, writing it along with it's length to the end of the
-// underlying stream before calling Close() on the underlying strema.
+// encode the index table and the Bloom filter of written keys, writing them
+// along with the segment footer to the end of the underlying stream before
+// calling Close() on the underlying stream. If an earlier write failed the
+// underlying stream is closed without finishing the segment and the error is
+// returned.
 func (s *SegmentWriter) Close() error {
+	if s.err != nil {
+		s.writer.Close()
+		return s.err
+	}
+
 	// Always record the last key to the index table
 	if s.index%s.indexFactor != 0 {
 		s.table.Put(kv.NewKVPair(s.lastKey, s.encodeUint32(uint32(s.lastKeyIndex))))
 	}
 
-	// Write the encoded index table to the end of the stream
+	// Encode the index table
 	encoded, err := s.encodeTable()
 	if err != nil {
 		return err
 	}
 
-	_, err = s.writer.Write(encoded)
-	if err != nil {
-		return err
+	// Build the Bloom filter, if enabled
+	var filter []byte
+	if s.bitsPerKey > 0 && len(s.hashes) > 0 {
+		filter = newBloomFilter(s.hashes, s.bitsPerKey).bytes()
 	}
 
-	// Last four bytes of a segment stream will always be size of index table
-	indexSize := len(encoded)
-	if err := binary.Write(s.writer, binary.BigEndian, uint32(indexSize)); err != nil {
+	// Write both after the data
+	s.footer.Codec = CodecNone
+	s.footer.Created = time.Now()
+	s.footer.EncoderID = s.encoder.ID()
+	s.footer.Version = FormatV1
+	if err := writeFooter(s.writer, encoded, filter, s.footer); err != nil {
 		return err
 	}
 
@@ -78,22 +124,38 @@ func (s *SegmentWriter) encodeTable() ([]byte, error) {
 // count is maintained for the number of writes made and is frequently checked
 // in order to determine if a specific entry should be added to the index table
 // based on the configured index factor. The first and last writes are always
-// added to the index table.
+// added to the index table. Only the first version of a key is ever indexed so
+// that searches always start from its newest version. Once a write fails every
+// later write returns the same error.
 func (s *SegmentWriter) Write(pair kv.KVPair) (int, error) {
-	s.lastKey = pair.Key
-	s.lastKeyIndex = s.byteIndex
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	version := s.index > 0 && pair.Key == s.lastKey
+	if !version {
+		s.lastKey = pair.Key
+		s.lastKeyIndex = s.byteIndex
+	}
+	s.footer.add(pair)
+	if s.bitsPerKey > 0 {
+		s.hashes = append(s.hashes, bloomHash(pair.Key))
+	}
 
 	encoded, err := s.encoder.EncodePair(pair)
 	if err != nil {
+		s.err = err
 		return 0, err
 	}
 
+	// A partial write leaves the offsets of the index table wrong
 	n, err := s.writer.Write(encoded)
 	if err != nil {
-		return 0, nil
+		s.err = err
+		return 0, err
 	}
 
-	if (s.index+1)%s.indexFactor == 0 || (s.index+1) == 1 {
+	if !version && ((s.index+1)%s.indexFactor == 0 || (s.index+1) == 1) {
 		s.table.Put(kv.NewKVPair(pair.Key, s.encodeUint32(uint32(s.byteIndex))))
 	}
 	s.byteIndex += n
@@ -108,7 +170,7 @@ func (s *SegmentWriter) WriteAll(pairs []kv.KVPair) (int, error) {
 	for _, pair := range pairs {
 		n, err := s.Write(pair)
 		if err != nil {
-			return 0, nil
+			return total, err
 		}
 
 		total += n
@@ -117,8 +179,12 @@ func (s *SegmentWriter) WriteAll(pairs []kv.KVPair) (int, error) {
 	return total, nil
 }
 
-func NewSegmentWriter(id kv.SegmentID, writer io.WriteCloser, encoder kv.Encoder, table kv.MemoryStore, indexFactor int) SegmentWriter {
+// NewSegmentWriter returns a new SegmentWriter. A key is added to the index
+// table every indexFactor writes and bitsPerKey bits are used for each key in
+// the Bloom filter, which isn't written if bitsPerKey is zero.
+func NewSegmentWriter(id kv.SegmentID, writer io.WriteCloser, encoder kv.Encoder, table kv.MemoryStore, indexFactor int, bitsPerKey int) SegmentWriter {
 	return SegmentWriter{
+		bitsPerKey:  bitsPerKey,
 		encoder:     encoder,
 		id:          id,
 		indexFactor: indexFactor,
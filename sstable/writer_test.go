@@ -2,10 +2,12 @@ package sstable
 
 import (
 	"encoding/binary"
+	"errors"
 	"reflect"
 	"testing"
 
 	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/encoders"
 	"github.com/jmgilman/kv/mock"
 	"github.com/jmgilman/kv/mock/helper"
 	"github.com/matryer/is"
@@ -22,7 +24,7 @@ func NewMockSegmentWriter(indexFactor int) (SegmentWriter, afero.File, error) {
 
 	encoder := mock.MockEncoder{}
 	table := mock.NewMockMemoryStore([]kv.KVPair{})
-	return NewSegmentWriter(id, file, &encoder, &table, indexFactor), file, nil
+	return NewSegmentWriter(id, file, &encoder, &table, indexFactor, 0), file, nil
 }
 
 func TestSegmentWriterClose(t *testing.T) {
@@ -51,7 +53,7 @@ func TestSegmentWriterClose(t *testing.T) {
 	// File size is correct
 	dataSize := entrySize * size
 	indexSize := ((size / factor) + 2) * entrySize // Add two for first/last indexes
-	fileSize := dataSize + indexSize + 4           // Last four bytes are index length
+	fileSize := dataSize + indexSize + writer.footer.size()
 
 	s, err := file.Stat()
 	is.NoErr(err)
@@ -155,3 +157,106 @@ func TestSegmentWriterWriteAll(t *testing.T) {
 	// Table size is correct
 	is.Equal(writer.table.Size(), (size/factor)+1)
 }
+
+func TestSegmentWriterVersions(t *testing.T) {
+	is := is.New(t)
+
+	writer, _, err := NewMockSegmentWriter(2)
+	is.NoErr(err)
+
+	// Only the first version of a key is indexed
+	var pairs []kv.KVPair
+	for _, key := range []string{"a", "b", "b", "b", "c"} {
+		pair := kv.NewKVPair(key, []byte(key))
+		pair.Seq = uint64(10 - len(pairs))
+		pairs = append(pairs, pair)
+	}
+
+	_, err = writer.WriteAll(pairs)
+	is.NoErr(err)
+	is.NoErr(writer.Close())
+
+	// The index points at the first version of the last key
+	is.Equal(writer.table.Size(), 3)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := writer.table.Get(key)
+		is.NoErr(err)
+	}
+
+	entry, err := writer.table.Get("b")
+	is.NoErr(err)
+	is.Equal(binary.BigEndian.Uint32(entry.Value), uint32(4))
+	is.Equal(writer.footer.MaxSeq, uint64(10))
+}
+
+// failingWriter is an io.WriteCloser which fails every write after the first
+// limit bytes.
+type failingWriter struct {
+	closed  bool
+	limit   int
+	written int
+}
+
+func (f *failingWriter) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.written+len(p) > f.limit {
+		return 0, errors.New("disk full")
+	}
+
+	f.written += len(p)
+	return len(p), nil
+}
+
+func TestSegmentWriterWriteError(t *testing.T) {
+	size := 10
+	is := is.New(t)
+
+	file := failingWriter{limit: 8}
+	encoder := mock.MockEncoder{}
+	table := mock.NewMockMemoryStore([]kv.KVPair{})
+	writer := NewSegmentWriter(kv.NewSegmentID(), &file, &encoder, &table, 3, 0)
+
+	// The write which fails and every write after it report the error
+	pairs := helper.NewRandomSortedPairs(size)
+	n, err := writer.WriteAll(pairs)
+	is.True(err != nil)
+	is.Equal(n, 8)
+
+	_, err = writer.Write(pairs[0])
+	is.True(err != nil)
+
+	// The segment isn't finished
+	is.True(writer.Close() != nil)
+	is.True(file.closed)
+	is.Equal(file.written, 8)
+}
+
+func TestSegmentWriterVerify(t *testing.T) {
+	size := 10
+	is := is.New(t)
+
+	fs := afero.NewMemMapFs()
+	file, err := fs.Create("test.dat")
+	is.NoErr(err)
+
+	encoder := encoders.NewByteEncoder()
+	table := mock.NewMockMemoryStore([]kv.KVPair{})
+	writer := NewSegmentWriter(kv.NewSegmentID(), file, encoder, &table, 3, 0)
+	_, err = writer.WriteAll(helper.NewRandomSortedPairs(size))
+	is.NoErr(err)
+	is.NoErr(writer.Close())
+
+	file, err = fs.Open("test.dat")
+	is.NoErr(err)
+	info, err := file.Stat()
+	is.NoErr(err)
+
+	// FormatV1 segments have no checksums to verify
+	segment := NewSegment(file, encoder, &mock.MockMemoryStore{}, int(info.Size()), nil)
+	is.NoErr(segment.LoadIndex())
+	is.Equal(segment.Verify(), ErrorUnverifiable)
+}
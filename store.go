@@ -7,17 +7,50 @@ type MemoryStoreFactory func() MemoryStore
 // MemoryStore's.
 type NVStore interface {
 	Get(key string) (*KVPair, error)
+
+	// Iterator returns an Iterator over the newest version of every live key
+	// in the store whose sequence number isn't higher than seq.
+	Iterator(seq uint64) Iterator
+
+	// Lookup returns the newest KVPair for the given key as it's stored,
+	// including tombstones. Returns ErrorNoSuchKey only if the key doesn't
+	// exist.
+	Lookup(key string) (*KVPair, error)
+
 	New(store MemoryStore) (SegmentID, error)
+
+	// Seq returns the highest sequence number stored.
+	Seq() uint64
+
+	// Snapshots returns the list of snapshots pinned against the store.
+	Snapshots() *SnapshotList
 }
 
 // MemoryStore represents an ordered in-memory storage object for key/value
 // pairs.
 type MemoryStore interface {
 	Delete(key string) error
+
+	// Get returns the newest KVPair for the given key. Returns ErrorNoSuchKey
+	// if the key doesn't exist, has been deleted or has expired.
 	Get(key string) (*KVPair, error)
+
+	// Iterator returns an Iterator over every KVPair in the store, including
+	// tombstones and older versions, in key order. Versions of the same key
+	// are ordered from newest to oldest. The Iterator must stay usable while
+	// the store is written to, as long as creating it is synchronized with
+	// writes. It may or may not see writes made after it was created.
+	Iterator() Iterator
+
+	// Lookup returns the newest KVPair for the given key as it's stored,
+	// including tombstones. Returns ErrorNoSuchKey only if the key doesn't exist.
+	Lookup(key string) (*KVPair, error)
 	Min() *KVPair
 	Max() *KVPair
 	Pairs() []*KVPair
+
+	// Put adds the given KVPair as a version of its key, replacing any version
+	// with the same sequence number.
 	Put(pair KVPair) error
 	Range(key string) (*KVPair, *KVPair, error)
 	Size() int
@@ -0,0 +1,326 @@
+package kv
+
+import (
+	"sync"
+	"time"
+)
+
+// BufferLevel is used as the output level of a CompactionTask to indicate the
+// merged segments should be put back into the buffer in place of the inputs.
+const BufferLevel = -1
+
+// CompactionStrategy decides which segments of a SegmentStore should be
+// compacted next and where the result should be put.
+type CompactionStrategy interface {
+	// Pick returns the next compaction to run for the given layout or nil if
+	// no compaction is needed.
+	Pick(layout Layout) *CompactionTask
+}
+
+// CompactionTask describes a single compaction chosen by a CompactionStrategy.
+type CompactionTask struct {
+	// Drop deletes the inputs without merging them.
+	Drop bool
+
+	// DropTombstones removes deleted keys entirely rather than writing
+	// tombstones for them. This is only safe when no older data remains for
+	// the inputs to shadow.
+	DropTombstones bool
+
+	// Inputs are the segments to merge ordered from newest to oldest. When the
+	// output level is BufferLevel they must be adjacent in the buffer.
+	Inputs []Segment
+
+	// Level is the level the merged output is put into, or BufferLevel.
+	Level int
+}
+
+// Layout is a snapshot of the segments in a SegmentStore.
+type Layout struct {
+	// Buffer holds the buffered segments from oldest to newest.
+	Buffer []Segment
+
+	// Comparator is the order of keys in the store.
+	Comparator Comparator
+
+	// Levels holds each level from newest to oldest.
+	Levels []SegmentLevel
+}
+
+// LeveledStrategy implements CompactionStrategy by organizing segments into
+// levels of non-overlapping segments with exponentially growing size budgets.
+// It favors read performance by keeping the number of segments a read has to
+// search low.
+//
+// Once the buffer holds L0Trigger segments they're all merged, along with any
+// overlapping segments in the first level, into the first level. Each level
+// has a byte budget of LevelSize multiplied by FanOut for every level above
+// it, and when a level goes over its budget one of its segments is merged
+// into the overlapping segments of the next level.
+//
+// A LeveledStrategy is safe for concurrent use and must not be copied.
+type LeveledStrategy struct {
+	FanOut    int
+	L0Trigger int
+	LevelSize int
+	mu        sync.Mutex
+	pointers  map[int]string
+}
+
+func (l *LeveledStrategy) Pick(layout Layout) *CompactionTask {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buffer := layout.Buffer
+	cmp := DefaultComparator(layout.Comparator)
+	levels := layout.Levels
+
+	if len(buffer) >= l.L0Trigger && len(buffer) > 0 {
+		var inputs []Segment
+		for i := len(buffer) - 1; i >= 0; i-- {
+			inputs = append(inputs, buffer[i])
+		}
+
+		if len(levels) > 0 {
+			min, max := segmentsRange(buffer, cmp)
+			inputs = append(inputs, overlapping(levels[0].segments, min, max, cmp)...)
+		}
+
+		return &CompactionTask{
+			DropTombstones: isBottom(levels, 0),
+			Inputs:         inputs,
+			Level:          0,
+		}
+	}
+
+	for i, level := range levels {
+		if levelSize(level) <= l.levelBudget(i) {
+			continue
+		}
+
+		// Rotate through the segments of a level so that every part of its key
+		// space eventually gets compacted
+		segment := level.segments[0]
+		if pointer, ok := l.pointers[i]; ok {
+			for _, s := range level.segments {
+				if cmp.Compare(s.Min().Key, pointer) > 0 {
+					segment = s
+					break
+				}
+			}
+		}
+		if l.pointers == nil {
+			l.pointers = map[int]string{}
+		}
+		l.pointers[i] = segment.Min().Key
+
+		inputs := []Segment{segment}
+		if i+1 < len(levels) {
+			inputs = append(inputs, overlapping(levels[i+1].segments, segment.Min().Key, segment.Max().Key, cmp)...)
+		}
+
+		return &CompactionTask{
+			DropTombstones: isBottom(levels, i+1),
+			Inputs:         inputs,
+			Level:          i + 1,
+		}
+	}
+
+	return nil
+}
+
+// levelBudget returns the maximum number of bytes the given level may hold.
+func (l *LeveledStrategy) levelBudget(level int) int {
+	budget := l.LevelSize
+	for i := 0; i < level; i++ {
+		budget *= l.FanOut
+	}
+
+	return budget
+}
+
+// NewLeveledStrategy returns a new LeveledStrategy. See LeveledStrategy for a
+// description of each parameter.
+func NewLeveledStrategy(l0Trigger int, levelSize int, fanOut int) *LeveledStrategy {
+	return &LeveledStrategy{
+		FanOut:    fanOut,
+		L0Trigger: l0Trigger,
+		LevelSize: levelSize,
+		pointers:  map[int]string{},
+	}
+}
+
+// SizeTieredStrategy implements CompactionStrategy by merging runs of
+// similarly sized segments in the buffer into a single larger segment which
+// takes their place. It favors write performance by rewriting data less often
+// at the cost of reads having to search more segments.
+//
+// Segments are considered similar if their size is between BucketLow and
+// BucketHigh times the average size of the run. A run is merged once it holds
+// MinThreshold segments and at most MaxThreshold segments are merged at once.
+type SizeTieredStrategy struct {
+	BucketHigh   float64
+	BucketLow    float64
+	MaxThreshold int
+	MinThreshold int
+}
+
+func (s *SizeTieredStrategy) Pick(layout Layout) *CompactionTask {
+	buffer := layout.Buffer
+
+	// Search from the oldest segment for the first run of similar sizes
+	for start := 0; start < len(buffer); start++ {
+		total := buffer[start].Size()
+		end := start + 1
+		for end < len(buffer) && end-start < s.MaxThreshold {
+			average := float64(total) / float64(end-start)
+			size := float64(buffer[end].Size())
+			if size < average*s.BucketLow || size > average*s.BucketHigh {
+				break
+			}
+
+			total += buffer[end].Size()
+			end++
+		}
+
+		if end-start < s.MinThreshold {
+			continue
+		}
+
+		var inputs []Segment
+		for i := end - 1; i >= start; i-- {
+			inputs = append(inputs, buffer[i])
+		}
+
+		return &CompactionTask{
+			DropTombstones: start == 0 && isBottom(layout.Levels, -1),
+			Inputs:         inputs,
+			Level:          BufferLevel,
+		}
+	}
+
+	return nil
+}
+
+// NewSizeTieredStrategy returns a new SizeTieredStrategy. See
+// SizeTieredStrategy for a description of each parameter.
+func NewSizeTieredStrategy(minThreshold int, maxThreshold int, bucketLow float64, bucketHigh float64) *SizeTieredStrategy {
+	return &SizeTieredStrategy{
+		BucketHigh:   bucketHigh,
+		BucketLow:    bucketLow,
+		MaxThreshold: maxThreshold,
+		MinThreshold: minThreshold,
+	}
+}
+
+// FIFOStrategy implements CompactionStrategy by never merging segments and
+// instead dropping the oldest segments in the buffer once they're older than
+// TTL or the buffer grows past MaxSize bytes. It's suited to data which is
+// only useful for a limited time, such as caches or metrics. A zero TTL or
+// MaxSize disables the respective check.
+type FIFOStrategy struct {
+	MaxSize int
+	TTL     time.Duration
+}
+
+func (f *FIFOStrategy) Pick(layout Layout) *CompactionTask {
+	var inputs []Segment
+
+	// Drop every segment which has expired
+	if f.TTL > 0 {
+		for _, segment := range layout.Buffer {
+			if time.Since(segment.Created()) <= f.TTL {
+				break
+			}
+
+			inputs = append([]Segment{segment}, inputs...)
+		}
+	}
+
+	// Drop the oldest remaining segments until the buffer fits
+	if f.MaxSize > 0 {
+		remaining := layout.Buffer[len(inputs):]
+
+		var size int
+		for _, segment := range remaining {
+			size += segment.Size()
+		}
+
+		for _, segment := range remaining {
+			if size <= f.MaxSize {
+				break
+			}
+
+			size -= segment.Size()
+			inputs = append([]Segment{segment}, inputs...)
+		}
+	}
+
+	if len(inputs) == 0 {
+		return nil
+	}
+
+	return &CompactionTask{
+		Drop:   true,
+		Inputs: inputs,
+		Level:  BufferLevel,
+	}
+}
+
+// NewFIFOStrategy returns a new FIFOStrategy. See FIFOStrategy for a
+// description of each parameter.
+func NewFIFOStrategy(maxSize int, ttl time.Duration) *FIFOStrategy {
+	return &FIFOStrategy{
+		MaxSize: maxSize,
+		TTL:     ttl,
+	}
+}
+
+// isBottom returns true if no level below the given level holds any segments.
+func isBottom(levels []SegmentLevel, level int) bool {
+	for i := level + 1; i < len(levels); i++ {
+		if len(levels[i].segments) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// levelSize returns the total size in bytes of the segments in a level.
+func levelSize(level SegmentLevel) int {
+	var size int
+	for _, segment := range level.segments {
+		size += segment.Size()
+	}
+
+	return size
+}
+
+// overlapping returns the segments whose key range overlaps the given range.
+func overlapping(segments []Segment, min string, max string, cmp Comparator) []Segment {
+	var result []Segment
+	for _, segment := range segments {
+		if cmp.Compare(segment.Max().Key, min) >= 0 && cmp.Compare(segment.Min().Key, max) <= 0 {
+			result = append(result, segment)
+		}
+	}
+
+	return result
+}
+
+// segmentsRange returns the lowest and highest key across the given segments.
+func segmentsRange(segments []Segment, cmp Comparator) (string, string) {
+	min := segments[0].Min().Key
+	max := segments[0].Max().Key
+	for _, segment := range segments[1:] {
+		if cmp.Compare(segment.Min().Key, min) < 0 {
+			min = segment.Min().Key
+		}
+		if cmp.Compare(segment.Max().Key, max) > 0 {
+			max = segment.Max().Key
+		}
+	}
+
+	return min, max
+}
@@ -0,0 +1,220 @@
+package kv_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/mock"
+	"github.com/matryer/is"
+)
+
+func TestLeveledStrategyLiteral(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	// A strategy which wasn't created with NewLeveledStrategy still works
+	strategy := &kv.LeveledStrategy{FanOut: 10, L0Trigger: count, LevelSize: 50}
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+	compactor := kv.NewCompactor(store, 40)
+
+	for {
+		ran, err := compactor.Compact()
+		is.NoErr(err)
+		if !ran {
+			break
+		}
+	}
+	is.True(len(store.Levels()) > 1)
+
+	for i := 1; i < size; i++ {
+		pair, err := store.Get(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+	}
+}
+
+func TestLeveledStrategyConcurrent(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	// The first level goes over its budget once the buffer is merged into it
+	strategy := kv.NewLeveledStrategy(count, 50, 10)
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+	ran, err := kv.NewCompactor(store, 40).Compact()
+	is.NoErr(err)
+	is.True(ran)
+
+	// Tasks can be picked from several goroutines at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if task := strategy.Pick(store.Layout()); task == nil || task.Level != 1 {
+					t.Error("expected a task for the second level")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSizeTieredStrategy(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	strategy := kv.NewSizeTieredStrategy(count, 32, 0.5, 1.5)
+	store, err := NewBufferedStore(count, size, strategy)
+	is.NoErr(err)
+	compactor := kv.NewCompactor(store, 1024*1024)
+
+	// Similar segments are merged back into the buffer
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+	is.Equal(len(store.Buffer()), 1)
+	is.Equal(len(store.Levels()), 0)
+
+	for i := 1; i < size; i++ {
+		pair, err := store.Get(fmt.Sprintf("key%04d", i))
+		is.NoErr(err)
+		is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+	}
+
+	// Nothing older remains so tombstones are dropped
+	_, err = store.Lookup("key0000")
+	is.Equal(err, kv.ErrorNoSuchKey)
+
+	// A single segment is below the threshold
+	ran, err = compactor.Compact()
+	is.NoErr(err)
+	is.True(!ran)
+}
+
+func TestSizeTieredStrategyPosition(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+	strategy := kv.NewSizeTieredStrategy(count, 32, 0.5, 1.5)
+
+	// One large segment followed by several small ones
+	_, err := FillBufferedStore(&backend, &log, 1, size*10, strategy)
+	is.NoErr(err)
+	store, err := FillBufferedStore(&backend, &log, count, size, strategy)
+	is.NoErr(err)
+	large := store.Buffer()[0]
+
+	// Only the small segments are merged and they keep their position
+	compactor := kv.NewCompactor(store, 1024*1024)
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+
+	buffer := store.Buffer()
+	is.Equal(len(buffer), 2)
+	is.Equal(buffer[0].ID(), large.ID())
+
+	// Older data remains so tombstones are kept
+	pair, err := store.Lookup("key0000")
+	is.NoErr(err)
+	is.True(pair.Tombstone)
+
+	// Newer segments are still appended after the merged one
+	memStore := mock.NewMockMemoryStore([]kv.KVPair{kv.NewKVPair("key0001", []byte("newest"))})
+	newest, err := store.New(&memStore)
+	is.NoErr(err)
+
+	// Reopened store has the same buffer order
+	recovered, err := kv.OpenSegmentStore(&backend, &log, strategy, nil)
+	is.NoErr(err)
+	is.Equal(SegmentIDs(recovered.Buffer()), []kv.SegmentID{large.ID(), buffer[1].ID(), newest})
+
+	pair, err = recovered.Get("key0001")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte("newest"))
+
+	pair, err = recovered.Get("key0002")
+	is.NoErr(err)
+	is.Equal(pair.Value, []byte(fmt.Sprintf("segment%d", count-1)))
+}
+
+func TestFIFOStrategy(t *testing.T) {
+	count := 4
+	size := 10
+	is := is.New(t)
+
+	// Oldest segments are dropped until the buffer fits
+	store, err := NewBufferedStore(count, size, kv.NewFIFOStrategy(300, 0))
+	is.NoErr(err)
+	buffer := store.Buffer()
+
+	compactor := kv.NewCompactor(store, 1024*1024)
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+	is.Equal(SegmentIDs(store.Buffer()), SegmentIDs(buffer[2:]))
+
+	ran, err = compactor.Compact()
+	is.NoErr(err)
+	is.True(!ran)
+
+	// Expired segments are dropped
+	store, err = NewBufferedStore(count, size, kv.NewFIFOStrategy(0, time.Millisecond))
+	is.NoErr(err)
+	time.Sleep(5 * time.Millisecond)
+
+	compactor = kv.NewCompactor(store, 1024*1024)
+	ran, err = compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+	is.Equal(len(store.Buffer()), 0)
+}
+
+func TestFIFOStrategyTTLAndMaxSize(t *testing.T) {
+	count := 2
+	size := 10
+	is := is.New(t)
+	backend := mock.NewMockSegmentBackend()
+	log := mock.NewMockLog()
+	strategy := kv.NewFIFOStrategy(300, 50*time.Millisecond)
+
+	// Two segments which expire followed by two which still fit
+	_, err := FillBufferedStore(&backend, &log, count, size, strategy)
+	is.NoErr(err)
+	time.Sleep(100 * time.Millisecond)
+	store, err := FillBufferedStore(&backend, &log, count, size, strategy)
+	is.NoErr(err)
+	buffer := store.Buffer()
+	is.Equal(len(buffer), 2*count)
+
+	// Expired segments don't count towards the size of the buffer
+	compactor := kv.NewCompactor(store, 1024*1024)
+	ran, err := compactor.Compact()
+	is.NoErr(err)
+	is.True(ran)
+	is.Equal(SegmentIDs(store.Buffer()), SegmentIDs(buffer[count:]))
+}
+
+func TestCompactorNoStrategy(t *testing.T) {
+	is := is.New(t)
+
+	store, err := NewBufferedStore(4, 10, nil)
+	is.NoErr(err)
+
+	ran, err := kv.NewCompactor(store, 1024*1024).Compact()
+	is.NoErr(err)
+	is.True(!ran)
+	is.Equal(len(store.Buffer()), 4)
+}
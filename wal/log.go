@@ -0,0 +1,443 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/jmgilman/kv"
+	"github.com/spf13/afero"
+)
+
+var ErrorCorruptLog = errors.New("log is corrupted")
+var ErrorEncoderMismatch = errors.New("log was written with a different encoder")
+var ErrorIndexNotFound = errors.New("index not found")
+var ErrorLogClosed = errors.New("log is closed")
+var ErrorLogFailed = errors.New("log failed after a write error")
+var ErrorOutOfOrder = errors.New("index is out of order")
+var ErrorUnknownFormat = errors.New("log segment has an unknown format")
+
+// Log implements kv.Log by persisting LogEntry's to a series of segment files
+// on disk. Each segment starts with a header identifying its format and the
+// encoder its entries are written with, followed by a record for each entry
+// prefixed with its length and a CRC32C checksum of its contents. When the
+// active segment grows past the configured size a new segment is started.
+//
+// When a Log is opened any partially written record at the end of the last
+// segment is truncated, leaving the log at the last valid entry. The same is
+// done when a write fails, and if that isn't possible the log refuses any
+// further writes.
+type Log struct {
+	closed      bool
+	encoder     kv.Encoder
+	failed      bool
+	file        afero.File
+	fs          afero.Fs
+	root        string
+	segmentSize int64
+	segments    []*segment
+}
+
+// Close closes the active segment file.
+func (l *Log) Close() error {
+	if l.closed {
+		return ErrorLogClosed
+	}
+	l.closed = true
+
+	if l.file != nil {
+		return l.file.Close()
+	}
+
+	return nil
+}
+
+// First returns the index of the first entry in the log or zero if the log is
+// empty.
+func (l *Log) First() (uint64, error) {
+	if len(l.segments) == 0 {
+		return 0, nil
+	}
+
+	return l.segments[0].start, nil
+}
+
+// Last returns the index of the last entry in the log or zero if the log is
+// empty.
+func (l *Log) Last() (uint64, error) {
+	if len(l.segments) == 0 {
+		return 0, nil
+	}
+
+	return l.tail().last(), nil
+}
+
+// Read returns the entry at the given index. Returns ErrorIndexNotFound if the
+// index is not in the log.
+func (l *Log) Read(index uint64) (kv.LogEntry, error) {
+	if l.closed {
+		return kv.LogEntry{}, ErrorLogClosed
+	}
+
+	i := l.findSegment(index)
+	if i < 0 {
+		return kv.LogEntry{}, ErrorIndexNotFound
+	}
+
+	// The active segment is already open
+	s := l.segments[i]
+	if s == l.tail() {
+		return s.read(l.file, l.encoder, index)
+	}
+
+	file, err := openSegment(l.fs, s)
+	if err != nil {
+		return kv.LogEntry{}, err
+	}
+	defer file.Close()
+
+	return s.read(file, l.encoder, index)
+}
+
+// TruncateFront removes all entries with an index lower than the given index.
+// Segments which only contain removed entries are deleted and the segment
+// containing the given index is rewritten to start at it.
+func (l *Log) TruncateFront(index uint64) error {
+	if l.closed {
+		return ErrorLogClosed
+	}
+
+	if len(l.segments) == 0 || index <= l.segments[0].start {
+		return nil
+	}
+
+	// Remove everything
+	if index > l.tail().last() {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+		l.file = nil
+
+		return l.removeSegments(len(l.segments))
+	}
+
+	// Remove all segments before the one containing the index
+	i := l.findSegment(index)
+	if err := l.removeSegments(i); err != nil {
+		return err
+	}
+
+	if l.segments[0].start == index {
+		return nil
+	}
+
+	return l.rewriteFirst(index)
+}
+
+// Write appends the given entry to the log. The index must be one greater
+// than the index of the last entry, or any non-zero index if the log is empty.
+func (l *Log) Write(index uint64, entry kv.LogEntry) error {
+	if l.closed {
+		return ErrorLogClosed
+	} else if l.failed {
+		return ErrorLogFailed
+	}
+
+	if index == 0 || (len(l.segments) > 0 && index != l.tail().last()+1) {
+		return ErrorOutOfOrder
+	}
+
+	record, err := encodeEntry(l.encoder, index, entry)
+	if err != nil {
+		return err
+	}
+
+	// Start a new segment if there isn't one or the current one is full
+	if len(l.segments) == 0 || l.tail().size >= l.segmentSize {
+		if err := l.roll(index); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(record)
+	if err == nil {
+		err = l.file.Sync()
+	}
+
+	if err != nil {
+		l.discard()
+		return err
+	}
+
+	tail := l.tail()
+	tail.offsets = append(tail.offsets, tail.size)
+	tail.size += int64(n)
+
+	return nil
+}
+
+// discard truncates the active segment to the end of its last complete record
+// after a failed write so that no new records are appended after a partial
+// one. If that fails the log is marked as failed.
+func (l *Log) discard() {
+	size := l.tail().size
+	if err := l.file.Truncate(size); err != nil {
+		l.failed = true
+		return
+	}
+
+	if _, err := l.file.Seek(size, io.SeekStart); err != nil {
+		l.failed = true
+	}
+}
+
+// findSegment returns the position of the segment containing the given index
+// or -1 if no segment contains it.
+func (l *Log) findSegment(index uint64) int {
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].last() >= index
+	})
+
+	if i == len(l.segments) || index < l.segments[i].start {
+		return -1
+	}
+
+	return i
+}
+
+// load reads all segment files in the root directory, validating each record
+// and truncating a partially written record at the end of the last segment.
+func (l *Log) load() error {
+	if err := l.fs.MkdirAll(l.root, 0755); err != nil {
+		return err
+	}
+
+	infos, err := afero.ReadDir(l.fs, l.root)
+	if err != nil {
+		return err
+	}
+
+	var segments []*segment
+	for _, info := range infos {
+		name := info.Name()
+
+		// Leftovers from an interrupted rewrite
+		if strings.HasSuffix(name, ".tmp") {
+			if err := l.fs.Remove(path.Join(l.root, name)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var start uint64
+		if _, err := fmt.Sscanf(name, "wal-%020d.log", &start); err != nil {
+			continue
+		}
+
+		s := newSegment(l.root, start)
+		s.size = info.Size()
+		segments = append(segments, s)
+	}
+
+	// File names are zero-padded so they're already in index order
+	for i, s := range segments {
+		if err := l.loadSegment(s, i == len(segments)-1); err != nil {
+			return err
+		}
+
+		// A rewritten segment supersedes the segment it was copied from
+		if len(l.segments) > 0 && s.start <= l.tail().last() {
+			if err := l.removeSegments(len(l.segments)); err != nil {
+				return err
+			}
+		}
+
+		if len(l.segments) > 0 && s.start != l.tail().last()+1 {
+			return ErrorCorruptLog
+		}
+
+		l.segments = append(l.segments, s)
+	}
+
+	if len(l.segments) == 0 {
+		return nil
+	}
+
+	// Drop the last segment if a torn write left it empty
+	if len(l.tail().offsets) == 0 {
+		if err := l.fs.Remove(l.tail().path); err != nil {
+			return err
+		}
+		l.segments = l.segments[:len(l.segments)-1]
+
+		if len(l.segments) == 0 {
+			return nil
+		}
+	}
+
+	return l.openTail()
+}
+
+// loadSegment scans the given segment. If it's the last segment in the log,
+// any invalid data at the end of it is assumed to be a torn write and is
+// truncated, otherwise ErrorCorruptLog is returned.
+func (l *Log) loadSegment(s *segment, last bool) error {
+	file, err := l.fs.OpenFile(s.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := s.scan(file, l.encoder)
+	if err != nil {
+		if !errors.Is(err, errorInvalidRecord) && !errors.Is(err, io.EOF) {
+			return err
+		} else if !last {
+			return ErrorCorruptLog
+		}
+
+		if err := file.Truncate(offset); err != nil {
+			return err
+		}
+		s.size = offset
+	}
+
+	return nil
+}
+
+// openTail opens the last segment for appending new records.
+func (l *Log) openTail() error {
+	file, err := l.fs.OpenFile(l.tail().path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	return nil
+}
+
+// removeSegments deletes the first n segments.
+func (l *Log) removeSegments(n int) error {
+	for _, s := range l.segments[:n] {
+		if err := l.fs.Remove(s.path); err != nil {
+			return err
+		}
+	}
+
+	l.segments = l.segments[n:]
+	return nil
+}
+
+// rewriteFirst copies the entries from the given index onwards in the first
+// segment into a new segment starting at the index. The new segment is
+// written to a temporary file and renamed before the old segment is removed.
+func (l *Log) rewriteFirst(index uint64) error {
+	old := l.segments[0]
+	isTail := old == l.tail()
+
+	// Read the entries being kept
+	file, err := openSegment(l.fs, old)
+	if err != nil {
+		return err
+	}
+
+	offset := old.offsets[index-old.start]
+	data := make([]byte, old.size-offset)
+	_, err = file.ReadAt(data, offset)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	// Write them to the new segment
+	s := newSegment(l.root, index)
+	s.size = segmentHeaderSize + int64(len(data))
+	for _, o := range old.offsets[index-old.start:] {
+		s.offsets = append(s.offsets, o-offset+segmentHeaderSize)
+	}
+
+	data = append(encodeHeader(l.encoder), data...)
+	if err := afero.WriteFile(l.fs, s.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	if err := l.fs.Rename(s.path+".tmp", s.path); err != nil {
+		return err
+	}
+
+	if isTail {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := l.fs.Remove(old.path); err != nil {
+		return err
+	}
+	l.segments[0] = s
+
+	if isTail {
+		return l.openTail()
+	}
+
+	return nil
+}
+
+// roll closes the active segment and starts a new one at the given index.
+func (l *Log) roll(index uint64) error {
+	if l.file != nil {
+		if err := l.file.Close(); err != nil {
+			return err
+		}
+	}
+
+	s := newSegment(l.root, index)
+	file, err := l.fs.OpenFile(s.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(encodeHeader(l.encoder)); err != nil {
+		file.Close()
+		return err
+	}
+	s.size = segmentHeaderSize
+
+	l.file = file
+	l.segments = append(l.segments, s)
+	return nil
+}
+
+// tail returns the last segment in the log.
+func (l *Log) tail() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// Open opens the log stored in the given root directory, creating it if it
+// doesn't exist. Entries are encoded with the given encoder and a new segment
+// file is started once the active one reaches segmentSize bytes. Returns
+// ErrorUnknownFormat if a segment wasn't written in a known format and
+// ErrorEncoderMismatch if it was written with a different encoder.
+func Open(fs afero.Fs, root string, encoder kv.Encoder, segmentSize int) (*Log, error) {
+	log := &Log{
+		encoder:     encoder,
+		fs:          fs,
+		root:        root,
+		segmentSize: int64(segmentSize),
+	}
+
+	if err := log.load(); err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
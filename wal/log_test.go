@@ -0,0 +1,398 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/jmgilman/kv"
+	"github.com/jmgilman/kv/encoders"
+	"github.com/matryer/is"
+	"github.com/spf13/afero"
+)
+
+func NewTestLog(fs afero.Fs, segmentSize int) (*Log, error) {
+	return Open(fs, "test", encoders.NewByteEncoder(), segmentSize)
+}
+
+func NewTestEntry(i int) kv.LogEntry {
+	key := fmt.Sprintf("key%04d", i)
+	return kv.NewLogEntry(kv.LogKeyPut, []kv.KVPair{kv.NewKVPair(key, []byte(key))})
+}
+
+func WriteTestEntries(log *Log, start int, count int) error {
+	for i := start; i < start+count; i++ {
+		if err := log.Write(uint64(i), NewTestEntry(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestLogRead(t *testing.T) {
+	size := 10
+	is := is.New(t)
+
+	log, err := NewTestLog(afero.NewMemMapFs(), 64)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+
+	// Small segment size causes multiple segments
+	is.True(len(log.segments) > 1)
+
+	// All entries can be read back
+	for i := 1; i <= size; i++ {
+		entry, err := log.Read(uint64(i))
+		is.NoErr(err)
+		is.Equal(entry, NewTestEntry(i))
+	}
+
+	// Nonexistent entries
+	_, err = log.Read(0)
+	is.True(errors.Is(err, ErrorIndexNotFound))
+	_, err = log.Read(uint64(size + 1))
+	is.True(errors.Is(err, ErrorIndexNotFound))
+}
+
+func TestLogWrite(t *testing.T) {
+	is := is.New(t)
+
+	log, err := NewTestLog(afero.NewMemMapFs(), 1024)
+	is.NoErr(err)
+
+	// Empty log
+	first, err := log.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(0))
+
+	// Writes must be sequential
+	is.NoErr(log.Write(1, NewTestEntry(1)))
+	is.True(errors.Is(log.Write(3, NewTestEntry(3)), ErrorOutOfOrder))
+	is.True(errors.Is(log.Write(1, NewTestEntry(1)), ErrorOutOfOrder))
+	is.NoErr(log.Write(2, NewTestEntry(2)))
+
+	first, err = log.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(1))
+
+	last, err := log.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(2))
+}
+
+// errorWrite is returned by a FaultyFile.
+var errorWrite = errors.New("write failed")
+
+// FaultyFile wraps an afero.File and fails writes after writing half of the
+// given data, or fails syncs if SyncErr is set. Truncates fail if
+// TruncateErr is set.
+type FaultyFile struct {
+	afero.File
+	SyncErr     bool
+	TruncateErr bool
+}
+
+func (f *FaultyFile) Sync() error {
+	if f.SyncErr {
+		return errorWrite
+	}
+
+	return f.File.Sync()
+}
+
+func (f *FaultyFile) Truncate(size int64) error {
+	if f.TruncateErr {
+		return errorWrite
+	}
+
+	return f.File.Truncate(size)
+}
+
+func (f *FaultyFile) Write(data []byte) (int, error) {
+	if f.SyncErr {
+		return f.File.Write(data)
+	}
+
+	n, err := f.File.Write(data[:len(data)/2])
+	if err != nil {
+		return n, err
+	}
+
+	return n, errorWrite
+}
+
+func TestLogWriteError(t *testing.T) {
+	size := 5
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 1024)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+
+	// Partial record is discarded
+	file := log.file
+	log.file = &FaultyFile{File: file}
+	is.True(errors.Is(log.Write(uint64(size+1), NewTestEntry(size+1)), errorWrite))
+
+	// Record which failed to sync is discarded
+	log.file = &FaultyFile{File: file, SyncErr: true}
+	is.True(errors.Is(log.Write(uint64(size+1), NewTestEntry(size+1)), errorWrite))
+
+	// Entry can be written again once the error clears
+	log.file = file
+	is.NoErr(log.Write(uint64(size+1), NewTestEntry(size+1)))
+	is.NoErr(log.Write(uint64(size+2), NewTestEntry(size+2)))
+	is.NoErr(log.Close())
+
+	// Nothing is left of the failed writes on disk
+	log, err = NewTestLog(fs, 1024)
+	is.NoErr(err)
+
+	last, err := log.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size+2))
+
+	for i := 1; i <= size+2; i++ {
+		entry, err := log.Read(uint64(i))
+		is.NoErr(err)
+		is.Equal(entry, NewTestEntry(i))
+	}
+
+	// Log refuses writes once a partial record can't be discarded
+	log.file = &FaultyFile{File: log.file, TruncateErr: true}
+	is.True(errors.Is(log.Write(uint64(size+3), NewTestEntry(size+3)), errorWrite))
+	is.True(errors.Is(log.Write(uint64(size+3), NewTestEntry(size+3)), ErrorLogFailed))
+}
+
+func TestLogOpen(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 64)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.Close())
+
+	// Entries are loaded from disk
+	log, err = NewTestLog(fs, 64)
+	is.NoErr(err)
+
+	last, err := log.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size))
+
+	for i := 1; i <= size; i++ {
+		entry, err := log.Read(uint64(i))
+		is.NoErr(err)
+		is.Equal(entry, NewTestEntry(i))
+	}
+
+	// Log can be appended to after being opened
+	is.NoErr(log.Write(uint64(size+1), NewTestEntry(size+1)))
+	entry, err := log.Read(uint64(size + 1))
+	is.NoErr(err)
+	is.Equal(entry, NewTestEntry(size+1))
+}
+
+func TestLogOpenTornWrite(t *testing.T) {
+	size := 5
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 1024)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.Close())
+
+	// Cut the last record in half
+	tail := log.tail()
+	cut := tail.offsets[size-1] + (tail.size-tail.offsets[size-1])/2
+	file, err := fs.OpenFile(tail.path, os.O_RDWR, 0644)
+	is.NoErr(err)
+	is.NoErr(file.Truncate(cut))
+	is.NoErr(file.Close())
+
+	// Log is truncated to the last valid record
+	log, err = NewTestLog(fs, 1024)
+	is.NoErr(err)
+
+	last, err := log.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size-1))
+
+	stat, err := fs.Stat(tail.path)
+	is.NoErr(err)
+	is.Equal(stat.Size(), tail.offsets[size-1])
+
+	// Torn record can be rewritten
+	is.NoErr(log.Write(uint64(size), NewTestEntry(size)))
+	entry, err := log.Read(uint64(size))
+	is.NoErr(err)
+	is.Equal(entry, NewTestEntry(size))
+}
+
+func TestLogOpenCorrupt(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 64)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.Close())
+
+	// Flip a byte in the first segment
+	file, err := fs.OpenFile(log.segments[0].path, os.O_RDWR, 0644)
+	is.NoErr(err)
+	_, err = file.WriteAt([]byte{0xFF}, segmentHeaderSize+recordHeaderSize+1)
+	is.NoErr(err)
+	is.NoErr(file.Close())
+
+	// Corruption outside of the tail is an error
+	_, err = NewTestLog(fs, 64)
+	is.True(errors.Is(err, ErrorCorruptLog))
+}
+
+// OldEncoder is a ByteEncoder which identifies itself as an older version.
+type OldEncoder struct {
+	kv.Encoder
+}
+
+func (OldEncoder) ID() uint32 {
+	return 1
+}
+
+func TestLogOpenFormat(t *testing.T) {
+	size := 5
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 1024)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.Close())
+
+	// Entries aren't decoded with a different encoder
+	_, err = Open(fs, "test", OldEncoder{encoders.NewByteEncoder()}, 1024)
+	is.True(errors.Is(err, ErrorEncoderMismatch))
+
+	// Segments without a header are rejected rather than truncated
+	path := log.segments[0].path
+	data, err := afero.ReadFile(fs, path)
+	is.NoErr(err)
+	is.NoErr(afero.WriteFile(fs, path, data[segmentHeaderSize:], 0644))
+
+	_, err = NewTestLog(fs, 1024)
+	is.True(errors.Is(err, ErrorUnknownFormat))
+
+	stat, err := fs.Stat(path)
+	is.NoErr(err)
+	is.Equal(stat.Size(), int64(len(data)-segmentHeaderSize))
+
+	// Unknown versions are rejected
+	binary.BigEndian.PutUint32(data[4:8], FormatV1+1)
+	is.NoErr(afero.WriteFile(fs, path, data, 0644))
+
+	_, err = NewTestLog(fs, 1024)
+	is.True(errors.Is(err, ErrorUnknownFormat))
+}
+
+func TestLogOpenTornHeader(t *testing.T) {
+	size := 5
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 1024)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.Close())
+
+	// Start a segment whose header was cut short
+	torn := newSegment("test", uint64(size+1))
+	is.NoErr(afero.WriteFile(fs, torn.path, encodeHeader(encoders.NewByteEncoder())[:5], 0644))
+
+	// Torn segment is dropped
+	log, err = NewTestLog(fs, 1024)
+	is.NoErr(err)
+
+	last, err := log.Last()
+	is.NoErr(err)
+	is.Equal(last, uint64(size))
+
+	_, err = fs.Stat(torn.path)
+	is.True(os.IsNotExist(err))
+}
+
+func TestLogTruncateFront(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	log, err := NewTestLog(fs, 64)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+
+	// Remove the first half of the entries
+	is.NoErr(log.TruncateFront(6))
+
+	first, err := log.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(6))
+
+	_, err = log.Read(5)
+	is.True(errors.Is(err, ErrorIndexNotFound))
+
+	for i := 6; i <= size; i++ {
+		entry, err := log.Read(uint64(i))
+		is.NoErr(err)
+		is.Equal(entry, NewTestEntry(i))
+	}
+
+	// Truncation survives reopening
+	is.NoErr(log.Close())
+	log, err = NewTestLog(fs, 64)
+	is.NoErr(err)
+
+	first, err = log.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(6))
+
+	// Removing everything empties the log
+	is.NoErr(log.TruncateFront(uint64(size + 1)))
+
+	first, err = log.First()
+	is.NoErr(err)
+	is.Equal(first, uint64(0))
+
+	infos, err := afero.ReadDir(fs, "test")
+	is.NoErr(err)
+	is.Equal(len(infos), 0)
+
+	// Empty log can be written to
+	is.NoErr(log.Write(1, NewTestEntry(1)))
+}
+
+func TestLogTruncateFrontTail(t *testing.T) {
+	size := 10
+	is := is.New(t)
+	fs := afero.NewMemMapFs()
+
+	// Large segment size keeps everything in one segment
+	log, err := NewTestLog(fs, 1024)
+	is.NoErr(err)
+	is.NoErr(WriteTestEntries(log, 1, size))
+	is.NoErr(log.TruncateFront(4))
+
+	// Active segment is still usable after being rewritten
+	is.NoErr(log.Write(uint64(size+1), NewTestEntry(size+1)))
+	for i := 4; i <= size+1; i++ {
+		entry, err := log.Read(uint64(i))
+		is.NoErr(err)
+		is.Equal(entry, NewTestEntry(i))
+	}
+}
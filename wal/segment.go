@@ -0,0 +1,252 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path"
+
+	"github.com/jmgilman/kv"
+	"github.com/spf13/afero"
+)
+
+// FormatV1 is the current version of the segment format.
+const FormatV1 uint32 = 1
+
+// recordHeaderSize is the size of the length and checksum which prefix every
+// record.
+const recordHeaderSize = 8
+
+// segmentMagic marks the start of every segment file.
+const segmentMagic uint32 = 0x6b762d77
+
+// segmentHeaderSize is the size of the header at the start of every segment
+// file. It's encoded as:
+//
+//	[uint32 magic][uint32 version][uint32 encoder ID]
+//
+// Records don't identify the encoder they were written with, so the header
+// ensures they're never decoded with a different one.
+const segmentHeaderSize = 12
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errorInvalidRecord is returned when a record fails validation while a
+// segment is being scanned.
+var errorInvalidRecord = errors.New("invalid record")
+
+// segment is a single file in a Log which holds a contiguous run of entries
+// starting at a given index. The byte offset of each record is kept in memory
+// so that individual entries can be read without scanning the file.
+type segment struct {
+	offsets []int64
+	path    string
+	size    int64
+	start   uint64
+}
+
+// last returns the index of the last entry in the segment.
+func (s *segment) last() uint64 {
+	return s.start + uint64(len(s.offsets)) - 1
+}
+
+// read returns the entry at the given index from the segment file.
+func (s *segment) read(file io.ReaderAt, encoder kv.Encoder, index uint64) (kv.LogEntry, error) {
+	offset := s.offsets[index-s.start]
+	_, payload, err := readRecord(file, offset, s.size)
+	if err != nil {
+		return kv.LogEntry{}, err
+	}
+
+	entryIndex, entry, err := decodeEntry(encoder, payload)
+	if err != nil {
+		return kv.LogEntry{}, err
+	} else if entryIndex != index {
+		return kv.LogEntry{}, ErrorCorruptLog
+	}
+
+	return entry, nil
+}
+
+// scan checks the header of the segment file and then reads every record in
+// it, validating the checksum and index of each. It stops at the first invalid
+// record and returns errorInvalidRecord along with the offset at which the
+// valid data ends.
+func (s *segment) scan(file io.ReaderAt, encoder kv.Encoder) (int64, error) {
+	if err := checkHeader(file, s.size, encoder); err != nil {
+		return 0, err
+	}
+
+	offset := int64(segmentHeaderSize)
+	for offset < s.size {
+		n, payload, err := readRecord(file, offset, s.size)
+		if err != nil {
+			return offset, err
+		}
+
+		index, _, err := decodeEntry(encoder, payload)
+		if err != nil || index != s.start+uint64(len(s.offsets)) {
+			return offset, errorInvalidRecord
+		}
+
+		s.offsets = append(s.offsets, offset)
+		offset += n
+	}
+
+	return offset, nil
+}
+
+// checkHeader reads the header of a segment file and checks that it was
+// written in a known format with the given encoder. Returns errorInvalidRecord
+// if the file is too short to hold a header, ErrorUnknownFormat if it's
+// missing or has an unknown version and ErrorEncoderMismatch if it was written
+// with a different encoder.
+func checkHeader(file io.ReaderAt, size int64, encoder kv.Encoder) error {
+	if size < segmentHeaderSize {
+		return errorInvalidRecord
+	}
+
+	header := make([]byte, segmentHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	// Segments written before the header was added start with a record
+	if binary.BigEndian.Uint32(header[0:4]) != segmentMagic {
+		return fmt.Errorf("%w: missing header", ErrorUnknownFormat)
+	}
+
+	version := binary.BigEndian.Uint32(header[4:8])
+	if version != FormatV1 {
+		return fmt.Errorf("%w: version %d", ErrorUnknownFormat, version)
+	}
+
+	encoderID := binary.BigEndian.Uint32(header[8:12])
+	if encoderID != encoder.ID() {
+		return fmt.Errorf("%w: encoder %d", ErrorEncoderMismatch, encoderID)
+	}
+
+	return nil
+}
+
+// decodeEntry decodes a record payload into its index and LogEntry.
+func decodeEntry(encoder kv.Encoder, payload []byte) (uint64, kv.LogEntry, error) {
+	reader := bytes.NewReader(payload)
+
+	var header struct {
+		Index  uint64
+		Action kv.LogAction
+		Count  uint32
+	}
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return 0, kv.LogEntry{}, err
+	}
+
+	var meta []kv.KVPair
+	for i := 0; i < int(header.Count); i++ {
+		pair, err := encoder.DecodePair(reader)
+		if err != nil {
+			return 0, kv.LogEntry{}, err
+		}
+
+		meta = append(meta, pair)
+	}
+
+	return header.Index, kv.NewLogEntry(header.Action, meta), nil
+}
+
+// encodeEntry encodes the given LogEntry into a record consisting of a length
+// prefix, a CRC32C checksum, and the encoded index, action, and metadata.
+func encodeEntry(encoder kv.Encoder, index uint64, entry kv.LogEntry) ([]byte, error) {
+	payload := bytes.NewBuffer([]byte{})
+	if err := binary.Write(payload, binary.BigEndian, index); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(payload, binary.BigEndian, entry.Action); err != nil {
+		return nil, err
+	}
+
+	if err := binary.Write(payload, binary.BigEndian, uint32(len(entry.Meta))); err != nil {
+		return nil, err
+	}
+
+	for _, pair := range entry.Meta {
+		encoded, err := encoder.EncodePair(pair)
+		if err != nil {
+			return nil, err
+		}
+
+		payload.Write(encoded)
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, recordHeaderSize+payload.Len()))
+	binary.Write(buf, binary.BigEndian, uint32(payload.Len()))
+	binary.Write(buf, binary.BigEndian, crc32.Checksum(payload.Bytes(), crcTable))
+	buf.Write(payload.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+// encodeHeader returns the header of a segment whose entries are written with
+// the given encoder.
+func encodeHeader(encoder kv.Encoder) []byte {
+	header := make([]byte, segmentHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], segmentMagic)
+	binary.BigEndian.PutUint32(header[4:8], FormatV1)
+	binary.BigEndian.PutUint32(header[8:12], encoder.ID())
+
+	return header
+}
+
+// readRecord reads the record at the given offset and returns its total size
+// along with its payload. Returns errorInvalidRecord if the record extends
+// past the given size or fails its checksum.
+func readRecord(file io.ReaderAt, offset int64, size int64) (int64, []byte, error) {
+	if offset+recordHeaderSize > size {
+		return 0, nil, errorInvalidRecord
+	}
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return 0, nil, err
+	}
+
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	checksum := binary.BigEndian.Uint32(header[4:8])
+	if offset+recordHeaderSize+length > size {
+		return 0, nil, errorInvalidRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return 0, nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != checksum {
+		return 0, nil, errorInvalidRecord
+	}
+
+	return recordHeaderSize + length, payload, nil
+}
+
+// segmentName returns the file name of the segment starting at the given
+// index.
+func segmentName(start uint64) string {
+	return fmt.Sprintf("wal-%020d.log", start)
+}
+
+func newSegment(root string, start uint64) *segment {
+	return &segment{
+		path:  path.Join(root, segmentName(start)),
+		start: start,
+	}
+}
+
+// openSegment opens the segment file for reading.
+func openSegment(fs afero.Fs, s *segment) (afero.File, error) {
+	return fs.Open(s.path)
+}